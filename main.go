@@ -1,14 +1,19 @@
 package main
 
 import (
-	"encoding/base64"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
+	"fmt"
 	"log"
 	"maps"
 	"os"
 	"slices"
+	"time"
 
 	"github.com/dop251/goja"
+	"github.com/dop251/goja_nodejs/buffer"
 	"github.com/dop251/goja_nodejs/console"
 	"github.com/dop251/goja_nodejs/require"
 	"github.com/gatewayd-io/gatewayd-plugin-js/plugin"
@@ -25,29 +30,6 @@ import (
 )
 
 func setupHelpers(runtime *goja.Runtime) error {
-	if err := runtime.Set("btoa", func(call goja.FunctionCall) goja.Value {
-		if len(call.Arguments) < 1 {
-			panic(runtime.NewTypeError("btoa requires 1 argument"))
-		}
-		return runtime.ToValue(
-			base64.StdEncoding.EncodeToString([]byte(call.Arguments[0].String())))
-	}); err != nil {
-		return err
-	}
-
-	if err := runtime.Set("atob", func(call goja.FunctionCall) goja.Value {
-		if len(call.Arguments) < 1 {
-			panic(runtime.NewTypeError("atob requires 1 argument"))
-		}
-		decoded, err := base64.StdEncoding.DecodeString(call.Arguments[0].String())
-		if err != nil {
-			panic(runtime.NewTypeError("atob: invalid base64 input: " + err.Error()))
-		}
-		return runtime.ToValue(string(decoded))
-	}); err != nil {
-		return err
-	}
-
 	if err := runtime.Set("parseSQL", func(call goja.FunctionCall) goja.Value {
 		if len(call.Arguments) < 1 {
 			panic(runtime.NewTypeError("parseSQL requires 1 argument"))
@@ -75,6 +57,8 @@ func main() {
 	}
 
 	logLevel := flag.String("log-level", "info", "Log level")
+	printChecksums := flag.Bool(
+		"print-script-checksums", false, "Print the checksums and digest of the script bundle and exit")
 	flag.Parse()
 
 	logger := hclog.New(&hclog.LoggerOptions{
@@ -82,29 +66,16 @@ func main() {
 		Output:     os.Stderr,
 		JSONFormat: true,
 		Color:      hclog.ColorOff,
+		// The level of the script logger is independent of the plugin.
+		IndependentLevels: true,
 	})
 
 	pluginInstance := plugin.NewJSPlugin(&plugin.Plugin{
-		Logger:   logger,
-		VM:       goja.New(),
-		Bindings: map[string]goja.Callable{},
+		Logger:      logger,
+		Bindings:    map[string]goja.Callable{},
+		Connections: plugin.NewConnectionTracker(),
 	})
 
-	registry := require.Registry{}
-	registry.Enable(pluginInstance.Impl.VM)
-
-	printer := console.StdPrinter{
-		StdoutPrint: func(s string) { pluginInstance.Impl.Logger.Info(s) },
-		StderrPrint: func(s string) { pluginInstance.Impl.Logger.Error(s) },
-	}
-	registry.RegisterNativeModule("console", console.RequireWithPrinter(printer))
-	console.Enable(pluginInstance.Impl.VM)
-
-	if err := pluginInstance.Impl.VM.Set("Value", pluginInstance.Impl.VM.ToValue(v1.NewValue)); err != nil {
-		logger.Error("Failed to set Value helper function", "error", err)
-		return
-	}
-
 	cfg := cast.ToStringMap(plugin.PluginConfig["config"])
 	if cfg == nil {
 		logger.Error("Failed to load plugin config")
@@ -116,26 +87,241 @@ func main() {
 		go metrics.ExposeMetrics(config, logger)
 	}
 
-	scriptPath := cast.ToString(cfg["scriptPath"])
-	script, err := os.ReadFile(scriptPath)
+	auditConfig := plugin.NewAuditConfig(cfg)
+	if auditConfig.Enabled {
+		auditor, err := plugin.NewAuditor(auditConfig, logger)
+		if err != nil {
+			logger.Error("Failed to start audit log", "error", err)
+			return
+		}
+		defer auditor.Close()
+		pluginInstance.Impl.Auditor = auditor
+	}
+
+	secrets, err := plugin.NewSecrets(
+		cast.ToString(cfg["scriptSecrets"]), cast.ToString(cfg["scriptEnvAllowList"]))
 	if err != nil {
-		logger.Error("Failed to read script file", "error", err)
+		logger.Error("Failed to load script secrets", "error", err)
 		return
 	}
+	pluginInstance.Impl.Secrets = secrets
+	pluginInstance.Impl.Redactor = plugin.NewRedactor(plugin.NewRedactionConfig(cfg), secrets)
+
+	// Secrets are redacted from the console output of scripts.
+	printer := console.StdPrinter{
+		StdoutPrint: func(s string) { pluginInstance.Impl.Logger.Info(secrets.Redact(s)) },
+		StderrPrint: func(s string) { pluginInstance.Impl.Logger.Error(secrets.Redact(s)) },
+	}
+
+	scriptLogger := plugin.NewScriptLogger(
+		plugin.NewLogConfig(cfg, logging.GetLogLevel(*logLevel)), logger, secrets)
+
+	fetchConfig := plugin.NewFetchConfig(cfg)
+	if len(fetchConfig.AllowedHosts) > 0 {
+		pluginInstance.Impl.Fetcher = plugin.NewFetcher(fetchConfig)
+	}
+
+	scheduler := plugin.NewScheduler(plugin.NewSchedulerConfig(cfg), pluginInstance.Impl)
+	pluginInstance.Impl.Scheduler = scheduler
+
+	scriptPath := cast.ToString(cfg["scriptPath"])
+	integrityConfig := plugin.NewIntegrityConfig(cfg)
+
+	// Archives and verified scripts are read once as a bundle, and only the
+	// bundle is ever run. The modules they require are loaded from the bundle.
+	var bundle *plugin.ScriptBundle
+	if plugin.IsScriptArchive(scriptPath) || integrityConfig.Enabled() || *printChecksums {
+		bundle, err = plugin.LoadScriptBundle(scriptPath)
+		if err != nil {
+			logger.Error("Failed to read script bundle", "error", err)
+			return
+		}
+		if *printChecksums {
+			fmt.Printf("%ssha256: %s\n", bundle.Checksums(), bundle.Digest())
+			return
+		}
+		if integrityConfig.Enabled() {
+			if err := bundle.Verify(integrityConfig); err != nil {
+				logger.Error("Refusing to start, because the script bundle failed verification", "error", err)
+				return
+			}
+			logger.Info("Verified script bundle", "digest", bundle.Digest(), "path", scriptPath)
+		}
+	}
+
+	var script []byte
+	if bundle != nil {
+		scriptPath = bundle.Entrypoint()
+		script = bundle.Script()
+	} else {
+		script, err = os.ReadFile(scriptPath)
+		if err != nil {
+			logger.Error("Failed to read script file", "error", err)
+			return
+		}
+	}
 	logger.Debug("Read script file", "bytes", len(script), "path", scriptPath)
 
-	if _, err = pluginInstance.Impl.VM.RunString(string(script)); err != nil {
-		logger.Error("Failed to run JS code", "error", err)
+	// The version of an archive is used unless a script version is configured.
+	scriptVersion := cast.ToString(cfg["scriptVersion"])
+	if manifest := bundle.GetManifest(); manifest != nil {
+		if scriptVersion == "" {
+			scriptVersion = manifest.Version
+		}
+		plugin.ScriptBundleInfo.WithLabelValues(manifest.Name, manifest.Version).Set(1)
+		logger.Info("Loaded script bundle", "name", manifest.Name, "version", manifest.Version)
+	}
+
+	tracing, err := plugin.NewTracing(plugin.NewTracingConfig(cfg), scriptVersion)
+	if err != nil {
+		logger.Error("Failed to start tracing", "error", err)
+		return
+	}
+	pluginInstance.Impl.Tracing = tracing
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tracing.Shutdown(ctx); err != nil {
+			logger.Error("Failed to shut down tracing", "error", err)
+		}
+	}()
+
+	scriptConfig, err := plugin.LoadScriptConfig(
+		cast.ToString(cfg["scriptConfigPath"]),
+		cast.ToString(cfg["scriptConfigEnvPrefix"]),
+		os.Environ())
+	if err != nil {
+		logger.Error("Failed to load script config", "error", err)
+		return
+	}
+	if err := bundle.GetManifest().ValidateConfig(scriptConfig); err != nil {
+		logger.Error("Failed to validate script config", "error", err)
+		return
+	}
+
+	if sentryDSN != "" {
+		scriptHash := sha256.Sum256(script)
+		pluginInstance.Impl.Reporter = plugin.NewReporter(
+			sentry.CurrentHub(), scriptVersion, hex.EncodeToString(scriptHash[:]), secrets,
+			cast.ToBool(cfg["sentryCaptureScriptErrors"]))
+		defer sentry.Flush(2 * time.Second)
+	}
+
+	pluginInstance.Impl.Limits = plugin.NewResourceLimits(cfg)
+	pluginInstance.Impl.SlowQuery = plugin.NewSlowQueryConfig(cfg)
+	pluginInstance.Impl.QueryLabels = plugin.NewFingerprintLabels(cfg)
+
+	mode, err := plugin.NewModeSwitch(plugin.NewModeConfig(cfg), logger)
+	if err != nil {
+		logger.Error("Failed to set the mode", "error", err)
 		return
 	}
+	pluginInstance.Impl.Mode = mode
+
+	if rewriteConfig := plugin.NewRewriteConfig(cfg); rewriteConfig.RulesPath != "" {
+		rewriter, err := plugin.LoadRewriteRules(rewriteConfig.RulesPath)
+		if err != nil {
+			logger.Error("Failed to load rewrite rules", "error", err)
+			return
+		}
+		pluginInstance.Impl.Rewriter = rewriter
+		logger.Info("Loaded rewrite rules", "rules", rewriter.Len(), "path", rewriteConfig.RulesPath)
+	}
+
+	// The script and its modules are compiled once and run in every new VM.
+	var loader require.SourceLoader
+	if bundle != nil {
+		loader = bundle.Load
+	}
+	programs := plugin.NewProgramCache(loader)
+
+	// Setup prepares a new VM and runs the script in it. It runs on start and
+	// again whenever the VM is recycled after exceeding a resource limit.
+	pluginInstance.Impl.Setup = func(vm *goja.Runtime) error {
+		registry := require.NewRegistry(require.WithLoader(programs.Load))
+		registry.RegisterNativeModule(plugin.CompiledModuleName, programs.Require)
+		registry.RegisterNativeModule("console", console.RequireWithPrinter(printer))
+		registry.RegisterNativeModule("crypto", plugin.RequireCrypto)
+		registry.RegisterNativeModule("log", scriptLogger.Require)
+		registry.Enable(vm)
+		buffer.Enable(vm)
+		console.Enable(vm)
+
+		if err := vm.Set("Value", vm.ToValue(plugin.NewValue)); err != nil {
+			return fmt.Errorf("failed to set Value helper function: %w", err)
+		}
+		if err := plugin.RegisterEncodingHelpers(vm); err != nil {
+			return fmt.Errorf("failed to register encoding helper functions: %w", err)
+		}
+		if err := plugin.RegisterStartupHelpers(vm); err != nil {
+			return fmt.Errorf("failed to register startup helper functions: %w", err)
+		}
+		if err := plugin.RegisterClassifyHelpers(vm); err != nil {
+			return fmt.Errorf("failed to register classify helper functions: %w", err)
+		}
+		if err := pluginInstance.Impl.RegisterAuditAPI(); err != nil {
+			return fmt.Errorf("failed to register audit functions: %w", err)
+		}
+		if err := pluginInstance.Impl.RegisterConnectionAPI(); err != nil {
+			return fmt.Errorf("failed to register connection functions: %w", err)
+		}
+		if err := pluginInstance.Impl.RegisterRespondAPI(); err != nil {
+			return fmt.Errorf("failed to register respond functions: %w", err)
+		}
+		if err := mode.Register(vm); err != nil {
+			return fmt.Errorf("failed to register mode functions: %w", err)
+		}
+		if err := pluginInstance.Impl.RegisterListenerAPI(); err != nil {
+			return fmt.Errorf("failed to register listener functions: %w", err)
+		}
+		if err := secrets.Register(vm); err != nil {
+			return fmt.Errorf("failed to register env and secrets functions: %w", err)
+		}
+		if err := pluginInstance.Impl.RegisterFetchAPI(); err != nil {
+			return fmt.Errorf("failed to register fetch function: %w", err)
+		}
+		if err := scheduler.Register(vm); err != nil {
+			return fmt.Errorf("failed to register scheduler functions: %w", err)
+		}
+		if err := pluginInstance.Impl.RegisterTracingAPI(); err != nil {
+			return fmt.Errorf("failed to register tracing functions: %w", err)
+		}
+		if err := pluginInstance.Impl.Reporter.Register(vm); err != nil {
+			return fmt.Errorf("failed to register sentry functions: %w", err)
+		}
+		if err := plugin.RegisterScriptConfig(vm, scriptConfig); err != nil {
+			return fmt.Errorf("failed to register script config: %w", err)
+		}
+
+		// The script path is the file name of the frames of JS stack traces.
+		program, err := programs.Compile("script", scriptPath, script)
+		if err != nil {
+			return fmt.Errorf("failed to compile JS code: %w", err)
+		}
+		if _, err := vm.RunProgram(program); err != nil {
+			return fmt.Errorf("failed to run JS code: %w", err)
+		}
 
-	pluginInstance.Impl.RegisterFunctions(slices.Collect(maps.Keys(plugin.Hooks)))
+		if err := plugin.ValidateScriptConfig(vm, scriptConfig); err != nil {
+			return fmt.Errorf("failed to validate script config: %w", err)
+		}
+
+		pluginInstance.Impl.RegisterFunctions(slices.Collect(maps.Keys(plugin.Hooks)))
+		if err := pluginInstance.Impl.CheckHooks(bundle.GetManifest()); err != nil {
+			return err
+		}
 
-	if err := setupHelpers(pluginInstance.Impl.VM); err != nil {
-		logger.Error("Failed to register helper functions", "error", err)
+		return setupHelpers(vm)
+	}
+
+	if err := pluginInstance.Impl.ResetRuntime(); err != nil {
+		logger.Error("Failed to set up JS runtime", "error", err)
 		return
 	}
 
+	scheduler.Start()
+	defer scheduler.Stop()
+
 	goplugin.Serve(&goplugin.ServeConfig{
 		HandshakeConfig: goplugin.HandshakeConfig{
 			ProtocolVersion:  1,
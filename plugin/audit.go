@@ -0,0 +1,424 @@
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/hashicorp/go-hclog"
+	"github.com/spf13/cast"
+)
+
+const (
+	AuditOutputFile   = "file"
+	AuditOutputSyslog = "syslog"
+
+	// syslogPriority is LOG_LOCAL0 | LOG_INFO.
+	syslogPriority = 134
+	syslogTag      = "gatewayd-plugin-js"
+)
+
+var ErrUnknownAuditOutput = errors.New("unknown audit output")
+
+type AuditConfig struct {
+	Enabled        bool
+	Hooks          map[string]bool
+	Output         string
+	FilePath       string
+	FileMaxSize    int64
+	FileMaxBackups int
+	SyslogNetwork  string
+	SyslogAddress  string
+	BufferSize     int
+	FlushInterval  time.Duration
+}
+
+// NewAuditConfig returns a new AuditConfig from the plugin config.
+func NewAuditConfig(config map[string]interface{}) *AuditConfig {
+	auditConfig := AuditConfig{
+		Enabled:        cast.ToBool(config["auditEnabled"]),
+		Hooks:          map[string]bool{},
+		Output:         cast.ToString(config["auditOutput"]),
+		FilePath:       cast.ToString(config["auditFilePath"]),
+		FileMaxSize:    cast.ToInt64(config["auditFileMaxSize"]) * 1024 * 1024,
+		FileMaxBackups: cast.ToInt(config["auditFileMaxBackups"]),
+		SyslogNetwork:  cast.ToString(config["auditSyslogNetwork"]),
+		SyslogAddress:  cast.ToString(config["auditSyslogAddress"]),
+		BufferSize:     cast.ToInt(config["auditBufferSize"]),
+		FlushInterval:  cast.ToDuration(config["auditFlushInterval"]),
+	}
+
+	for _, hook := range strings.Split(cast.ToString(config["auditHooks"]), ",") {
+		if hook = strings.TrimSpace(hook); hook != "" {
+			auditConfig.Hooks[hook] = true
+		}
+	}
+	if auditConfig.FlushInterval <= 0 {
+		auditConfig.FlushInterval = time.Second
+	}
+
+	return &auditConfig
+}
+
+// auditSink is the destination of the audit trail.
+type auditSink interface {
+	Write(line []byte) error
+	Flush() error
+	Close() error
+}
+
+// fileSink writes JSON lines to a file and rotates it once it grows
+// beyond maxSize, keeping at most maxBackups rotated files.
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	writer     *bufio.Writer
+	size       int64
+}
+
+func newFileSink(path string, maxSize int64, maxBackups int) (*fileSink, error) {
+	sink := &fileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.writer = bufio.NewWriter(file)
+	s.size = info.Size()
+	return nil
+}
+
+func (s *fileSink) rotate() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+
+	if s.maxBackups > 0 {
+		for i := s.maxBackups - 1; i > 0; i-- {
+			// Missing backups are expected until enough rotations happened.
+			_ = os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+func (s *fileSink) Write(line []byte) error {
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.writer.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) Flush() error {
+	return s.writer.Flush()
+}
+
+func (s *fileSink) Close() error {
+	if err := s.writer.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// syslogSink sends each JSON line as a single message to a local syslog socket.
+type syslogSink struct {
+	conn net.Conn
+}
+
+func newSyslogSink(network, address string) (*syslogSink, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{conn: conn}, nil
+}
+
+func (s *syslogSink) Write(line []byte) error {
+	_, err := fmt.Fprintf(s.conn, "<%d>%s %s[%d]: %s",
+		syslogPriority, time.Now().Format(time.Stamp), syslogTag, os.Getpid(), line)
+	return err
+}
+
+func (s *syslogSink) Flush() error {
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	return s.conn.Close()
+}
+
+// auditRecord is an entry waiting to be written. The query is fingerprinted
+// by the writer goroutine, so that the hooks are not slowed down by parsing.
+type auditRecord struct {
+	fields map[string]interface{}
+	query  string
+}
+
+// auditSession holds the startup parameters of a client connection.
+type auditSession struct {
+	user     string
+	database string
+}
+
+// Auditor writes an append-only audit trail of connection and query events.
+// All methods are safe to call on a nil Auditor, in which case they do nothing.
+type Auditor struct {
+	config   *AuditConfig
+	logger   hclog.Logger
+	sink     auditSink
+	records  chan auditRecord
+	done     chan struct{}
+	sessions map[string]auditSession
+	mu       sync.Mutex
+	closed   bool
+}
+
+// NewAuditor creates the audit sink and starts the background writer.
+func NewAuditor(config *AuditConfig, logger hclog.Logger) (*Auditor, error) {
+	var sink auditSink
+	var err error
+	switch config.Output {
+	case AuditOutputFile, "":
+		sink, err = newFileSink(config.FilePath, config.FileMaxSize, config.FileMaxBackups)
+	case AuditOutputSyslog:
+		sink, err = newSyslogSink(config.SyslogNetwork, config.SyslogAddress)
+	default:
+		err = fmt.Errorf("%w: %q", ErrUnknownAuditOutput, config.Output)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	auditor := &Auditor{
+		config:   config,
+		logger:   logger,
+		sink:     sink,
+		records:  make(chan auditRecord, max(config.BufferSize, 1)),
+		done:     make(chan struct{}),
+		sessions: map[string]auditSession{},
+	}
+	go auditor.run()
+
+	return auditor, nil
+}
+
+func (a *Auditor) run() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(a.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case record, ok := <-a.records:
+			if !ok {
+				if err := a.sink.Close(); err != nil {
+					a.logger.Error("Failed to close audit sink", "error", err)
+				}
+				return
+			}
+			a.write(record)
+		case <-ticker.C:
+			if err := a.sink.Flush(); err != nil {
+				a.logger.Error("Failed to flush audit sink", "error", err)
+			}
+		}
+	}
+}
+
+func (a *Auditor) write(record auditRecord) {
+	if record.query != "" {
+		record.fields["fingerprint"] = getFingerprint(record.query)
+	}
+
+	line, err := json.Marshal(record.fields)
+	if err != nil {
+		AuditWriteErrors.Inc()
+		a.logger.Error("Failed to marshal audit entry", "error", err)
+		return
+	}
+
+	if err := a.sink.Write(append(line, '\n')); err != nil {
+		AuditWriteErrors.Inc()
+		a.logger.Error("Failed to write audit entry", "error", err)
+		return
+	}
+	AuditEntries.Inc()
+}
+
+// enqueue hands the record to the writer without blocking. Records are
+// dropped if the buffer is full.
+func (a *Auditor) enqueue(record auditRecord) {
+	if _, ok := record.fields["timestamp"]; !ok {
+		record.fields["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+
+	select {
+	case a.records <- record:
+	default:
+		AuditEntriesDropped.Inc()
+	}
+}
+
+// Write adds an arbitrary entry to the audit trail.
+func (a *Auditor) Write(fields map[string]interface{}) {
+	if a == nil {
+		return
+	}
+	a.enqueue(auditRecord{fields: fields})
+}
+
+// AuditHook records the outcome of a hook, if the hook is enabled for auditing.
+// The request is the one returned by the JS function.
+func (a *Auditor) AuditHook(hook string, req *v1.Struct, err error) {
+	if a == nil {
+		return
+	}
+
+	client := getClientAddress(req)
+	if !a.config.Hooks[hook] {
+		// The session is dropped even if the closing is not audited.
+		if hook == "onClosed" {
+			a.mu.Lock()
+			delete(a.sessions, client)
+			a.mu.Unlock()
+		}
+		return
+	}
+
+	fields := map[string]interface{}{
+		"hook":    hook,
+		"client":  client,
+		"verdict": getVerdict(req, err),
+	}
+	record := auditRecord{fields: fields}
+
+	a.mu.Lock()
+	switch hook {
+	case "onTrafficFromClient":
+		request := getBytesField(req, "request")
+		if params, ok := parseStartupParameters(request); ok {
+			a.sessions[client] = auditSession{user: params["user"], database: params["database"]}
+			fields["event"] = "startup"
+		} else if query, ok := getQuery(request); ok {
+			fields["event"] = "query"
+			record.query = query
+		} else {
+			a.mu.Unlock()
+			return
+		}
+	case "onOpened":
+		fields["event"] = "opened"
+	case "onClosed":
+		fields["event"] = "closed"
+	default:
+		fields["event"] = hook
+	}
+	session := a.sessions[client]
+	if hook == "onClosed" {
+		delete(a.sessions, client)
+	}
+	a.mu.Unlock()
+
+	fields["user"] = session.user
+	fields["database"] = session.database
+	a.enqueue(record)
+}
+
+// RegisterAuditAPI exposes the audit.write function to JS. Entries written
+// in a hook get the client address, user and database of its connection,
+// unless they set them:
+//
+//	audit.write({ event: "export", table: "users" });
+func (p *Plugin) RegisterAuditAPI() error {
+	runtime := p.VM
+	audit := runtime.NewObject()
+	setProperty(audit, "write", func(call goja.FunctionCall) goja.Value {
+		fields, ok := call.Argument(0).Export().(map[string]interface{})
+		if !ok {
+			panic(runtime.NewTypeError("audit.write requires an object argument"))
+		}
+		if client := getClientAddress(p.hookReq); client != "" {
+			params := p.Connections.Parameters(p.hookReq)
+			for key, value := range map[string]string{
+				"client": client, "user": params["user"], "database": params["database"],
+			} {
+				if _, ok := fields[key]; !ok {
+					fields[key] = value
+				}
+			}
+		}
+		p.Auditor.Write(fields)
+		return goja.Undefined()
+	})
+	return runtime.Set("audit", audit)
+}
+
+// Close stops accepting entries, writes the buffered ones and closes the sink.
+func (a *Auditor) Close() {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.records)
+	a.mu.Unlock()
+
+	<-a.done
+}
+
+// getVerdict tells whether the request was allowed, terminated by the
+// script or failed.
+func getVerdict(req *v1.Struct, err error) string {
+	if err != nil {
+		return "error"
+	}
+	if isTerminated(req) {
+		return "terminated"
+	}
+	return "allowed"
+}
@@ -0,0 +1,196 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAuditor(t *testing.T) (*Auditor, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditor, err := NewAuditor(NewAuditConfig(map[string]interface{}{
+		"auditEnabled":    "true",
+		"auditHooks":      "onOpened,onTrafficFromClient,onClosed",
+		"auditOutput":     "file",
+		"auditFilePath":   path,
+		"auditBufferSize": "16",
+	}), newTestPlugin(t).Logger)
+	require.NoError(t, err)
+	return auditor, path
+}
+
+func readAuditEntries(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	entries := []map[string]interface{}{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func newTrafficRequest(t *testing.T, request []byte) *v1.Struct {
+	t.Helper()
+	req, err := v1.NewStruct(map[string]interface{}{
+		"client":  map[string]interface{}{"local": "localhost:15432", "remote": "127.0.0.1:5000"},
+		"request": request,
+	})
+	require.NoError(t, err)
+	return req
+}
+
+func newStartupMessage(params ...string) []byte {
+	body := []byte{}
+	for _, param := range params {
+		body = append(body, param...)
+		body = append(body, 0)
+	}
+	body = append(body, 0)
+	msg := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	msg = binary.BigEndian.AppendUint32(msg, ProtocolVersion3)
+	return append(msg, body...)
+}
+
+func newQueryMessage(query string) []byte {
+	msg := binary.BigEndian.AppendUint32([]byte{'Q'}, uint32(4+len(query)+1))
+	return append(append(msg, query...), 0)
+}
+
+func TestAuditor_AuditHook(t *testing.T) {
+	auditor, path := newTestAuditor(t)
+
+	auditor.AuditHook("onOpened", newTrafficRequest(t, nil), nil)
+	auditor.AuditHook("onTrafficFromClient",
+		newTrafficRequest(t, newStartupMessage("user", "alice", "database", "shop")), nil)
+	auditor.AuditHook("onTrafficFromClient",
+		newTrafficRequest(t, newQueryMessage("SELECT * FROM users WHERE id = 1")), nil)
+	auditor.AuditHook("onTick", newTrafficRequest(t, nil), nil)
+	auditor.AuditHook("onClosed", newTrafficRequest(t, nil), nil)
+	auditor.Close()
+
+	entries := readAuditEntries(t, path)
+	require.Len(t, entries, 4)
+	assert.Equal(t, "opened", entries[0]["event"])
+	assert.Equal(t, "startup", entries[1]["event"])
+	assert.Equal(t, "query", entries[2]["event"])
+	assert.Equal(t, "alice", entries[2]["user"])
+	assert.Equal(t, "shop", entries[2]["database"])
+	assert.Equal(t, "127.0.0.1:5000", entries[2]["client"])
+	assert.Equal(t, "allowed", entries[2]["verdict"])
+	assert.NotEmpty(t, entries[2]["fingerprint"])
+	assert.NotContains(t, entries[2], "query")
+	assert.Equal(t, "closed", entries[3]["event"])
+}
+
+func TestAuditor_SessionsWithoutClosedAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditor, err := NewAuditor(NewAuditConfig(map[string]interface{}{
+		"auditHooks":    "onTrafficFromClient",
+		"auditFilePath": path,
+	}), newTestPlugin(t).Logger)
+	require.NoError(t, err)
+	defer auditor.Close()
+
+	auditor.AuditHook("onTrafficFromClient",
+		newTrafficRequest(t, newStartupMessage("user", "alice", "database", "shop")), nil)
+	assert.Len(t, auditor.sessions, 1)
+	auditor.AuditHook("onClosed", newTrafficRequest(t, nil), nil)
+	assert.Empty(t, auditor.sessions, "sessions are dropped even if onClosed is not audited")
+}
+
+func TestPlugin_RegisterAuditAPI(t *testing.T) {
+	auditor, path := newTestAuditor(t)
+	p := newTestPlugin(t)
+	p.Auditor = auditor
+	p.Connections = NewConnectionTracker()
+	require.NoError(t, p.RegisterAuditAPI())
+
+	_, err := p.VM.RunString(`
+		audit.write({event: "custom", table: "users"});
+		function onTrafficFromClient(ctx, req) {
+			audit.write({event: "export", table: "orders"});
+			audit.write({event: "export", user: "system"});
+			return req;
+		}
+	`)
+	require.NoError(t, err)
+	_, err = p.VM.RunString(`audit.write("not an object")`)
+	require.Error(t, err)
+
+	p.Connections.TrackClient(newTrafficRequest(t, newStartupMessage("user", "alice", "database", "shop")))
+	p.RegisterFunction("onTrafficFromClient")
+	_, err = p.RunFunction(context.Background(), "onTrafficFromClient",
+		newTrafficRequest(t, newQueryMessage("SELECT 1")))
+	require.NoError(t, err)
+	auditor.Close()
+
+	entries := readAuditEntries(t, path)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "custom", entries[0]["event"])
+	assert.Equal(t, "users", entries[0]["table"])
+	assert.NotEmpty(t, entries[0]["timestamp"])
+	assert.NotContains(t, entries[0], "client", "entries outside hooks have no connection")
+
+	assert.Equal(t, "orders", entries[1]["table"])
+	assert.Equal(t, "127.0.0.1:5000", entries[1]["client"])
+	assert.Equal(t, "alice", entries[1]["user"])
+	assert.Equal(t, "shop", entries[1]["database"])
+	assert.Equal(t, "system", entries[2]["user"], "fields set by the script are kept")
+}
+
+func TestAuditor_Nil(t *testing.T) {
+	p := newTestPlugin(t)
+	require.NoError(t, p.RegisterAuditAPI())
+
+	_, err := p.VM.RunString(`audit.write({event: "custom"})`)
+	require.NoError(t, err)
+	p.Auditor.AuditHook("onOpened", newTrafficRequest(t, nil), nil)
+	p.Auditor.Close()
+}
+
+func TestFileSink_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := newFileSink(path, 10, 2)
+	require.NoError(t, err)
+
+	for range 4 {
+		require.NoError(t, sink.Write([]byte("01234567\n")))
+	}
+	require.NoError(t, sink.Close())
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		content, err := os.ReadFile(name)
+		require.NoError(t, err)
+		assert.Equal(t, "01234567\n", string(content))
+	}
+	assert.NoFileExists(t, path+".3")
+}
+
+func TestNewAuditConfig(t *testing.T) {
+	config := NewAuditConfig(map[string]interface{}{
+		"auditEnabled":       "true",
+		"auditHooks":         "onOpened, onClosed",
+		"auditFileMaxSize":   "1",
+		"auditFlushInterval": "5s",
+	})
+	assert.True(t, config.Enabled)
+	assert.Equal(t, map[string]bool{"onOpened": true, "onClosed": true}, config.Hooks)
+	assert.Equal(t, int64(1024*1024), config.FileMaxSize)
+	assert.Equal(t, 5*time.Second, config.FlushInterval)
+}
@@ -0,0 +1,343 @@
+package plugin
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dop251/goja_nodejs/require"
+)
+
+var (
+	ErrInvalidScriptBundle = errors.New("invalid script bundle")
+	ErrMissingHooks        = errors.New("script does not handle the hooks required by its bundle")
+)
+
+const (
+	// BundleManifestName is the name of the manifest in script archives.
+	BundleManifestName = "manifest.json"
+	// maxBundleSize is the maximum uncompressed size of a script bundle.
+	maxBundleSize = 64 * 1024 * 1024
+)
+
+// bundleExtensions are the extensions of the files that can be loaded via
+// require, which are part of the script bundle.
+var bundleExtensions = map[string]bool{".js": true, ".cjs": true, ".mjs": true, ".json": true}
+
+// BundleManifest describes the scripts released as an archive.
+type BundleManifest struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	// Main is the path of the entrypoint in the archive. It defaults to index.js.
+	Main string `json:"main"`
+	// Hooks are the hooks the script must handle once it has run.
+	Hooks []string `json:"hooks"`
+	// ConfigSchema is the JSON Schema of the script settings.
+	ConfigSchema map[string]interface{} `json:"configSchema"`
+}
+
+// parseBundleManifest parses and validates the manifest of an archive.
+func parseBundleManifest(data []byte) (*BundleManifest, error) {
+	manifest := BundleManifest{Main: "index.js"}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidScriptBundle, BundleManifestName, err)
+	}
+	if manifest.Name == "" || manifest.Version == "" {
+		return nil, fmt.Errorf("%w: %s must have a name and a version", ErrInvalidScriptBundle, BundleManifestName)
+	}
+	for _, hook := range manifest.Hooks {
+		if _, ok := Hooks[hook]; !ok {
+			return nil, fmt.Errorf("%w: %s requires unknown hook %q", ErrInvalidScriptBundle, BundleManifestName, hook)
+		}
+	}
+	return &manifest, nil
+}
+
+// ValidateConfig validates the script settings against the config schema of
+// the manifest, if any.
+func (m *BundleManifest) ValidateConfig(config map[string]interface{}) error {
+	if m == nil || m.ConfigSchema == nil {
+		return nil
+	}
+	return validateScriptConfig(m.ConfigSchema, config)
+}
+
+// CheckHooks checks that the script handles every hook required by the manifest.
+func (p *Plugin) CheckHooks(manifest *BundleManifest) error {
+	if manifest == nil {
+		return nil
+	}
+	missing := []string{}
+	for _, hook := range manifest.Hooks {
+		if len(p.getListeners(hook)) == 0 {
+			missing = append(missing, hook)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrMissingHooks, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// ScriptBundle is a snapshot of the entrypoint and of the modules it can
+// require. For a script file, these are the .js, .cjs, .mjs and .json files
+// in its directory and subdirectories, except hidden directories and
+// node_modules, up to the same size as archives. For a .tar.gz, .tgz or .zip archive,
+// these are the files of the archive, which is read in memory without being
+// unpacked, and the entrypoint is given by its manifest. Modules are loaded
+// from the snapshot, so files changed after loading are never run.
+type ScriptBundle struct {
+	// Manifest is the manifest of an archive, or nil for a script file.
+	Manifest   *BundleManifest
+	entrypoint string
+	files      map[string][]byte
+	checksums  []byte
+}
+
+// IsScriptArchive tells whether the script path is an archive.
+func IsScriptArchive(scriptPath string) bool {
+	return strings.HasSuffix(scriptPath, ".tar.gz") ||
+		strings.HasSuffix(scriptPath, ".tgz") ||
+		strings.HasSuffix(scriptPath, ".zip")
+}
+
+// LoadScriptBundle reads the bundle of the script or archive.
+func LoadScriptBundle(scriptPath string) (*ScriptBundle, error) {
+	absolute, err := filepath.Abs(scriptPath)
+	if err != nil {
+		return nil, err
+	}
+	if IsScriptArchive(scriptPath) {
+		return loadScriptArchive(absolute)
+	}
+
+	root := filepath.Dir(absolute)
+	files := map[string][]byte{}
+	left := int64(maxBundleSize)
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && path != root && skippedDir(entry.Name()) {
+			return filepath.SkipDir
+		}
+		if !entry.Type().IsRegular() || (path != absolute && !bundleExtensions[filepath.Ext(path)]) {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		data, err := readArchiveFile(file, path, &left)
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(relative)] = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newScriptBundle(root, filepath.Base(absolute), files, nil)
+}
+
+// skippedDir tells whether the directory is left out of the bundle of a
+// script file, which are hidden directories and node_modules.
+func skippedDir(name string) bool {
+	return name == "node_modules" || strings.HasPrefix(name, ".")
+}
+
+// loadScriptArchive reads the files of an archive in memory. The files are
+// loaded from paths under the path of the archive, as if it was a directory.
+func loadScriptArchive(archivePath string) (*ScriptBundle, error) {
+	var files map[string][]byte
+	var err error
+	if strings.HasSuffix(archivePath, ".zip") {
+		files, err = readZip(archivePath)
+	} else {
+		files, err = readTarGz(archivePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := files[BundleManifestName]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s has no %s", ErrInvalidScriptBundle, archivePath, BundleManifestName)
+	}
+	manifest, err := parseBundleManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	return newScriptBundle(archivePath, manifest.Main, files, manifest)
+}
+
+// newScriptBundle returns a bundle of the files, which are keyed by their
+// slash-separated path relative to the root, and builds its checksum list.
+// The list has the SHA-256 digest and the path of each file like sha256sum,
+// sorted by path.
+func newScriptBundle(
+	root, entrypoint string, files map[string][]byte, manifest *BundleManifest,
+) (*ScriptBundle, error) {
+	entrypoint = path.Clean(filepath.ToSlash(entrypoint))
+	if _, ok := files[entrypoint]; !ok {
+		return nil, fmt.Errorf("%w: %s", fs.ErrNotExist, filepath.Join(root, entrypoint))
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bundle := &ScriptBundle{
+		Manifest:   manifest,
+		entrypoint: filepath.Join(root, filepath.FromSlash(entrypoint)),
+		files:      make(map[string][]byte, len(files)),
+	}
+	var checksums bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&checksums, "%x  %s\n", sha256.Sum256(files[name]), name)
+		bundle.files[filepath.Join(root, filepath.FromSlash(name))] = files[name]
+	}
+	bundle.checksums = checksums.Bytes()
+	return bundle, nil
+}
+
+// archiveName returns the cleaned name of a file in an archive, and rejects
+// the names that escape the archive.
+func archiveName(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimPrefix(name, "./"))
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("%w: file %q is outside the archive", ErrInvalidScriptBundle, name)
+	}
+	return cleaned, nil
+}
+
+// readArchiveFile reads a file of a bundle, within the size left.
+func readArchiveFile(reader io.Reader, name string, left *int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(reader, *left+1))
+	if err != nil {
+		return nil, err
+	}
+	*left -= int64(len(data))
+	if *left < 0 {
+		return nil, fmt.Errorf("%w: bundle is larger than %d bytes at %s", ErrInvalidScriptBundle, maxBundleSize, name)
+	}
+	return data, nil
+}
+
+func readTarGz(archivePath string) (map[string][]byte, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidScriptBundle, err)
+	}
+	defer gzipReader.Close()
+
+	files := map[string][]byte{}
+	left := int64(maxBundleSize)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidScriptBundle, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name, err := archiveName(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		if files[name], err = readArchiveFile(tarReader, name, &left); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func readZip(archivePath string) (map[string][]byte, error) {
+	zipReader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidScriptBundle, err)
+	}
+	defer zipReader.Close()
+
+	files := map[string][]byte{}
+	left := int64(maxBundleSize)
+	for _, entry := range zipReader.File {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		name, err := archiveName(entry.Name)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := entry.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidScriptBundle, err)
+		}
+		files[name], err = readArchiveFile(reader, name, &left)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// GetManifest returns the manifest of an archive, or nil.
+func (b *ScriptBundle) GetManifest() *BundleManifest {
+	if b == nil {
+		return nil
+	}
+	return b.Manifest
+}
+
+// Entrypoint returns the path of the entrypoint, which is the file name of
+// the frames of JS stack traces.
+func (b *ScriptBundle) Entrypoint() string {
+	return b.entrypoint
+}
+
+// Script returns the source of the entrypoint.
+func (b *ScriptBundle) Script() []byte {
+	return b.files[b.entrypoint]
+}
+
+// Load is the source loader of require, which only loads the files of the bundle.
+func (b *ScriptBundle) Load(path string) ([]byte, error) {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if data, ok := b.files[absolute]; ok {
+		return data, nil
+	}
+	return nil, require.ModuleFileDoesNotExistError
+}
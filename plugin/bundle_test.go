@@ -0,0 +1,232 @@
+package plugin
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dop251/goja"
+	jsRequire "github.com/dop251/goja_nodejs/require"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeBundle writes a script bundle to a temporary directory and returns
+// the path of the entrypoint.
+func writeBundle(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.js":         `const lib = require("./lib/util"); var answer = lib.answer;`,
+		"lib/util.js":      `module.exports = { answer: require("./data.json").answer };`,
+		"lib/data.json":    `{"answer": 42}`,
+		"README.md":        "not part of the bundle",
+		"lib/unrelated.sh": "echo not part of the bundle",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	return filepath.Join(dir, "index.js")
+}
+
+func sha256Hex(data string) string {
+	digest := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(digest[:])
+}
+
+func TestLoadScriptBundle(t *testing.T) {
+	scriptPath := writeBundle(t)
+
+	bundle, err := LoadScriptBundle(scriptPath)
+	require.NoError(t, err)
+
+	expected := fmt.Sprintf("%s  index.js\n%s  lib/data.json\n%s  lib/util.js\n",
+		sha256Hex(`const lib = require("./lib/util"); var answer = lib.answer;`),
+		sha256Hex(`{"answer": 42}`),
+		sha256Hex(`module.exports = { answer: require("./data.json").answer };`))
+	assert.Equal(t, expected, string(bundle.Checksums()))
+	assert.Equal(t, sha256Hex(expected), bundle.Digest())
+	assert.Contains(t, string(bundle.Script()), "require")
+
+	_, err = LoadScriptBundle(filepath.Join(filepath.Dir(scriptPath), "missing.js"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLoadScriptBundle_SkippedFiles(t *testing.T) {
+	scriptPath := writeBundle(t)
+	dir := filepath.Dir(scriptPath)
+	for _, name := range []string{".git/config.json", "node_modules/pkg/index.js", "lib/.cache/data.json"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(`{}`), 0o600))
+	}
+
+	bundle, err := LoadScriptBundle(scriptPath)
+	require.NoError(t, err)
+	assert.Equal(t, 3, bytes.Count(bundle.Checksums(), []byte("\n")))
+
+	// The directory of a script file is limited to the size of archives.
+	large, err := os.Create(filepath.Join(dir, "large.json"))
+	require.NoError(t, err)
+	require.NoError(t, large.Truncate(maxBundleSize))
+	require.NoError(t, large.Close())
+	_, err = LoadScriptBundle(scriptPath)
+	assert.ErrorIs(t, err, ErrInvalidScriptBundle)
+}
+
+func TestScriptBundle_Load(t *testing.T) {
+	scriptPath := writeBundle(t)
+	bundle, err := LoadScriptBundle(scriptPath)
+	require.NoError(t, err)
+
+	// Modules are served from the snapshot, even if the files change later.
+	require.NoError(t, os.WriteFile(
+		filepath.Join(filepath.Dir(scriptPath), "lib", "util.js"), []byte(`module.exports = { answer: 0 };`), 0o600))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(filepath.Dir(scriptPath), "extra.js"), []byte(`module.exports = 1;`), 0o600))
+
+	vm := goja.New()
+	registry := jsRequire.NewRegistry(jsRequire.WithLoader(bundle.Load))
+	registry.Enable(vm)
+
+	_, err = vm.RunScript(scriptPath, string(bundle.Script()))
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), vm.Get("answer").ToInteger())
+
+	_, err = vm.RunScript(scriptPath, `require("./extra")`)
+	assert.Error(t, err)
+}
+
+// archiveFiles are the files of the test archives.
+var archiveFiles = map[string]string{
+	"manifest.json": `{
+		"name": "rules", "version": "1.2.0", "main": "src/main.js",
+		"hooks": ["onTrafficFromClient"],
+		"configSchema": {"type": "object", "required": ["maxRows"]}
+	}`,
+	"src/main.js": `const limits = require("./limits");
+		function onTrafficFromClient(ctx) { return ctx; }
+		var maxRows = limits.maxRows;`,
+	"src/limits.js": `module.exports = { maxRows: 100 };`,
+}
+
+func writeTarGz(t *testing.T, files map[string]string) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for name, content := range files {
+		require.NoError(t, tarWriter.WriteHeader(&tar.Header{
+			Name: name, Mode: 0o600, Size: int64(len(content)), Typeflag: tar.TypeReg,
+		}))
+		_, err := tarWriter.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, gzipWriter.Close())
+
+	archivePath := filepath.Join(t.TempDir(), "rules.tar.gz")
+	require.NoError(t, os.WriteFile(archivePath, buffer.Bytes(), 0o600))
+	return archivePath
+}
+
+func writeZip(t *testing.T, files map[string]string) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	zipWriter := zip.NewWriter(&buffer)
+	for name, content := range files {
+		writer, err := zipWriter.Create(name)
+		require.NoError(t, err)
+		_, err = writer.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zipWriter.Close())
+
+	archivePath := filepath.Join(t.TempDir(), "rules.zip")
+	require.NoError(t, os.WriteFile(archivePath, buffer.Bytes(), 0o600))
+	return archivePath
+}
+
+func TestLoadScriptBundle_Archive(t *testing.T) {
+	for name, archivePath := range map[string]string{
+		"tar.gz": writeTarGz(t, archiveFiles),
+		"zip":    writeZip(t, archiveFiles),
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.True(t, IsScriptArchive(archivePath))
+			bundle, err := LoadScriptBundle(archivePath)
+			require.NoError(t, err)
+
+			require.NotNil(t, bundle.GetManifest())
+			assert.Equal(t, "rules", bundle.Manifest.Name)
+			assert.Equal(t, "1.2.0", bundle.Manifest.Version)
+			assert.Equal(t, []string{"onTrafficFromClient"}, bundle.Manifest.Hooks)
+			assert.Equal(t, filepath.Join(archivePath, "src", "main.js"), bundle.Entrypoint())
+			assert.Contains(t, string(bundle.Checksums()), "  src/limits.js\n")
+
+			// Modules are required from the archive, as if it was a directory.
+			vm := goja.New()
+			jsRequire.NewRegistry(jsRequire.WithLoader(bundle.Load)).Enable(vm)
+			_, err = vm.RunScript(bundle.Entrypoint(), string(bundle.Script()))
+			require.NoError(t, err)
+			assert.Equal(t, int64(100), vm.Get("maxRows").ToInteger())
+
+			assert.NoError(t, bundle.Manifest.ValidateConfig(map[string]interface{}{"maxRows": 10}))
+			assert.ErrorIs(t, bundle.Manifest.ValidateConfig(map[string]interface{}{}), ErrInvalidScriptConfig)
+		})
+	}
+}
+
+func TestLoadScriptBundle_InvalidArchive(t *testing.T) {
+	withFile := func(name, content string) map[string]string {
+		files := map[string]string{}
+		for key, value := range archiveFiles {
+			files[key] = value
+		}
+		files[name] = content
+		return files
+	}
+
+	tests := map[string]map[string]string{
+		"no manifest":   {"index.js": "var a = 1;"},
+		"no version":    withFile("manifest.json", `{"name": "rules", "main": "src/main.js"}`),
+		"unknown hook":  withFile("manifest.json", `{"name": "rules", "version": "1", "hooks": ["onNothing"]}`),
+		"escaping path": withFile("../evil.js", "var a = 1;"),
+		"invalid json":  withFile("manifest.json", `{`),
+		"no entrypoint": withFile("manifest.json", `{"name": "rules", "version": "1", "main": "missing.js"}`),
+	}
+	for name, files := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadScriptBundle(writeTarGz(t, files))
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := LoadScriptBundle(filepath.Join(t.TempDir(), "missing.zip"))
+	assert.ErrorIs(t, err, ErrInvalidScriptBundle)
+}
+
+func TestPlugin_CheckHooks(t *testing.T) {
+	p := newTestPlugin(t)
+	manifest := &BundleManifest{Hooks: []string{"onTrafficFromClient", "onTrafficFromServer"}}
+
+	_, err := p.VM.RunString(`function onTrafficFromClient(ctx) { return ctx; }`)
+	require.NoError(t, err)
+	p.RegisterFunction("onTrafficFromClient")
+
+	err = p.CheckHooks(manifest)
+	require.ErrorIs(t, err, ErrMissingHooks)
+	assert.Contains(t, err.Error(), "onTrafficFromServer")
+	assert.NotContains(t, err.Error(), "onTrafficFromClient")
+
+	assert.NoError(t, p.CheckHooks(nil))
+}
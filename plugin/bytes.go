@@ -0,0 +1,43 @@
+package plugin
+
+import (
+	"github.com/dop251/goja"
+)
+
+// toBytes converts a JS Uint8Array, ArrayBuffer or string to bytes.
+// Strings are encoded as UTF-8.
+func toBytes(value goja.Value) ([]byte, bool) {
+	if value == nil || goja.IsUndefined(value) || goja.IsNull(value) {
+		return nil, false
+	}
+
+	switch exported := value.Export().(type) {
+	case []byte:
+		return exported, true
+	case goja.ArrayBuffer:
+		return exported.Bytes(), true
+	case string:
+		return []byte(exported), true
+	default:
+		return nil, false
+	}
+}
+
+// mustBytes is like toBytes but throws a TypeError naming the function.
+func mustBytes(runtime *goja.Runtime, value goja.Value, function string) []byte {
+	data, ok := toBytes(value)
+	if !ok {
+		panic(runtime.NewTypeError("%s: expected a Uint8Array, ArrayBuffer or string", function))
+	}
+	return data
+}
+
+// newUint8Array returns a Uint8Array backed by a copy of the bytes.
+func newUint8Array(runtime *goja.Runtime, data []byte) goja.Value {
+	buffer := runtime.NewArrayBuffer(append([]byte{}, data...))
+	array, err := runtime.New(runtime.Get("Uint8Array"), runtime.ToValue(buffer))
+	if err != nil {
+		panic(err)
+	}
+	return array
+}
@@ -0,0 +1,341 @@
+package plugin
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/dop251/goja"
+	"github.com/spf13/cast"
+	pgQuery "github.com/wasilibs/go-pgquery"
+)
+
+const (
+	AccessRead  = "read"
+	AccessWrite = "write"
+)
+
+// readOnlyStatements are the kinds of the statements that do not write.
+// Statements of other kinds, e.g. EXECUTE or CALL, may write.
+var readOnlyStatements = map[string]bool{
+	"SelectStmt": true, "ExplainStmt": true, "VariableShowStmt": true, "VariableSetStmt": true,
+	"TransactionStmt": true, "DeclareCursorStmt": true, "FetchStmt": true, "ClosePortalStmt": true,
+	"PrepareStmt": true, "DeallocateStmt": true, "DiscardStmt": true, "ListenStmt": true,
+	"UnlistenStmt": true,
+}
+
+// dmlStatements are the kinds of the statements that read or write rows.
+var dmlStatements = map[string]bool{
+	"SelectStmt": true, "InsertStmt": true, "UpdateStmt": true, "DeleteStmt": true,
+	"MergeStmt": true, "TruncateStmt": true,
+}
+
+// dclStatements are the kinds of the statements that manage roles and
+// privileges.
+var dclStatements = map[string]bool{
+	"GrantStmt": true, "GrantRoleStmt": true, "AlterDefaultPrivilegesStmt": true,
+	"CreateRoleStmt": true, "AlterRoleStmt": true, "AlterRoleSetStmt": true, "DropRoleStmt": true,
+	"ReassignOwnedStmt": true, "DropOwnedStmt": true,
+}
+
+// ddlStatements are the kinds of the statements that define objects, besides
+// those whose kind starts with Create, Alter or Drop.
+var ddlStatements = map[string]bool{
+	"DefineStmt": true, "RenameStmt": true, "CommentStmt": true, "IndexStmt": true,
+	"ViewStmt": true, "CompositeTypeStmt": true, "RuleStmt": true, "SecLabelStmt": true,
+}
+
+// targetFields are the paths of the fields of the nodes that hold the tables
+// written by the statements, e.g. the table of an INSERT or of a CREATE INDEX.
+var targetFields = map[string][]string{
+	"InsertStmt":         {"relation"},
+	"UpdateStmt":         {"relation"},
+	"DeleteStmt":         {"relation"},
+	"MergeStmt":          {"relation"},
+	"TruncateStmt":       {"relations"},
+	"SelectStmt":         {"intoClause.rel"},
+	"CreateTableAsStmt":  {"into.rel"},
+	"CreateStmt":         {"relation"},
+	"AlterTableStmt":     {"relation"},
+	"IndexStmt":          {"relation"},
+	"ViewStmt":           {"view"},
+	"RenameStmt":         {"relation"},
+	"CreateTrigStmt":     {"relation"},
+	"RuleStmt":           {"relation"},
+	"RefreshMatViewStmt": {"relation"},
+}
+
+// droppedTables are the types of the objects of DROP statements that are
+// tables.
+var droppedTables = map[string]bool{
+	"OBJECT_TABLE": true, "OBJECT_VIEW": true, "OBJECT_MATVIEW": true, "OBJECT_FOREIGN_TABLE": true,
+}
+
+// TableAccess is a table referenced by a query.
+type TableAccess struct {
+	// Schema is the schema of the table, if the name is qualified.
+	Schema string
+	Name   string
+	// Access is write if a statement writes or defines the table, and read
+	// otherwise.
+	Access string
+}
+
+// Classification is what the statements of a query do.
+type Classification struct {
+	// Statements are the kinds of the statements, e.g. select or createtable.
+	Statements []string
+	// Tables are the tables referenced by the statements, in order, without
+	// the names of the common table expressions.
+	Tables []TableAccess
+	// Functions are the names of the functions called, e.g. pg_catalog.now.
+	Functions []string
+
+	Write       bool
+	DDL         bool
+	DCL         bool
+	Transaction bool
+	Utility     bool
+}
+
+// ClassifySQL parses the query and classifies its statements.
+func ClassifySQL(text string) (*Classification, error) {
+	tree, err := pgQuery.ParseToJSON(text)
+	if err != nil {
+		return nil, err
+	}
+	query := &parsedQuery{text: text, parsed: true}
+	if err := json.Unmarshal([]byte(tree), &query.tree); err != nil {
+		return nil, err
+	}
+	return classify(query), nil
+}
+
+// classify classifies the statements of the parsed query.
+func classify(query *parsedQuery) *Classification {
+	result := &Classification{Statements: []string{}, Tables: []TableAccess{}, Functions: []string{}}
+	for _, node := range query.statementNodes() {
+		for kind := range node {
+			result.Statements = append(result.Statements, statementKind(kind))
+			switch {
+			case kind == "TransactionStmt":
+				result.Transaction = true
+			case dmlStatements[kind]:
+			case dclStatements[kind]:
+				result.DCL = true
+			case ddlStatements[kind] || kind != "AlterSystemStmt" &&
+				(strings.HasPrefix(kind, "Create") || strings.HasPrefix(kind, "Alter") || strings.HasPrefix(kind, "Drop")):
+				result.DDL = true
+			default:
+				result.Utility = true
+			}
+		}
+		result.Write = result.Write || isWriteStatement(node)
+	}
+
+	written, ctes := map[int]bool{}, map[string]bool{}
+	type reference struct {
+		TableAccess
+		location int
+	}
+	references := []reference{}
+	functions := []reference{}
+	walkJSON(query.parse(), func(node map[string]interface{}) {
+		if name, ok := node["ctename"]; ok {
+			ctes[cast.ToString(name)] = true
+		}
+		if _, ok := node["funcformat"]; ok {
+			functions = append(functions, reference{
+				TableAccess: TableAccess{Name: strings.Join(nameParts(node["funcname"]), ".")},
+				location:    cast.ToInt(node["location"]),
+			})
+		}
+		for kind, value := range node {
+			stmt := cast.ToStringMap(value)
+			for _, path := range targetFields[kind] {
+				markWritten(lookupPath(stmt, path), written)
+			}
+			if kind == "CopyStmt" && cast.ToBool(stmt["is_from"]) {
+				markWritten(stmt["relation"], written)
+			}
+			if kind == "DropStmt" && droppedTables[cast.ToString(stmt["removeType"])] {
+				for _, object := range cast.ToSlice(stmt["objects"]) {
+					parts := nameParts(cast.ToStringMap(cast.ToStringMap(object)["List"])["items"])
+					if len(parts) == 0 {
+						continue
+					}
+					table := TableAccess{Name: parts[len(parts)-1], Access: AccessWrite}
+					if len(parts) > 1 {
+						table.Schema = parts[len(parts)-2]
+					}
+					// The names of DROP statements have no location, so they
+					// are sorted after the other references.
+					references = append(references, reference{TableAccess: table, location: len(query.text)})
+				}
+			}
+		}
+	})
+	for _, rel := range query.relations() {
+		access := AccessRead
+		if written[rel.location] {
+			access = AccessWrite
+		}
+		references = append(references, reference{
+			TableAccess: TableAccess{Schema: rel.schema, Name: rel.name, Access: access},
+			location:    rel.location,
+		})
+	}
+
+	sort.SliceStable(references, func(i, j int) bool { return references[i].location < references[j].location })
+	tables := map[string]int{}
+	for _, ref := range references {
+		if ref.Schema == "" && ctes[ref.Name] {
+			continue
+		}
+		key := ref.Schema + "." + ref.Name
+		if index, ok := tables[key]; ok {
+			if ref.Access == AccessWrite {
+				result.Tables[index].Access = AccessWrite
+			}
+			continue
+		}
+		tables[key] = len(result.Tables)
+		result.Tables = append(result.Tables, ref.TableAccess)
+	}
+
+	sort.SliceStable(functions, func(i, j int) bool { return functions[i].location < functions[j].location })
+	seen := map[string]bool{}
+	for _, function := range functions {
+		if !seen[function.Name] {
+			seen[function.Name] = true
+			result.Functions = append(result.Functions, function.Name)
+		}
+	}
+	return result
+}
+
+// markWritten records the locations of the tables of the value as written.
+func markWritten(value interface{}, written map[int]bool) {
+	walkJSON(value, func(node map[string]interface{}) {
+		if _, ok := node["relpersistence"]; ok {
+			written[cast.ToInt(node["location"])] = true
+		}
+	})
+}
+
+// lookupPath returns the value of the dotted path of fields of the node.
+func lookupPath(node map[string]interface{}, path string) interface{} {
+	var value interface{} = node
+	for _, field := range strings.Split(path, ".") {
+		value = cast.ToStringMap(value)[field]
+	}
+	return value
+}
+
+// nameParts returns the parts of a qualified name, a list of String nodes.
+func nameParts(value interface{}) []string {
+	parts := []string{}
+	for _, item := range cast.ToSlice(value) {
+		parts = append(parts, cast.ToString(cast.ToStringMap(cast.ToStringMap(item)["String"])["sval"]))
+	}
+	return parts
+}
+
+// isWriteQuery tells whether the query has a statement that writes. Queries
+// that cannot be parsed are not writes, since the server rejects them.
+func isWriteQuery(text string) bool {
+	for _, node := range newParsedQuery(text).statementNodes() {
+		if isWriteStatement(node) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWriteStatement tells whether the statement node writes, e.g. SELECT INTO,
+// SELECT FOR UPDATE, or a SELECT with an INSERT in a WITH clause.
+func isWriteStatement(node map[string]interface{}) bool {
+	for kind, value := range node {
+		stmt := cast.ToStringMap(value)
+		switch kind {
+		case "SelectStmt":
+			if stmt["intoClause"] != nil || stmt["lockingClause"] != nil {
+				return true
+			}
+			for _, cte := range cast.ToSlice(cast.ToStringMap(stmt["withClause"])["ctes"]) {
+				query := cast.ToStringMap(cast.ToStringMap(cast.ToStringMap(cte)["CommonTableExpr"])["ctequery"])
+				if isWriteStatement(query) {
+					return true
+				}
+			}
+			return false
+		case "ExplainStmt":
+			// Only EXPLAIN ANALYZE runs the statement.
+			for _, option := range cast.ToSlice(stmt["options"]) {
+				if cast.ToString(cast.ToStringMap(cast.ToStringMap(option)["DefElem"])["defname"]) == "analyze" {
+					return isWriteStatement(cast.ToStringMap(stmt["query"]))
+				}
+			}
+			return false
+		case "DeclareCursorStmt":
+			return isWriteStatement(cast.ToStringMap(stmt["query"]))
+		case "CopyStmt":
+			return cast.ToBool(stmt["is_from"])
+		default:
+			return !readOnlyStatements[kind]
+		}
+	}
+	return false
+}
+
+// RegisterClassifyHelpers exposes classifySQL to JS, which classifies the
+// statements of a query, and throws if it cannot be parsed:
+//
+//	classifySQL("UPDATE accounts SET balance = 0 FROM audit.log")
+//	// { statements: ["update"], write: true, ddl: false, dcl: false,
+//	//   transaction: false, utility: false, functions: [],
+//	//   tables: [{ schema: null, name: "accounts", access: "write" },
+//	//            { schema: "audit", name: "log", access: "read" }] }
+func RegisterClassifyHelpers(runtime *goja.Runtime) error {
+	return runtime.Set("classifySQL", func(call goja.FunctionCall) goja.Value {
+		if len(call.Arguments) < 1 {
+			panic(runtime.NewTypeError("classifySQL requires 1 argument"))
+		}
+		result, err := ClassifySQL(call.Arguments[0].String())
+		if err != nil {
+			panic(runtime.NewTypeError("classifySQL: " + err.Error()))
+		}
+
+		tables := make([]interface{}, 0, len(result.Tables))
+		for _, table := range result.Tables {
+			object := runtime.NewObject()
+			var schema interface{}
+			if table.Schema != "" {
+				schema = table.Schema
+			}
+			setProperty(object, "schema", schema)
+			setProperty(object, "name", table.Name)
+			setProperty(object, "access", table.Access)
+			tables = append(tables, object)
+		}
+		object := runtime.NewObject()
+		setProperty(object, "statements", stringValues(result.Statements))
+		setProperty(object, "tables", tables)
+		setProperty(object, "functions", stringValues(result.Functions))
+		setProperty(object, "write", result.Write)
+		setProperty(object, "ddl", result.DDL)
+		setProperty(object, "dcl", result.DCL)
+		setProperty(object, "transaction", result.Transaction)
+		setProperty(object, "utility", result.Utility)
+		return object
+	})
+}
+
+// stringValues returns the strings as a list of values, which is a JS array.
+func stringValues(values []string) []interface{} {
+	list := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		list = append(list, value)
+	}
+	return list
+}
@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsWriteQuery(t *testing.T) {
+	for query, expected := range map[string]bool{
+		"SELECT * FROM users":                                       false,
+		"SHOW search_path; SET search_path = app":                   false,
+		"BEGIN READ ONLY":                                           false,
+		"EXPLAIN DELETE FROM users":                                 false,
+		"COPY users TO STDOUT":                                      false,
+		"not sql":                                                   false,
+		"INSERT INTO users VALUES (1)":                              true,
+		"SELECT 1; UPDATE users SET a = 1":                          true,
+		"SELECT * INTO copy FROM users":                             true,
+		"SELECT * FROM users FOR UPDATE":                            true,
+		"WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d": true,
+		"EXPLAIN ANALYZE DELETE FROM users":                         true,
+		"COPY users FROM STDIN":                                     true,
+		"CREATE TABLE t (a int)":                                    true,
+		"EXECUTE q":                                                 true,
+	} {
+		assert.Equal(t, expected, isWriteQuery(query), query)
+	}
+}
+
+func TestClassifySQL(t *testing.T) {
+	read := func(schema, name string) TableAccess {
+		return TableAccess{Schema: schema, Name: name, Access: AccessRead}
+	}
+	write := func(schema, name string) TableAccess {
+		return TableAccess{Schema: schema, Name: name, Access: AccessWrite}
+	}
+
+	for query, expected := range map[string]*Classification{
+		"SELECT count(*), pg_catalog.now() FROM public.users u JOIN orders o ON o.user_id = u.id": {
+			Statements: []string{"select"},
+			Tables:     []TableAccess{read("public", "users"), read("", "orders")},
+			Functions:  []string{"count", "pg_catalog.now"},
+		},
+		"UPDATE accounts SET balance = 0 FROM audit.log WHERE log.id = accounts.id": {
+			Statements: []string{"update"},
+			Tables:     []TableAccess{write("", "accounts"), read("audit", "log")},
+			Functions:  []string{},
+			Write:      true,
+		},
+		"WITH d AS (DELETE FROM users RETURNING *) INSERT INTO archive SELECT * FROM d": {
+			Statements: []string{"insert"},
+			Tables:     []TableAccess{write("", "users"), write("", "archive")},
+			Functions:  []string{},
+			Write:      true,
+		},
+		"INSERT INTO t SELECT * FROM t": {
+			Statements: []string{"insert"},
+			Tables:     []TableAccess{write("", "t")},
+			Functions:  []string{},
+			Write:      true,
+		},
+		"SELECT * INTO copy FROM users": {
+			Statements: []string{"select"},
+			Tables:     []TableAccess{write("", "copy"), read("", "users")},
+			Functions:  []string{},
+			Write:      true,
+		},
+		"CREATE INDEX ON users (lower(email)); DROP TABLE app.sessions, tokens": {
+			Statements: []string{"index", "drop"},
+			Tables:     []TableAccess{write("", "users"), write("app", "sessions"), write("", "tokens")},
+			Functions:  []string{"lower"},
+			Write:      true,
+			DDL:        true,
+		},
+		"GRANT SELECT ON users TO reporting": {
+			Statements: []string{"grant"},
+			Tables:     []TableAccess{read("", "users")},
+			Functions:  []string{},
+			Write:      true,
+			DCL:        true,
+		},
+		"BEGIN; SELECT 1; COMMIT": {
+			Statements:  []string{"transaction", "select", "transaction"},
+			Tables:      []TableAccess{},
+			Functions:   []string{},
+			Transaction: true,
+		},
+		"SET search_path = app; COPY users FROM STDIN; CALL refresh(1)": {
+			Statements: []string{"variableset", "copy", "call"},
+			Tables:     []TableAccess{write("", "users")},
+			Functions:  []string{"refresh"},
+			Write:      true,
+			Utility:    true,
+		},
+		"ALTER SYSTEM SET work_mem = '64MB'": {
+			Statements: []string{"altersystem"},
+			Tables:     []TableAccess{},
+			Functions:  []string{},
+			Write:      true,
+			Utility:    true,
+		},
+	} {
+		result, err := ClassifySQL(query)
+		require.NoError(t, err, query)
+		assert.Equal(t, expected, result, query)
+	}
+
+	_, err := ClassifySQL("not sql")
+	assert.Error(t, err)
+}
+
+func TestRegisterClassifyHelpers(t *testing.T) {
+	p := newTestPlugin(t)
+	require.NoError(t, RegisterClassifyHelpers(p.VM))
+
+	value, err := p.VM.RunString(`
+	const result = classifySQL("UPDATE app.users SET name = upper(name) FROM teams");
+	JSON.stringify([result.statements, result.write, result.ddl, result.functions,
+		result.tables.map((table) => [table.schema, table.name, table.access])]);`)
+	require.NoError(t, err)
+	assert.JSONEq(t,
+		`[["update"], true, false, ["upper"], [["app", "users", "write"], [null, "teams", "read"]]]`,
+		value.String())
+
+	_, err = p.VM.RunString(`classifySQL("not sql")`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "classifySQL: syntax error")
+}
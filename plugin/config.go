@@ -0,0 +1,187 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dop251/goja"
+	"gopkg.in/yaml.v3"
+)
+
+var ErrInvalidScriptConfig = errors.New("invalid script config")
+
+// LoadScriptConfig loads the settings passed to the script. The settings are
+// read from a JSON or YAML file, if a path is given, and are overridden by
+// environment variables starting with the prefix. The name of the setting is
+// the rest of the variable name in camelCase, e.g. JS_CONFIG_MAX_ROWS sets
+// maxRows. Values that are valid JSON are decoded, others are kept as strings.
+func LoadScriptConfig(path, prefix string, environ []string) (map[string]interface{}, error) {
+	config := map[string]interface{}{}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// YAML is a superset of JSON, so this handles both formats.
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidScriptConfig, path, err)
+		}
+		if config == nil {
+			config = map[string]interface{}{}
+		}
+		normalizeYAML(config)
+	}
+
+	if prefix == "" {
+		return config, nil
+	}
+
+	for _, env := range environ {
+		key, value, ok := strings.Cut(env, "=")
+		if !ok || !strings.HasPrefix(key, prefix) || len(key) == len(prefix) {
+			continue
+		}
+
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+			decoded = value
+		}
+		config[toCamelCase(strings.TrimPrefix(key, prefix))] = decoded
+	}
+
+	return config, nil
+}
+
+// toCamelCase converts an upper snake case name, e.g. MAX_ROWS, to maxRows.
+func toCamelCase(name string) string {
+	var builder strings.Builder
+	for i, part := range strings.Split(strings.ToLower(name), "_") {
+		if part == "" {
+			continue
+		}
+		if i > 0 && builder.Len() > 0 {
+			builder.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		} else {
+			builder.WriteString(part)
+		}
+	}
+	return builder.String()
+}
+
+// RegisterScriptConfig exposes the script settings to JS as the deeply
+// frozen config object.
+func RegisterScriptConfig(runtime *goja.Runtime, config map[string]interface{}) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	parse, ok := goja.AssertFunction(runtime.Get("JSON").ToObject(runtime).Get("parse"))
+	if !ok {
+		return fmt.Errorf("%w: JSON.parse is not available", ErrInvalidScriptConfig)
+	}
+	value, err := parse(goja.Undefined(), runtime.ToValue(string(data)))
+	if err != nil {
+		return err
+	}
+
+	if err := deepFreeze(runtime, value); err != nil {
+		return err
+	}
+
+	return runtime.Set("config", value)
+}
+
+// deepFreeze freezes the object and all the objects it contains.
+func deepFreeze(runtime *goja.Runtime, value goja.Value) error {
+	object, ok := value.(*goja.Object)
+	if !ok {
+		return nil
+	}
+
+	for _, key := range object.Keys() {
+		if err := deepFreeze(runtime, object.Get(key)); err != nil {
+			return err
+		}
+	}
+
+	freeze, ok := goja.AssertFunction(runtime.Get("Object").ToObject(runtime).Get("freeze"))
+	if !ok {
+		return fmt.Errorf("%w: Object.freeze is not available", ErrInvalidScriptConfig)
+	}
+	_, err := freeze(goja.Undefined(), object)
+	return err
+}
+
+// ValidateScriptConfig validates the script settings against the JSON Schema
+// exported by the script as the global configSchema object. Scripts that do
+// not define a schema accept any settings.
+func ValidateScriptConfig(runtime *goja.Runtime, config map[string]interface{}) error {
+	value := runtime.Get("configSchema")
+	if value == nil || goja.IsUndefined(value) || goja.IsNull(value) {
+		return nil
+	}
+
+	// Round-trip through JSON to get plain Go values on both sides.
+	schemaJSON, err := json.Marshal(value.Export())
+	if err != nil {
+		return err
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(schemaJSON, &schema); err != nil {
+		return fmt.Errorf("%w: configSchema must be an object", ErrInvalidScriptConfig)
+	}
+	return validateScriptConfig(schema, config)
+}
+
+// validateScriptConfig validates the script settings against a JSON Schema.
+func validateScriptConfig(schema map[string]interface{}, config map[string]interface{}) error {
+	compiled, err := compileSchema(schema)
+	if err != nil {
+		return fmt.Errorf("%w: invalid configSchema: %w", ErrInvalidScriptConfig, err)
+	}
+
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	var document interface{}
+	if err := json.Unmarshal(configJSON, &document); err != nil {
+		return err
+	}
+
+	if problems := validateSchema(compiled, document, "config"); len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidScriptConfig, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// normalizeYAML converts the maps decoded from YAML with keys that are not
+// strings, e.g. 1: one, to maps with string keys, which can be marshaled to
+// JSON.
+func normalizeYAML(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = normalizeYAML(item)
+		}
+		return value
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			normalized[fmt.Sprint(key)] = normalizeYAML(item)
+		}
+		return normalized
+	case []interface{}:
+		for i, item := range value {
+			value[i] = normalizeYAML(item)
+		}
+		return value
+	default:
+		return value
+	}
+}
@@ -0,0 +1,173 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadScriptConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+tables:
+  - users
+  - orders
+maxRows: 10
+tenant: acme
+`), 0o600))
+
+	config, err := LoadScriptConfig(path, "JS_CONFIG_", []string{
+		"JS_CONFIG_MAX_ROWS=100",
+		"JS_CONFIG_DRY_RUN=true",
+		"JS_CONFIG_TENANT=globex",
+		"JS_CONFIG_=ignored",
+		"OTHER=ignored",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"users", "orders"}, config["tables"])
+	assert.InDelta(t, 100, config["maxRows"], 0)
+	assert.Equal(t, true, config["dryRun"])
+	assert.Equal(t, "globex", config["tenant"])
+	assert.Len(t, config, 4)
+}
+
+func TestLoadScriptConfig_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"tables": [`), 0o600))
+
+	_, err := LoadScriptConfig(path, "", nil)
+	require.ErrorIs(t, err, ErrInvalidScriptConfig)
+
+	_, err = LoadScriptConfig(filepath.Join(t.TempDir(), "missing.json"), "", nil)
+	require.Error(t, err)
+}
+
+func TestRegisterScriptConfig(t *testing.T) {
+	p := newTestPlugin(t)
+	require.NoError(t, RegisterScriptConfig(p.VM, map[string]interface{}{
+		"tables": []interface{}{"users"},
+		"limits": map[string]interface{}{"rows": 10},
+	}))
+
+	value, err := p.VM.RunString(`
+		"use strict";
+		const errors = [];
+		for (const mutate of [
+			() => { config.tenant = "acme"; },
+			() => { config.limits.rows = 20; },
+			() => { config.tables.push("orders"); },
+		]) {
+			try { mutate(); } catch (e) { errors.push(e instanceof TypeError); }
+		}
+		errors.length === 3 && errors.every(Boolean) && config.limits.rows === 10
+	`)
+	require.NoError(t, err)
+	assert.True(t, value.ToBoolean())
+}
+
+func TestValidateScriptConfig(t *testing.T) {
+	p := newTestPlugin(t)
+	config := map[string]interface{}{"tables": []interface{}{"users"}, "maxRows": 10}
+
+	require.NoError(t, ValidateScriptConfig(p.VM, config), "scripts without a schema accept any config")
+
+	_, err := p.VM.RunString(`var configSchema = {
+		type: "object",
+		required: ["tables"],
+		properties: {
+			tables: { type: "array", items: { type: "string" }, minItems: 1 },
+			maxRows: { type: "integer", minimum: 1, maximum: 1000 },
+			mode: { enum: ["strict", "lenient"] },
+		},
+		additionalProperties: false,
+	}`)
+	require.NoError(t, err)
+	require.NoError(t, ValidateScriptConfig(p.VM, config))
+
+	err = ValidateScriptConfig(p.VM, map[string]interface{}{
+		"tables":  []interface{}{1},
+		"maxRows": 1.5,
+		"mode":    "other",
+		"tenant":  "acme",
+	})
+	require.ErrorIs(t, err, ErrInvalidScriptConfig)
+	assert.Contains(t, err.Error(), "config.tables[0]: got number, want string")
+	assert.Contains(t, err.Error(), "config.maxRows: got number, want integer")
+	assert.Contains(t, err.Error(), "config.mode: value must be one of")
+	assert.Contains(t, err.Error(), "config: additional properties 'tenant' not allowed")
+
+	err = ValidateScriptConfig(p.VM, map[string]interface{}{})
+	assert.Contains(t, err.Error(), "config: missing property 'tables'")
+}
+
+func TestValidateScriptConfig_Keywords(t *testing.T) {
+	p := newTestPlugin(t)
+	_, err := p.VM.RunString(`var configSchema = {
+		type: "object",
+		properties: {
+			url: { type: "string", format: "uri" },
+			mode: { oneOf: [{ const: "strict" }, { const: "lenient" }] },
+			tags: { type: "array", items: { not: { type: "null" } } },
+			limits: { $ref: "#/$defs/limits" },
+		},
+		$defs: {
+			limits: { type: "object", properties: { rows: { type: "integer" } } },
+		},
+	}`)
+	require.NoError(t, err)
+	require.NoError(t, ValidateScriptConfig(p.VM, map[string]interface{}{
+		"url": "http://localhost", "mode": "strict", "tags": []interface{}{"a"},
+		"limits": map[string]interface{}{"rows": 10},
+	}))
+
+	err = ValidateScriptConfig(p.VM, map[string]interface{}{
+		"url": "not a uri", "mode": "other", "tags": []interface{}{nil},
+		"limits": map[string]interface{}{"rows": "ten"},
+	})
+	require.ErrorIs(t, err, ErrInvalidScriptConfig)
+	assert.Contains(t, err.Error(), "config.url: ")
+	assert.Contains(t, err.Error(), "config.mode: ")
+	assert.Contains(t, err.Error(), "config.tags[0]: ")
+	assert.Contains(t, err.Error(), "config.limits.rows: got string, want integer")
+
+	// References to other documents are never loaded.
+	_, err = p.VM.RunString(`configSchema = { $ref: "file:///etc/gatewayd/schema.json" }`)
+	require.NoError(t, err)
+	err = ValidateScriptConfig(p.VM, map[string]interface{}{})
+	require.ErrorIs(t, err, ErrInvalidScriptConfig)
+	assert.Contains(t, err.Error(), "invalid configSchema")
+}
+
+func TestLoadScriptConfig_NestedYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+limits:
+  users:
+    rows: 10
+  1: one
+shards:
+  - 2: two
+`), 0o600))
+
+	config, err := LoadScriptConfig(path, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"users": map[string]interface{}{"rows": 10},
+		"1":     "one",
+	}, config["limits"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"2": "two"}}, config["shards"])
+
+	require.NoError(t, validateScriptConfig(map[string]interface{}{
+		"properties": map[string]interface{}{
+			"limits": map[string]interface{}{"type": "object", "required": []interface{}{"1"}},
+		},
+	}, config))
+	p := newTestPlugin(t)
+	require.NoError(t, RegisterScriptConfig(p.VM, config))
+	value, err := p.VM.RunString(`config.shards[0]["2"]`)
+	require.NoError(t, err)
+	assert.Equal(t, "two", value.String())
+}
@@ -0,0 +1,466 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+)
+
+// maxTrackedStatements is the number of prepared statements and portals
+// tracked per connection, beyond which arbitrary ones are forgotten.
+const maxTrackedStatements = 1024
+
+type portal struct {
+	statement string
+	params    []interface{}
+}
+
+// statement is a prepared statement, with the kinds of its transaction
+// statements, which are classified when it is parsed.
+type statement struct {
+	text  string
+	kinds []string
+}
+
+// queryBatch are the queries answered by one ReadyForQuery message: a simple
+// query, or the portals executed before a Sync.
+type queryBatch struct {
+	started time.Time
+	queries []*Query
+}
+
+// connection is the state of a client connection.
+type connection struct {
+	local string
+	// parameters are the parameters of the StartupMessage of the client.
+	parameters map[string]string
+	statements map[string]statement
+	portals    map[string]portal
+	// batch is the batch of the portals executed since the last Sync.
+	batch *queryBatch
+	// pending are the batches sent to the server that are not answered yet.
+	pending []*queryBatch
+	// completed are the queries answered by the last response of the server.
+	completed   []*Query
+	transaction Transaction
+	// previous is the transaction state before the last request.
+	previous Transaction
+}
+
+// ConnectionInfo is a copy of the state of a client connection.
+type ConnectionInfo struct {
+	Remote      string
+	Local       string
+	Parameters  map[string]string
+	Transaction Transaction
+}
+
+// ClientTraffic is what a request sent by a client is made of.
+type ClientTraffic struct {
+	// Startup is the message sent by the client before the startup, if any.
+	Startup *StartupMessage
+	// Queries are the simple queries and the executed portals.
+	Queries []*Query
+	// Transaction is the transaction state of the connection before the
+	// request.
+	Transaction Transaction
+
+	// batches are the batches closed by the request.
+	batches []*queryBatch
+}
+
+// ServerTraffic is what a response sent by a server is made of.
+type ServerTraffic struct {
+	// Queries are the queries answered by the response, with their duration.
+	Queries []*Query
+}
+
+// ConnectionTracker tracks the state of each client connection: the startup
+// parameters, so that later hooks know the user and the database, and the
+// Parse and Bind messages, so that the statement text and the parameters of
+// Execute messages can be known, and the queries sent to the server, so that
+// their duration is known when the server is ready for the next query.
+// Connections are keyed by client address.
+type ConnectionTracker struct {
+	mu          sync.Mutex
+	connections map[string]*connection
+}
+
+// NewConnectionTracker returns a new ConnectionTracker.
+func NewConnectionTracker() *ConnectionTracker {
+	return &ConnectionTracker{connections: map[string]*connection{}}
+}
+
+// get returns the state of the connection, creating it if needed. The lock
+// must be held by the caller.
+func (t *ConnectionTracker) get(client string) *connection {
+	conn, ok := t.connections[client]
+	if !ok {
+		conn = &connection{
+			parameters:  map[string]string{},
+			statements:  map[string]statement{},
+			portals:     map[string]portal{},
+			transaction: Transaction{Status: TransactionStatusIdle},
+		}
+		t.connections[client] = conn
+	}
+	return conn
+}
+
+// TrackClient reads the messages of a request sent by a client.
+func (t *ConnectionTracker) TrackClient(req *v1.Struct) *ClientTraffic {
+	if t == nil {
+		return nil
+	}
+	data := getBytesField(req, "request")
+	client := getClientAddress(req)
+	now := time.Now()
+
+	if startup, ok := parseStartupMessage(data); ok {
+		if startup.Type == StartupTypeStartup {
+			t.mu.Lock()
+			t.get(client).parameters = startup.Parameters
+			t.mu.Unlock()
+		}
+		return &ClientTraffic{Startup: startup}
+	}
+
+	messages := splitMessages(data)
+	if len(messages) == 0 {
+		return nil
+	}
+	// The queries are classified before locking, since parsing them is slow
+	// and the lock is shared by all the connections.
+	kinds := classifyMessages(messages)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conn := t.get(client)
+	conn.local = req.GetFields()["client"].GetStructValue().GetFields()["local"].GetStringValue()
+
+	conn.previous = conn.transaction
+	traffic := &ClientTraffic{Queries: []*Query{}, Transaction: conn.transaction}
+	for _, msg := range messages {
+		reader := newMessageReader(msg.body)
+		switch msg.kind {
+		case 'Q':
+			// A simple query destroys the unnamed statement and portal.
+			delete(conn.statements, "")
+			delete(conn.portals, "")
+			query := &Query{
+				Protocol: QueryProtocolSimple,
+				Text:     string(bytes.TrimRight(msg.body, "\x00")),
+				Params:   []interface{}{},
+			}
+			traffic.Queries = append(traffic.Queries, query)
+			traffic.batches = append(traffic.batches, &queryBatch{started: now, queries: []*Query{query}})
+			conn.transaction.trackStatement(kinds[query.Text], now)
+		case 'P':
+			name, text := reader.readString(), reader.readString()
+			if reader.ok {
+				forgetOne(conn.statements, name)
+				conn.statements[name] = statement{text: text, kinds: kinds[text]}
+			}
+		case 'B':
+			name, bound := reader.readString(), portal{}
+			bound.statement = reader.readString()
+			bound.params = readBindParams(reader)
+			if reader.ok {
+				forgetOne(conn.portals, name)
+				conn.portals[name] = bound
+			}
+		case 'E':
+			name := reader.readString()
+			if bound, ok := conn.portals[name]; ok && reader.ok {
+				prepared := conn.statements[bound.statement]
+				query := &Query{
+					Protocol:  QueryProtocolExtended,
+					Text:      prepared.text,
+					Params:    bound.params,
+					Statement: bound.statement,
+					Portal:    name,
+				}
+				traffic.Queries = append(traffic.Queries, query)
+				if conn.batch == nil {
+					conn.batch = &queryBatch{started: now}
+				}
+				conn.batch.queries = append(conn.batch.queries, query)
+				conn.transaction.trackStatement(prepared.kinds, now)
+			}
+		case 'S':
+			// Every Sync is answered by a ReadyForQuery, even without portals.
+			batch := conn.batch
+			if batch == nil {
+				batch = &queryBatch{started: now}
+			}
+			conn.batch = nil
+			traffic.batches = append(traffic.batches, batch)
+		case 'C':
+			kind, name := reader.readByte(), reader.readString()
+			switch {
+			case !reader.ok:
+			case kind == 'S':
+				delete(conn.statements, name)
+			case kind == 'P':
+				delete(conn.portals, name)
+			}
+		}
+	}
+	return traffic
+}
+
+// Sent records that the request was sent to the server, so that its queries
+// are timed until the server is ready for the next query. Requests answered
+// by the plugin are not sent.
+func (t *ConnectionTracker) Sent(req *v1.Struct, traffic *ClientTraffic) {
+	if t == nil || traffic == nil || len(traffic.batches) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conn := t.get(getClientAddress(req))
+	conn.pending = append(conn.pending, traffic.batches...)
+	if len(conn.pending) > maxTrackedStatements {
+		conn.pending = conn.pending[len(conn.pending)-maxTrackedStatements:]
+	}
+}
+
+// TrackServer reads the messages of a response sent by a server, and
+// returns the queries answered by it, with their duration. The status of
+// the ReadyForQuery messages is the transaction status of the connection.
+func (t *ConnectionTracker) TrackServer(resp *v1.Struct) *ServerTraffic {
+	if t == nil {
+		return nil
+	}
+	data := getBytesField(resp, "response")
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conn, ok := t.connections[getClientAddress(resp)]
+	if !ok {
+		return nil
+	}
+	traffic := &ServerTraffic{Queries: []*Query{}}
+	for _, msg := range splitMessages(data) {
+		if msg.kind != 'Z' || len(msg.body) != 1 {
+			continue
+		}
+		var batch *queryBatch
+		if len(conn.pending) > 0 {
+			batch = conn.pending[0]
+			conn.pending = conn.pending[1:]
+			for _, query := range batch.queries {
+				query.Duration = now.Sub(batch.started)
+				traffic.Queries = append(traffic.Queries, query)
+			}
+		}
+		conn.transaction.readyForQuery(msg.body[0], batch)
+	}
+	conn.completed = traffic.Queries
+	return traffic
+}
+
+// Completed returns the queries answered by the last response of the server
+// to the connection of the request, for the hooks that follow TrackServer.
+func (t *ConnectionTracker) Completed(req *v1.Struct) *ServerTraffic {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conn, ok := t.connections[getClientAddress(req)]
+	if !ok {
+		return nil
+	}
+	return &ServerTraffic{Queries: conn.completed}
+}
+
+// Info returns a copy of the state of the connection of the request, or nil
+// if the connection is not tracked.
+func (t *ConnectionTracker) Info(req *v1.Struct) *ConnectionInfo {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	remote := getClientAddress(req)
+	conn, ok := t.connections[remote]
+	if !ok {
+		return nil
+	}
+	return conn.info(remote)
+}
+
+// List returns a copy of the state of all the connections.
+func (t *ConnectionTracker) List() []*ConnectionInfo {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	infos := make([]*ConnectionInfo, 0, len(t.connections))
+	for remote, conn := range t.connections {
+		infos = append(infos, conn.info(remote))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Remote < infos[j].Remote })
+	return infos
+}
+
+func (c *connection) info(remote string) *ConnectionInfo {
+	return &ConnectionInfo{
+		Remote:      remote,
+		Local:       c.local,
+		Parameters:  maps.Clone(c.parameters),
+		Transaction: c.transaction,
+	}
+}
+
+// Parameters returns a copy of the startup parameters of the connection of
+// the request, or nil if the startup of the connection was not seen.
+func (t *ConnectionTracker) Parameters(req *v1.Struct) map[string]string {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conn, ok := t.connections[getClientAddress(req)]
+	if !ok || len(conn.parameters) == 0 {
+		return nil
+	}
+	return maps.Clone(conn.parameters)
+}
+
+// Forget drops the state of the connection of the request.
+func (t *ConnectionTracker) Forget(req *v1.Struct) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.connections, getClientAddress(req))
+}
+
+// forgetOne makes room for a new entry, if the map is full.
+// classifyMessages returns the kinds of the transaction statements of the
+// queries of the Query and Parse messages, keyed by query.
+func classifyMessages(messages []message) map[string][]string {
+	kinds := map[string][]string{}
+	for _, msg := range messages {
+		reader := newMessageReader(msg.body)
+		text := ""
+		switch msg.kind {
+		case 'Q':
+			text = string(bytes.TrimRight(msg.body, "\x00"))
+		case 'P':
+			reader.readString()
+			if text = reader.readString(); !reader.ok {
+				continue
+			}
+		default:
+			continue
+		}
+		if _, ok := kinds[text]; !ok {
+			kinds[text] = transactionStatements(text)
+		}
+	}
+	return kinds
+}
+
+func forgetOne[V any](entries map[string]V, name string) {
+	if _, ok := entries[name]; ok || len(entries) < maxTrackedStatements {
+		return
+	}
+	for key := range entries {
+		delete(entries, key)
+		return
+	}
+}
+
+type clientTrafficKey struct{}
+
+// withClientTraffic returns a context that carries the traffic of a request.
+func withClientTraffic(ctx context.Context, traffic *ClientTraffic) context.Context {
+	if traffic == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, clientTrafficKey{}, traffic)
+}
+
+// clientTrafficFrom returns the traffic carried by the context, if any.
+func clientTrafficFrom(ctx context.Context) *ClientTraffic {
+	traffic, _ := ctx.Value(clientTrafficKey{}).(*ClientTraffic)
+	return traffic
+}
+
+type serverTrafficKey struct{}
+
+// withServerTraffic returns a context that carries the traffic of a response.
+func withServerTraffic(ctx context.Context, traffic *ServerTraffic) context.Context {
+	if traffic == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, serverTrafficKey{}, traffic)
+}
+
+// serverTrafficFrom returns the traffic carried by the context, if any.
+func serverTrafficFrom(ctx context.Context) *ServerTraffic {
+	traffic, _ := ctx.Value(serverTrafficKey{}).(*ServerTraffic)
+	return traffic
+}
+
+// newConnectionObject returns the JS object of the connection of the request,
+// or null if the request has no client.
+func (p *Plugin) newConnectionObject(req *v1.Struct) goja.Value {
+	remote := getClientAddress(req)
+	if remote == "" {
+		return goja.Null()
+	}
+
+	info := p.Connections.Info(req)
+	if info == nil {
+		info = &ConnectionInfo{Remote: remote, Transaction: Transaction{Status: TransactionStatusIdle}}
+	}
+	info.Local = req.GetFields()["client"].GetStructValue().GetFields()["local"].GetStringValue()
+	if len(info.Parameters) == 0 {
+		info.Parameters = nil
+	}
+	return newConnectionInfoObject(p.VM, info)
+}
+
+func newConnectionInfoObject(runtime *goja.Runtime, info *ConnectionInfo) *goja.Object {
+	object := runtime.NewObject()
+	setProperty(object, "remote", info.Remote)
+	setProperty(object, "local", info.Local)
+	setProperty(object, "parameters", info.Parameters)
+	setProperty(object, "user", info.Parameters["user"])
+	setProperty(object, "database", info.Parameters["database"])
+	setProperty(object, "applicationName", info.Parameters["application_name"])
+	setProperty(object, "transaction", newTransactionObject(runtime, info.Transaction))
+	return object
+}
+
+// RegisterConnectionAPI exposes the state of all the client connections to
+// JS, e.g. for onTick functions that look for long transactions:
+//
+//	for (const conn of listConnections()) {
+//	  if (conn.transaction.status !== "idle" && Date.now() - conn.transaction.lastActivityAt > 60000) { ... }
+//	}
+func (p *Plugin) RegisterConnectionAPI() error {
+	runtime := p.VM
+	return runtime.Set("listConnections", func() []interface{} {
+		connections := []interface{}{}
+		for _, info := range p.Connections.List() {
+			connections = append(connections, newConnectionInfoObject(runtime, info))
+		}
+		return connections
+	})
+}
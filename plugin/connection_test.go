@@ -0,0 +1,83 @@
+package plugin
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/dop251/goja"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionTracker_Startup(t *testing.T) {
+	tracker := NewConnectionTracker()
+	req := newTrafficRequest(t, nil)
+	assert.Nil(t, tracker.Parameters(req))
+
+	// An SSLRequest comes first, and is not a startup.
+	sslRequest := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), sslRequestCode)
+	traffic := tracker.TrackClient(newTrafficRequest(t, sslRequest))
+	require.NotNil(t, traffic)
+	assert.Equal(t, StartupTypeSSL, traffic.Startup.Type)
+	assert.Nil(t, tracker.Parameters(req))
+
+	traffic = tracker.TrackClient(newTrafficRequest(t,
+		newStartupMessage("user", "alice", "database", "shop", "application_name", "psql")))
+	require.NotNil(t, traffic)
+	assert.Equal(t, StartupTypeStartup, traffic.Startup.Type)
+	assert.Empty(t, traffic.Queries)
+
+	parameters := tracker.Parameters(req)
+	assert.Equal(t, map[string]string{"user": "alice", "database": "shop", "application_name": "psql"}, parameters)
+	parameters["user"] = "mallory"
+	assert.Equal(t, "alice", tracker.Parameters(req)["user"])
+
+	tracker.Forget(req)
+	assert.Nil(t, tracker.Parameters(req))
+
+	var nilTracker *ConnectionTracker
+	assert.Nil(t, nilTracker.Parameters(req))
+}
+
+func TestPlugin_HookContextConnection(t *testing.T) {
+	p := newTestPlugin(t)
+	p.Connections = NewConnectionTracker()
+	require.NoError(t, p.VM.Set("Value", p.VM.ToValue(v1.NewValue)))
+	_, err := p.VM.RunString(`
+	function onTrafficFromClient(ctx, req) {
+		req.Fields["startup"] = Value(ctx.startup === null ? "" : ctx.startup.type);
+		req.Fields["user"] = Value(ctx.connection.user);
+		return req;
+	}
+	function onTrafficFromServer(ctx, req) {
+		req.Fields["database"] = Value(ctx.connection.database);
+		req.Fields["remote"] = Value(ctx.connection.remote);
+		req.Fields["application"] = Value(ctx.connection.parameters.application_name);
+		return req;
+	}`)
+	require.NoError(t, err)
+	p.RegisterFunctions([]string{"onTrafficFromClient", "onTrafficFromServer"})
+
+	// The parameters are known from the hook of the startup on.
+	result, err := p.OnTrafficFromClient(context.Background(), newTrafficRequest(t,
+		newStartupMessage("user", "alice", "database", "shop", "application_name", "psql")))
+	require.NoError(t, err)
+	assert.Equal(t, StartupTypeStartup, result.AsMap()["startup"])
+	assert.Equal(t, "alice", result.AsMap()["user"])
+
+	result, err = p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, newQueryMessage("SELECT 1")))
+	require.NoError(t, err)
+	assert.Empty(t, result.AsMap()["startup"])
+	assert.Equal(t, "alice", result.AsMap()["user"])
+
+	result, err = p.OnTrafficFromServer(context.Background(), newTrafficRequest(t, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "shop", result.AsMap()["database"])
+	assert.Equal(t, "127.0.0.1:5000", result.AsMap()["remote"])
+	assert.Equal(t, "psql", result.AsMap()["application"])
+
+	// Requests without a client have no connection.
+	assert.Equal(t, goja.Null(), p.newConnectionObject(nil))
+}
@@ -0,0 +1,106 @@
+package plugin
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/dop251/goja"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// callID is incremented for each hook call to give every call a unique id.
+var callID atomic.Uint64
+
+// newHookContext builds the context object passed as the first argument of
+// JS functions. It carries the hook that is being run, the deadline and
+// cancellation state of the gRPC call, the plugin metadata, the gRPC
+// metadata sent by GatewayD and the client connection of the request, if
+// any. The VM lock must be held by the caller.
+func (p *Plugin) newHookContext(ctx context.Context, name string, req *v1.Struct) *goja.Object {
+	runtime := p.VM
+	hookContext := runtime.NewObject()
+
+	set := func(key string, value interface{}) {
+		// Set only fails on frozen objects or throwing setters, which
+		// cannot happen on a fresh object.
+		_ = hookContext.Set(key, value)
+	}
+
+	set("id", strconv.FormatUint(callID.Add(1), 10))
+	set("hook", name)
+	set("hookName", int32(Hooks[name]))
+	set("plugin", map[string]interface{}{
+		"name":      PluginID.GetName(),
+		"version":   PluginID.GetVersion(),
+		"remoteUrl": PluginID.GetRemoteUrl(),
+	})
+
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		date, err := runtime.New(runtime.Get("Date"), runtime.ToValue(deadline.UnixMilli()))
+		if err == nil {
+			set("deadline", date)
+		}
+	} else {
+		set("deadline", goja.Null())
+	}
+	set("remainingMs", func() float64 {
+		if !hasDeadline {
+			return math.Inf(1)
+		}
+		return float64(time.Until(deadline).Milliseconds())
+	})
+	set("cancelled", func() bool {
+		return ctx.Err() != nil
+	})
+	set("err", func() goja.Value {
+		if err := ctx.Err(); err != nil {
+			return runtime.ToValue(err.Error())
+		}
+		return goja.Null()
+	})
+
+	md := map[string]interface{}{}
+	if incoming, ok := metadata.FromIncomingContext(ctx); ok {
+		for key, values := range incoming {
+			list := make([]interface{}, 0, len(values))
+			for _, value := range values {
+				list = append(list, value)
+			}
+			md[key] = list
+		}
+	}
+	set("metadata", md)
+
+	// The message sent before the startup, and the queries run by the
+	// request or answered by the response, if any, with ctx.query being the
+	// first.
+	traffic := clientTrafficFrom(ctx)
+	queries := []interface{}{}
+	if traffic != nil {
+		for _, query := range traffic.Queries {
+			queries = append(queries, newQueryObject(runtime, query))
+		}
+	}
+	if serverTraffic := serverTrafficFrom(ctx); serverTraffic != nil {
+		for _, query := range serverTraffic.Queries {
+			queries = append(queries, newQueryObject(runtime, query))
+		}
+	}
+	set("queries", queries)
+	set("query", goja.Null())
+	if len(queries) > 0 {
+		set("query", queries[0])
+	}
+	set("startup", goja.Null())
+	if traffic != nil && traffic.Startup != nil {
+		set("startup", newStartupObject(runtime, traffic.Startup))
+	}
+	set("connection", p.newConnectionObject(req))
+
+	return hookContext
+}
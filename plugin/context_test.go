@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func runContextScript(t *testing.T, ctx context.Context, body string) map[string]interface{} {
+	t.Helper()
+	p := newTestPlugin(t)
+	require.NoError(t, p.VM.Set("Value", p.VM.ToValue(v1.NewValue)))
+	_, err := p.VM.RunString(`function onTrafficFromClient(ctx, req) {
+		const out = ` + body + `;
+		for (const key in out) { req.Fields[key] = Value(out[key]); }
+		return req;
+	}`)
+	require.NoError(t, err)
+	p.RegisterFunction("onTrafficFromClient")
+
+	result, err := p.RunFunction(ctx, "onTrafficFromClient", newTestRequest(t))
+	require.NoError(t, err)
+	return result.AsMap()
+}
+
+func TestHookContext(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-request-id", "abc"))
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	result := runContextScript(t, ctx, `{
+		hook: ctx.hook,
+		hookName: ctx.hookName,
+		id: ctx.id,
+		plugin: ctx.plugin.name,
+		version: ctx.plugin.version,
+		hasDeadline: ctx.deadline instanceof Date,
+		remaining: ctx.remainingMs() > 0 && ctx.remainingMs() <= 60000,
+		cancelled: ctx.cancelled(),
+		requestId: ctx.metadata["x-request-id"][0],
+	}`)
+
+	assert.Equal(t, "onTrafficFromClient", result["hook"])
+	assert.InDelta(t, float64(v1.HookName_HOOK_NAME_ON_TRAFFIC_FROM_CLIENT), result["hookName"], 0)
+	assert.NotEmpty(t, result["id"])
+	assert.Equal(t, PluginID.GetName(), result["plugin"])
+	assert.Equal(t, PluginID.GetVersion(), result["version"])
+	assert.Equal(t, true, result["hasDeadline"])
+	assert.Equal(t, true, result["remaining"])
+	assert.Equal(t, false, result["cancelled"])
+	assert.Equal(t, "abc", result["requestId"])
+}
+
+func TestHookContext_NoDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result := runContextScript(t, ctx, `{
+		deadline: ctx.deadline === null,
+		remaining: ctx.remainingMs() === Infinity,
+		cancelled: ctx.cancelled(),
+		err: ctx.err(),
+	}`)
+
+	assert.Equal(t, true, result["deadline"])
+	assert.Equal(t, true, result["remaining"])
+	assert.Equal(t, true, result["cancelled"])
+	assert.Equal(t, context.Canceled.Error(), result["err"])
+}
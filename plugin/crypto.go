@@ -0,0 +1,277 @@
+package plugin
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+var (
+	ErrUnknownHashAlgorithm = errors.New("unknown hash algorithm")
+	ErrCiphertextTooShort   = errors.New("ciphertext too short")
+)
+
+// newHash returns the hash constructor for the algorithm name.
+func newHash(algorithm string) (func() hash.Hash, error) {
+	switch strings.ToLower(strings.ReplaceAll(algorithm, "-", "")) {
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	case "sha384":
+		return sha512.New384, nil
+	case "sha512":
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownHashAlgorithm, algorithm)
+	}
+}
+
+// aesGCMEncrypt encrypts the plaintext with AES-GCM and a random nonce. The
+// nonce is prepended to the ciphertext. The key must be 16, 24 or 32 bytes.
+func aesGCMEncrypt(key, plaintext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// aesGCMDecrypt decrypts the output of aesGCMEncrypt.
+func aesGCMDecrypt(key, ciphertext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrCiphertextTooShort
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, additionalData)
+}
+
+// keystream is an endless stream of bytes derived from a key and a seed
+// with HMAC-SHA256 in counter mode.
+type keystream struct {
+	key     []byte
+	seed    []byte
+	counter uint64
+	block   []byte
+}
+
+func (k *keystream) next() byte {
+	if len(k.block) == 0 {
+		mac := hmac.New(sha256.New, k.key)
+		mac.Write(k.seed)
+		mac.Write(binary.BigEndian.AppendUint64(nil, k.counter))
+		k.block = mac.Sum(nil)
+		k.counter++
+	}
+	b := k.block[0]
+	k.block = k.block[1:]
+	return b
+}
+
+// uniform returns a uniformly distributed number in [0, n) by rejecting
+// the bytes that would bias the result.
+func (k *keystream) uniform(n int) int {
+	limit := 256 - 256%n
+	for {
+		if b := int(k.next()); b < limit {
+			return b % n
+		}
+	}
+}
+
+// tokenize replaces each digit of the value with a digit and each ASCII
+// letter with a letter of the same case, keeping all other characters, so
+// that the token has the same format as the value. The first keepFirst and
+// the last keepLast alphanumeric characters are kept as is. The result is
+// deterministic for a given key and value, so tokens can still be joined
+// on, but it cannot be reversed.
+func tokenize(key []byte, value string, keepFirst, keepLast int) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	stream := &keystream{key: key, seed: mac.Sum(nil)}
+
+	isAlphanumeric := func(r rune) bool {
+		return (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+	}
+	total := 0
+	for _, r := range value {
+		if isAlphanumeric(r) {
+			total++
+		}
+	}
+
+	var builder strings.Builder
+	position := 0
+	for _, r := range value {
+		if !isAlphanumeric(r) {
+			builder.WriteRune(r)
+			continue
+		}
+		position++
+		if position <= keepFirst || position > total-keepLast {
+			builder.WriteRune(r)
+			continue
+		}
+		switch {
+		case r >= '0' && r <= '9':
+			builder.WriteByte(byte('0' + stream.uniform(10)))
+		case r >= 'a' && r <= 'z':
+			builder.WriteByte(byte('a' + stream.uniform(26)))
+		default:
+			builder.WriteByte(byte('A' + stream.uniform(26)))
+		}
+	}
+	return builder.String()
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return "", err
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
+
+// RequireCrypto is the loader of the native crypto module. Binary inputs can
+// be a Uint8Array, an ArrayBuffer or a string, which is encoded as UTF-8, and
+// binary outputs are Uint8Arrays:
+//
+//	const crypto = require("crypto")
+//	crypto.hash("sha256", data)
+//	crypto.hmac("sha256", key, data)
+//	crypto.randomBytes(16)
+//	crypto.randomUUID()
+//	crypto.encrypt(key, plaintext, additionalData) // AES-GCM
+//	crypto.decrypt(key, ciphertext, additionalData)
+//	crypto.tokenize(key, "4111-1111-1111-1111", { keepLast: 4 })
+//	crypto.timingSafeEqual(a, b)
+func RequireCrypto(runtime *goja.Runtime, module *goja.Object) {
+	exports, ok := module.Get("exports").(*goja.Object)
+	if !ok {
+		panic(runtime.NewTypeError("crypto: module exports is not an object"))
+	}
+
+	set := func(name string, value func(call goja.FunctionCall) goja.Value) {
+		if err := exports.Set(name, value); err != nil {
+			panic(err)
+		}
+	}
+
+	set("hash", func(call goja.FunctionCall) goja.Value {
+		newFunc, err := newHash(call.Argument(0).String())
+		if err != nil {
+			panic(runtime.NewTypeError("crypto.hash: %s", err))
+		}
+		digest := newFunc()
+		digest.Write(mustBytes(runtime, call.Argument(1), "crypto.hash"))
+		return newUint8Array(runtime, digest.Sum(nil))
+	})
+
+	set("hmac", func(call goja.FunctionCall) goja.Value {
+		newFunc, err := newHash(call.Argument(0).String())
+		if err != nil {
+			panic(runtime.NewTypeError("crypto.hmac: %s", err))
+		}
+		mac := hmac.New(newFunc, mustBytes(runtime, call.Argument(1), "crypto.hmac"))
+		mac.Write(mustBytes(runtime, call.Argument(2), "crypto.hmac"))
+		return newUint8Array(runtime, mac.Sum(nil))
+	})
+
+	set("randomBytes", func(call goja.FunctionCall) goja.Value {
+		size := call.Argument(0).ToInteger()
+		if size < 0 || size > 1<<16 {
+			panic(runtime.NewTypeError("crypto.randomBytes: size must be between 0 and 65536"))
+		}
+		data := make([]byte, size)
+		if _, err := rand.Read(data); err != nil {
+			panic(runtime.NewGoError(err))
+		}
+		return newUint8Array(runtime, data)
+	})
+
+	set("randomUUID", func(goja.FunctionCall) goja.Value {
+		uuid, err := newUUID()
+		if err != nil {
+			panic(runtime.NewGoError(err))
+		}
+		return runtime.ToValue(uuid)
+	})
+
+	set("encrypt", func(call goja.FunctionCall) goja.Value {
+		additionalData, _ := toBytes(call.Argument(2))
+		ciphertext, err := aesGCMEncrypt(
+			mustBytes(runtime, call.Argument(0), "crypto.encrypt"),
+			mustBytes(runtime, call.Argument(1), "crypto.encrypt"),
+			additionalData)
+		if err != nil {
+			panic(runtime.NewTypeError("crypto.encrypt: %s", err))
+		}
+		return newUint8Array(runtime, ciphertext)
+	})
+
+	set("decrypt", func(call goja.FunctionCall) goja.Value {
+		additionalData, _ := toBytes(call.Argument(2))
+		plaintext, err := aesGCMDecrypt(
+			mustBytes(runtime, call.Argument(0), "crypto.decrypt"),
+			mustBytes(runtime, call.Argument(1), "crypto.decrypt"),
+			additionalData)
+		if err != nil {
+			panic(runtime.NewTypeError("crypto.decrypt: %s", err))
+		}
+		return newUint8Array(runtime, plaintext)
+	})
+
+	set("tokenize", func(call goja.FunctionCall) goja.Value {
+		key := mustBytes(runtime, call.Argument(0), "crypto.tokenize")
+		keepFirst, keepLast := 0, 0
+		if options := call.Argument(2); !goja.IsUndefined(options) && !goja.IsNull(options) {
+			object := options.ToObject(runtime)
+			if value := object.Get("keepFirst"); value != nil {
+				keepFirst = int(value.ToInteger())
+			}
+			if value := object.Get("keepLast"); value != nil {
+				keepLast = int(value.ToInteger())
+			}
+		}
+		return runtime.ToValue(tokenize(key, call.Argument(1).String(), keepFirst, keepLast))
+	})
+
+	set("timingSafeEqual", func(call goja.FunctionCall) goja.Value {
+		return runtime.ToValue(subtle.ConstantTimeCompare(
+			mustBytes(runtime, call.Argument(0), "crypto.timingSafeEqual"),
+			mustBytes(runtime, call.Argument(1), "crypto.timingSafeEqual")) == 1)
+	})
+}
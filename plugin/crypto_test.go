@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"testing"
+
+	"github.com/dop251/goja"
+	jsRequire "github.com/dop251/goja_nodejs/require"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCryptoTestRuntime(t *testing.T) *goja.Runtime {
+	t.Helper()
+	runtime := goja.New()
+	registry := jsRequire.NewRegistry()
+	registry.RegisterNativeModule("crypto", RequireCrypto)
+	registry.Enable(runtime)
+	_, err := runtime.RunString(`
+		const crypto = require("crypto");
+		const hex = (bytes) => Array.from(bytes, (b) => b.toString(16).padStart(2, "0")).join("");
+	`)
+	require.NoError(t, err)
+	return runtime
+}
+
+func TestCrypto_HashAndHMAC(t *testing.T) {
+	runtime := newCryptoTestRuntime(t)
+
+	digest := sha256.Sum256([]byte("hello"))
+	value, err := runtime.RunString(`hex(crypto.hash("sha256", "hello"))`)
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(digest[:]), value.String())
+
+	value, err = runtime.RunString(`crypto.hash("SHA-512", new Uint8Array([1, 2, 3]).buffer).length`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(64), value.ToInteger())
+
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte("data"))
+	value, err = runtime.RunString(`hex(crypto.hmac("sha256", "key", "data"))`)
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), value.String())
+
+	_, err = runtime.RunString(`crypto.hash("md4", "hello")`)
+	require.Error(t, err)
+	_, err = runtime.RunString(`crypto.hash("sha256", 42)`)
+	require.Error(t, err)
+}
+
+func TestCrypto_Random(t *testing.T) {
+	runtime := newCryptoTestRuntime(t)
+
+	value, err := runtime.RunString(`crypto.randomBytes(16) instanceof Uint8Array && crypto.randomBytes(16).length`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(16), value.ToInteger())
+
+	value, err = runtime.RunString(`crypto.randomUUID()`)
+	require.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`), value.String())
+}
+
+func TestCrypto_EncryptDecrypt(t *testing.T) {
+	runtime := newCryptoTestRuntime(t)
+
+	value, err := runtime.RunString(`
+		const key = crypto.randomBytes(32);
+		const sealed = crypto.encrypt(key, "secret", "aad");
+		String.fromCharCode(...crypto.decrypt(key, sealed, "aad"))
+	`)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", value.String())
+
+	_, err = runtime.RunString(`crypto.decrypt(key, sealed, "other")`)
+	require.Error(t, err)
+	_, err = runtime.RunString(`crypto.encrypt("short", "secret")`)
+	require.Error(t, err)
+}
+
+func TestCrypto_Tokenize(t *testing.T) {
+	token := tokenize([]byte("key"), "4111-1111-1111-1234", 0, 4)
+	assert.Regexp(t, regexp.MustCompile(`^\d{4}-\d{4}-\d{4}-1234$`), token)
+	assert.NotEqual(t, "4111-1111-1111-1234", token)
+	assert.Equal(t, token, tokenize([]byte("key"), "4111-1111-1111-1234", 0, 4))
+	assert.NotEqual(t, token, tokenize([]byte("other"), "4111-1111-1111-1234", 0, 4))
+
+	token = tokenize([]byte("key"), "John Doe", 1, 0)
+	assert.Regexp(t, regexp.MustCompile(`^J[a-z]{3} [A-Z][a-z]{2}$`), token)
+
+	runtime := newCryptoTestRuntime(t)
+	value, err := runtime.RunString(`crypto.tokenize("key", "4111-1111-1111-1234", { keepLast: 4 })`)
+	require.NoError(t, err)
+	assert.Equal(t, tokenize([]byte("key"), "4111-1111-1111-1234", 0, 4), value.String())
+}
+
+func TestCrypto_TimingSafeEqual(t *testing.T) {
+	runtime := newCryptoTestRuntime(t)
+	value, err := runtime.RunString(`[crypto.timingSafeEqual("abc", "abc"), crypto.timingSafeEqual("abc", "abd")].join()`)
+	require.NoError(t, err)
+	assert.Equal(t, "true,false", value.String())
+}
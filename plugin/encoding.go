@@ -0,0 +1,437 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dop251/goja"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+)
+
+// NewValue is the Value helper exposed to JS. It extends v1.NewValue with
+// support for ArrayBuffers, which are stored as bytes like Uint8Arrays.
+func NewValue(value interface{}) (*v1.Value, error) {
+	if buffer, ok := value.(goja.ArrayBuffer); ok {
+		return v1.NewBytesValue(buffer.Bytes()), nil
+	}
+	return v1.NewValue(value)
+}
+
+// toBinaryString converts bytes to a JS binary string, in which each
+// character code is the value of a byte.
+func toBinaryString(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// newStructValue returns the JS object of a request or a response, whose
+// byte values are Uint8Arrays: req.Fields["request"].GetBytesValue() returns
+// a Uint8Array instead of a Go byte slice. The object exports to the struct.
+func newStructValue(runtime *goja.Runtime, value *v1.Struct) goja.Value {
+	if value == nil {
+		return goja.Null()
+	}
+	return runtime.NewDynamicObject(&structObject{
+		runtime: runtime,
+		value:   value,
+		object:  runtime.ToValue(value).ToObject(runtime),
+	})
+}
+
+// structObject is the JS object of a struct. Its Fields are fieldsObjects
+// and the other properties are those of the struct.
+type structObject struct {
+	runtime *goja.Runtime
+	value   *v1.Struct
+	object  *goja.Object
+}
+
+func (o *structObject) Get(key string) goja.Value {
+	if key == "Fields" {
+		if o.value.Fields == nil {
+			o.value.Fields = map[string]*v1.Value{}
+		}
+		return o.runtime.NewDynamicObject(&fieldsObject{runtime: o.runtime, fields: o.value.Fields})
+	}
+	return o.object.Get(key)
+}
+
+func (o *structObject) Set(key string, value goja.Value) bool {
+	return o.object.Set(key, value) == nil
+}
+
+func (o *structObject) Has(key string) bool {
+	return o.object.Get(key) != nil
+}
+
+func (o *structObject) Delete(key string) bool {
+	return o.object.Delete(key) == nil
+}
+
+func (o *structObject) Keys() []string {
+	return o.object.Keys()
+}
+
+// fieldsObject is the JS object of the fields of a struct, whose values are
+// the objects returned by newFieldValue.
+type fieldsObject struct {
+	runtime *goja.Runtime
+	fields  map[string]*v1.Value
+}
+
+func (o *fieldsObject) Get(key string) goja.Value {
+	value, ok := o.fields[key]
+	if !ok {
+		return nil
+	}
+	return newFieldValue(o.runtime, value)
+}
+
+func (o *fieldsObject) Set(key string, value goja.Value) bool {
+	if field, ok := value.Export().(*fieldObject); ok {
+		o.fields[key] = field.value
+		return true
+	}
+	var field *v1.Value
+	if err := o.runtime.ExportTo(value, &field); err != nil {
+		return false
+	}
+	o.fields[key] = field
+	return true
+}
+
+func (o *fieldsObject) Has(key string) bool {
+	_, ok := o.fields[key]
+	return ok
+}
+
+func (o *fieldsObject) Delete(key string) bool {
+	delete(o.fields, key)
+	return true
+}
+
+func (o *fieldsObject) Keys() []string {
+	keys := make([]string, 0, len(o.fields))
+	for key := range o.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// newFieldValue returns the JS object of a value of a struct, whose
+// GetBytesValue returns a Uint8Array, or null if it is not bytes, whose
+// GetStructValue returns the object of newStructValue, and whose
+// GetListValue returns a list whose values are objects of newFieldValue.
+func newFieldValue(runtime *goja.Runtime, value *v1.Value) goja.Value {
+	if value == nil {
+		return goja.Null()
+	}
+	return runtime.NewDynamicObject(&fieldObject{
+		runtime: runtime,
+		value:   value,
+		object:  runtime.ToValue(value).ToObject(runtime),
+	})
+}
+
+type fieldObject struct {
+	runtime *goja.Runtime
+	value   *v1.Value
+	object  *goja.Object
+}
+
+func (o *fieldObject) Get(key string) goja.Value {
+	switch key {
+	case "GetBytesValue":
+		return o.runtime.ToValue(func() goja.Value {
+			if _, ok := o.value.GetKind().(*v1.Value_BytesValue); !ok {
+				return goja.Null()
+			}
+			return newUint8Array(o.runtime, o.value.GetBytesValue())
+		})
+	case "GetStructValue":
+		return o.runtime.ToValue(func() goja.Value {
+			return newStructValue(o.runtime, o.value.GetStructValue())
+		})
+	case "GetListValue":
+		return o.runtime.ToValue(func() goja.Value {
+			return newListValue(o.runtime, o.value.GetListValue())
+		})
+	default:
+		return o.object.Get(key)
+	}
+}
+
+func (o *fieldObject) Set(key string, value goja.Value) bool {
+	return o.object.Set(key, value) == nil
+}
+
+func (o *fieldObject) Has(key string) bool {
+	return o.object.Get(key) != nil
+}
+
+func (o *fieldObject) Delete(key string) bool {
+	return o.object.Delete(key) == nil
+}
+
+func (o *fieldObject) Keys() []string {
+	return o.object.Keys()
+}
+
+// newListValue returns the JS object of a list, whose Values, also returned
+// by GetValues, are an array of the objects of newFieldValue.
+func newListValue(runtime *goja.Runtime, value *v1.ListValue) goja.Value {
+	if value == nil {
+		return goja.Null()
+	}
+	return runtime.NewDynamicObject(&listObject{
+		runtime: runtime,
+		value:   value,
+		object:  runtime.ToValue(value).ToObject(runtime),
+	})
+}
+
+type listObject struct {
+	runtime *goja.Runtime
+	value   *v1.ListValue
+	object  *goja.Object
+}
+
+func (o *listObject) Get(key string) goja.Value {
+	values := o.runtime.NewDynamicArray(&valuesArray{runtime: o.runtime, list: o.value})
+	switch key {
+	case "Values":
+		return values
+	case "GetValues":
+		return o.runtime.ToValue(func() goja.Value { return values })
+	default:
+		return o.object.Get(key)
+	}
+}
+
+func (o *listObject) Set(key string, value goja.Value) bool {
+	return o.object.Set(key, value) == nil
+}
+
+func (o *listObject) Has(key string) bool {
+	return o.object.Get(key) != nil
+}
+
+func (o *listObject) Delete(key string) bool {
+	return o.object.Delete(key) == nil
+}
+
+func (o *listObject) Keys() []string {
+	return o.object.Keys()
+}
+
+// valuesArray is the JS array of the values of a list.
+type valuesArray struct {
+	runtime *goja.Runtime
+	list    *v1.ListValue
+}
+
+func (a *valuesArray) Len() int {
+	return len(a.list.Values)
+}
+
+func (a *valuesArray) Get(index int) goja.Value {
+	if index < 0 || index >= len(a.list.Values) {
+		return nil
+	}
+	return newFieldValue(a.runtime, a.list.Values[index])
+}
+
+func (a *valuesArray) Set(index int, value goja.Value) bool {
+	if index < 0 {
+		return false
+	}
+	var item *v1.Value
+	if field, ok := value.Export().(*fieldObject); ok {
+		item = field.value
+	} else if err := a.runtime.ExportTo(value, &item); err != nil {
+		return false
+	}
+	if index >= len(a.list.Values) {
+		a.SetLen(index + 1)
+	}
+	a.list.Values[index] = item
+	return true
+}
+
+func (a *valuesArray) SetLen(length int) bool {
+	if length < 0 {
+		return false
+	}
+	for len(a.list.Values) < length {
+		a.list.Values = append(a.list.Values, &v1.Value{Kind: &v1.Value_NullValue{}})
+	}
+	a.list.Values = a.list.Values[:length]
+	return true
+}
+
+// exportStruct returns the struct of a JS value, which is either a struct or
+// the object returned by newStructValue.
+func exportStruct(value goja.Value) (*v1.Struct, bool) {
+	if value == nil {
+		return nil, false
+	}
+	switch exported := value.Export().(type) {
+	case *v1.Struct:
+		return exported, true
+	case *structObject:
+		return exported.value, true
+	default:
+		return nil, false
+	}
+}
+
+// toUint8ArrayBytes converts any byte-like JS value, including byte slices
+// passed from Go and arrays of numbers, to bytes.
+func toUint8ArrayBytes(runtime *goja.Runtime, value goja.Value, function string) []byte {
+	if data, ok := toBytes(value); ok {
+		return data
+	}
+	var numbers []byte
+	if err := runtime.ExportTo(value, &numbers); err != nil {
+		panic(runtime.NewTypeError("%s: cannot convert %s to bytes", function, value))
+	}
+	return numbers
+}
+
+// decodeText decodes the bytes with the given encoding label. Invalid UTF-8
+// sequences are replaced with U+FFFD unless fatal is set.
+func decodeText(runtime *goja.Runtime, encoding string, data []byte, fatal bool) string {
+	switch encoding {
+	case "latin1", "iso-8859-1", "ascii", "us-ascii":
+		return toBinaryString(data)
+	default:
+		data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+		if !utf8.Valid(data) {
+			if fatal {
+				panic(runtime.NewTypeError("TextDecoder: the encoded data is not valid %s", encoding))
+			}
+			return strings.ToValidUTF8(string(data), "\uFFFD")
+		}
+		return string(data)
+	}
+}
+
+// RegisterEncodingHelpers exposes binary-safe helpers to JS:
+//
+//	bytes(value)           // Uint8Array from a string (UTF-8), Go []byte, ArrayBuffer or array
+//	toBase64(bytes)        // base64 string
+//	fromBase64(string)     // Uint8Array
+//	toHex(bytes)           // hex string
+//	fromHex(string)        // Uint8Array
+//	btoa(string)           // base64 of the UTF-8 string
+//	atob(base64)           // UTF-8 string
+//	new TextEncoder().encode(string)
+//	new TextDecoder("utf-8", { fatal: true }).decode(bytes)
+func RegisterEncodingHelpers(runtime *goja.Runtime) error {
+	helpers := map[string]interface{}{
+		"bytes": func(call goja.FunctionCall) goja.Value {
+			return newUint8Array(runtime, toUint8ArrayBytes(runtime, call.Argument(0), "bytes"))
+		},
+		"toBase64": func(call goja.FunctionCall) goja.Value {
+			return runtime.ToValue(base64.StdEncoding.EncodeToString(
+				toUint8ArrayBytes(runtime, call.Argument(0), "toBase64")))
+		},
+		"fromBase64": func(call goja.FunctionCall) goja.Value {
+			decoded, err := base64.StdEncoding.DecodeString(call.Argument(0).String())
+			if err != nil {
+				panic(runtime.NewTypeError("fromBase64: invalid base64 input: %s", err))
+			}
+			return newUint8Array(runtime, decoded)
+		},
+		"toHex": func(call goja.FunctionCall) goja.Value {
+			return runtime.ToValue(hex.EncodeToString(toUint8ArrayBytes(runtime, call.Argument(0), "toHex")))
+		},
+		"fromHex": func(call goja.FunctionCall) goja.Value {
+			decoded, err := hex.DecodeString(call.Argument(0).String())
+			if err != nil {
+				panic(runtime.NewTypeError("fromHex: invalid hex input: %s", err))
+			}
+			return newUint8Array(runtime, decoded)
+		},
+		// btoa and atob encode strings as UTF-8, unlike those of browsers,
+		// which use binary strings. toBase64 and fromBase64 are binary-safe.
+		"btoa": func(call goja.FunctionCall) goja.Value {
+			if len(call.Arguments) < 1 {
+				panic(runtime.NewTypeError("btoa requires 1 argument"))
+			}
+			return runtime.ToValue(base64.StdEncoding.EncodeToString([]byte(call.Arguments[0].String())))
+		},
+		"atob": func(call goja.FunctionCall) goja.Value {
+			if len(call.Arguments) < 1 {
+				panic(runtime.NewTypeError("atob requires 1 argument"))
+			}
+			decoded, err := base64.StdEncoding.DecodeString(call.Arguments[0].String())
+			if err != nil {
+				panic(runtime.NewTypeError("atob: invalid base64 input: %s", err))
+			}
+			return runtime.ToValue(string(decoded))
+		},
+		"TextEncoder": func(call goja.ConstructorCall) *goja.Object {
+			setProperty(call.This, "encoding", "utf-8")
+			setProperty(call.This, "encode", func(call goja.FunctionCall) goja.Value {
+				if goja.IsUndefined(call.Argument(0)) {
+					return newUint8Array(runtime, nil)
+				}
+				return newUint8Array(runtime, []byte(call.Argument(0).String()))
+			})
+			return nil
+		},
+		"TextDecoder": func(call goja.ConstructorCall) *goja.Object {
+			encoding := "utf-8"
+			if label := call.Argument(0); !goja.IsUndefined(label) {
+				encoding = strings.ToLower(strings.TrimSpace(label.String()))
+			}
+			switch encoding {
+			case "utf-8", "utf8", "unicode-1-1-utf-8":
+				encoding = "utf-8"
+			case "latin1", "iso-8859-1", "ascii", "us-ascii":
+			default:
+				panic(runtime.NewTypeError("TextDecoder: unsupported encoding %q", encoding))
+			}
+			fatal := false
+			if options := call.Argument(1); !goja.IsUndefined(options) && !goja.IsNull(options) {
+				if value := options.ToObject(runtime).Get("fatal"); value != nil {
+					fatal = value.ToBoolean()
+				}
+			}
+
+			setProperty(call.This, "encoding", encoding)
+			setProperty(call.This, "fatal", fatal)
+			setProperty(call.This, "decode", func(call goja.FunctionCall) goja.Value {
+				if goja.IsUndefined(call.Argument(0)) {
+					return runtime.ToValue("")
+				}
+				return runtime.ToValue(decodeText(runtime, encoding,
+					toUint8ArrayBytes(runtime, call.Argument(0), "TextDecoder.decode"), fatal))
+			})
+			return nil
+		},
+	}
+
+	for name, helper := range helpers {
+		if err := runtime.Set(name, helper); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setProperty sets a property of a newly created object, which cannot fail.
+func setProperty(object *goja.Object, name string, value interface{}) {
+	if err := object.Set(name, value); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dop251/goja"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newEncodingTestRuntime(t *testing.T) *goja.Runtime {
+	t.Helper()
+	runtime := goja.New()
+	require.NoError(t, RegisterEncodingHelpers(runtime))
+	require.NoError(t, runtime.Set("Value", runtime.ToValue(NewValue)))
+	return runtime
+}
+
+func TestEncoding_BinarySafeBase64(t *testing.T) {
+	runtime := newEncodingTestRuntime(t)
+	require.NoError(t, runtime.Set("binary", []byte{0x00, 0xFF, 0x80, 0x7F}))
+
+	value, err := runtime.RunString(`[toBase64(binary), toBase64(bytes(binary)), toHex(fromBase64("AP+Afw=="))].join()`)
+	require.NoError(t, err)
+	assert.Equal(t, "AP+Afw==,AP+Afw==,00ff807f", value.String())
+
+	// btoa and atob encode strings as UTF-8.
+	value, err = runtime.RunString(`[btoa("héllo"), atob(btoa("héllo ✓"))].join()`)
+	require.NoError(t, err)
+	assert.Equal(t, "aMOpbGxv,héllo ✓", value.String())
+
+	value, err = runtime.RunString(`fromHex("00ff807f")`)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x00, 0xFF, 0x80, 0x7F}, value.Export())
+
+	_, err = runtime.RunString(`atob("not base64!")`)
+	require.Error(t, err)
+	_, err = runtime.RunString(`fromHex("zz")`)
+	require.Error(t, err)
+}
+
+func TestEncoding_Bytes(t *testing.T) {
+	runtime := newEncodingTestRuntime(t)
+	require.NoError(t, runtime.Set("goBytes", []byte("SELECT 1")))
+
+	value, err := runtime.RunString(`
+		const fromGo = bytes(goBytes);
+		[
+			fromGo instanceof Uint8Array,
+			fromGo.length,
+			bytes("é").length,
+			bytes([1, 2, 3]).join("-"),
+			bytes(new Uint8Array([4, 5]).buffer).join("-"),
+		].join()
+	`)
+	require.NoError(t, err)
+	assert.Equal(t, "true,8,2,1-2-3,4-5", value.String())
+
+	value, err = runtime.RunString(`Value(new Uint8Array([1, 2]).buffer)`)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2}, value.Export().(*v1.Value).GetBytesValue())
+
+	value, err = runtime.RunString(`Value(bytes("abc"))`)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("abc"), value.Export().(*v1.Value).GetBytesValue())
+}
+
+func TestRunFunction_Uint8ArrayFields(t *testing.T) {
+	p := newTestPlugin(t)
+	require.NoError(t, RegisterEncodingHelpers(p.VM))
+	require.NoError(t, p.VM.Set("Value", p.VM.ToValue(NewValue)))
+	_, err := p.VM.RunString(`function onTrafficFromClient(ctx, req) {
+		const request = req.Fields["request"].GetBytesValue();
+		const client = req.Fields["client"].GetStructValue();
+		req.Fields["kind"] = Value(String.fromCharCode(request[0]));
+		req.Fields["isArray"] = Value(request instanceof Uint8Array && req.Fields["kind"].GetBytesValue() === null);
+		req.Fields["remote"] = Value(client.Fields["remote"].GetStringValue());
+		req.Fields["copy"] = req.Fields["request"];
+		req.Fields["response"] = Value(request.subarray(0, 1));
+		delete req.Fields["client"];
+		return req;
+	}`)
+	require.NoError(t, err)
+	p.RegisterFunction("onTrafficFromClient")
+
+	result, err := p.RunFunction(context.Background(), "onTrafficFromClient",
+		newTrafficRequest(t, newQueryMessage("SELECT 1")))
+	require.NoError(t, err)
+	fields := result.GetFields()
+	assert.Equal(t, "Q", fields["kind"].GetStringValue())
+	assert.True(t, fields["isArray"].GetBoolValue())
+	assert.Equal(t, "127.0.0.1:5000", fields["remote"].GetStringValue())
+	assert.Equal(t, newQueryMessage("SELECT 1"), fields["copy"].GetBytesValue())
+	assert.Equal(t, []byte("Q"), fields["response"].GetBytesValue())
+	assert.NotContains(t, fields, "client")
+}
+
+func TestRunFunction_Uint8ArrayListItems(t *testing.T) {
+	p := newTestPlugin(t)
+	require.NoError(t, RegisterEncodingHelpers(p.VM))
+	require.NoError(t, p.VM.Set("Value", p.VM.ToValue(NewValue)))
+	_, err := p.VM.RunString(`function onTrafficFromClient(ctx, req) {
+		const list = req.Fields["messages"].GetListValue();
+		const first = list.Values[0].GetBytesValue();
+		const second = list.GetValues()[1].GetStructValue().Fields["data"].GetBytesValue();
+		req.Fields["isArray"] = Value(first instanceof Uint8Array && second instanceof Uint8Array);
+		req.Fields["first"] = Value(String.fromCharCode(first[0]));
+		req.Fields["second"] = Value(String.fromCharCode(second[0]));
+		req.Fields["length"] = Value(list.Values.length);
+		list.Values[2] = Value(first.subarray(1));
+		return req;
+	}`)
+	require.NoError(t, err)
+	p.RegisterFunction("onTrafficFromClient")
+
+	req, err := v1.NewStruct(map[string]interface{}{
+		"messages": []interface{}{[]byte("Q1"), map[string]interface{}{"data": []byte("P")}},
+	})
+	require.NoError(t, err)
+	result, err := p.RunFunction(context.Background(), "onTrafficFromClient", req)
+	require.NoError(t, err)
+	fields := result.GetFields()
+	assert.True(t, fields["isArray"].GetBoolValue())
+	assert.Equal(t, "Q", fields["first"].GetStringValue())
+	assert.Equal(t, "P", fields["second"].GetStringValue())
+	assert.InDelta(t, 2, fields["length"].GetNumberValue(), 0)
+	values := fields["messages"].GetListValue().GetValues()
+	require.Len(t, values, 3)
+	assert.Equal(t, []byte("1"), values[2].GetBytesValue())
+}
+
+func TestEncoding_TextEncoderDecoder(t *testing.T) {
+	runtime := newEncodingTestRuntime(t)
+
+	value, err := runtime.RunString(`
+		const encoded = new TextEncoder().encode("héllo ✓");
+		[
+			encoded.length,
+			new TextDecoder().decode(encoded),
+			new TextDecoder("latin1").decode(new Uint8Array([0xE9])),
+			new TextDecoder().decode(new Uint8Array([0x61, 0xFF])),
+		].join()
+	`)
+	require.NoError(t, err)
+	assert.Equal(t, "10,héllo ✓,é,a�", value.String())
+
+	_, err = runtime.RunString(`new TextDecoder("utf-8", { fatal: true }).decode(new Uint8Array([0xFF]))`)
+	require.Error(t, err)
+	_, err = runtime.RunString(`new TextDecoder("utf-16")`)
+	require.Error(t, err)
+}
@@ -0,0 +1,326 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/spf13/cast"
+)
+
+var (
+	ErrHostNotAllowed       = errors.New("host is not in the fetch allow-list")
+	ErrResponseTooLarge     = errors.New("response is larger than the fetch size limit")
+	ErrUnsupportedURLScheme = errors.New("unsupported URL scheme")
+	ErrTooManyRedirects     = errors.New("stopped after 10 redirects")
+)
+
+type FetchConfig struct {
+	AllowedHosts        []string
+	Timeout             time.Duration
+	MaxResponseSize     int64
+	MaxIdleConnsPerHost int
+}
+
+// NewFetchConfig returns a new FetchConfig from the plugin config.
+func NewFetchConfig(config map[string]interface{}) *FetchConfig {
+	fetchConfig := FetchConfig{
+		Timeout:             cast.ToDuration(config["fetchTimeout"]),
+		MaxResponseSize:     cast.ToInt64(config["fetchMaxResponseSize"]),
+		MaxIdleConnsPerHost: cast.ToInt(config["fetchMaxIdleConnsPerHost"]),
+	}
+	for _, host := range strings.Split(cast.ToString(config["fetchAllowedHosts"]), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			fetchConfig.AllowedHosts = append(fetchConfig.AllowedHosts, host)
+		}
+	}
+	if fetchConfig.Timeout <= 0 {
+		fetchConfig.Timeout = 5 * time.Second
+	}
+	return &fetchConfig
+}
+
+// Fetcher sends the HTTP requests of the fetch function, reusing connections
+// between requests. Only hosts in the allow-list can be reached.
+type Fetcher struct {
+	config *FetchConfig
+	client *http.Client
+}
+
+// NewFetcher returns a new Fetcher with a pooled HTTP client.
+func NewFetcher(config *FetchConfig) *Fetcher {
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert
+	if config.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	}
+
+	fetcher := &Fetcher{config: config}
+	fetcher.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return ErrTooManyRedirects
+			}
+			_, err := fetcher.checkURL(req.URL)
+			return err
+		},
+	}
+	return fetcher
+}
+
+// DeniedHostLabel is the host label of the metrics of the requests to URLs
+// that are invalid or not allowed, whose hosts are chosen by scripts.
+const DeniedHostLabel = "<denied>"
+
+// allowedEntry returns the entry of the allow-list the host matches, if any.
+// An entry is a host name, a host:port pair or a *.domain wildcard.
+func (f *Fetcher) allowedEntry(target *url.URL) (string, bool) {
+	hostname := strings.ToLower(target.Hostname())
+	port := target.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[target.Scheme]
+	}
+	hostport := net.JoinHostPort(hostname, port)
+
+	for _, allowed := range f.config.AllowedHosts {
+		if allowed == hostname || allowed == hostport {
+			return allowed, true
+		}
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok && strings.HasSuffix(hostname, "."+suffix) {
+			return allowed, true
+		}
+	}
+	return "", false
+}
+
+func (f *Fetcher) checkURL(target *url.URL) (string, error) {
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedURLScheme, target.Scheme)
+	}
+	allowed, ok := f.allowedEntry(target)
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrHostNotAllowed, target.Host)
+	}
+	return allowed, nil
+}
+
+// fetchRequest holds the request options given to fetch.
+type fetchRequest struct {
+	Method  string
+	URL     string
+	Headers map[string]string
+	Body    []byte
+	Timeout time.Duration
+}
+
+// fetchResponse is the fully read response returned to JS.
+type fetchResponse struct {
+	URL        string
+	Status     int
+	StatusText string
+	Headers    http.Header
+	Body       []byte
+}
+
+// Do sends the request. The request timeout is bounded by the deadline of
+// the context, which is the context of the running hook. The metrics are
+// labeled with the entry of the allow-list the host matches, so that their
+// cardinality is bounded by the allow-list.
+func (f *Fetcher) Do(ctx context.Context, request *fetchRequest) (*fetchResponse, error) {
+	target, err := url.Parse(request.URL)
+	if err != nil {
+		FetchFailures.WithLabelValues(DeniedHostLabel, "denied").Inc()
+		return nil, err
+	}
+	host, err := f.checkURL(target)
+	if err != nil {
+		FetchFailures.WithLabelValues(DeniedHostLabel, "denied").Inc()
+		return nil, err
+	}
+
+	timeout := f.config.Timeout
+	if request.Timeout > 0 && request.Timeout < timeout {
+		timeout = request.Timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, request.Method, target.String(), bytes.NewReader(request.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range request.Headers {
+		req.Header.Set(name, value)
+	}
+
+	start := time.Now()
+	resp, err := f.client.Do(req)
+	if err != nil {
+		FetchFailures.WithLabelValues(host, "request").Inc()
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var reader io.Reader = resp.Body
+	if f.config.MaxResponseSize > 0 {
+		reader = io.LimitReader(resp.Body, f.config.MaxResponseSize+1)
+	}
+	body, err := io.ReadAll(reader)
+	FetchDuration.WithLabelValues(host).Observe(time.Since(start).Seconds())
+	if err != nil {
+		FetchFailures.WithLabelValues(host, "response").Inc()
+		return nil, err
+	}
+	if f.config.MaxResponseSize > 0 && int64(len(body)) > f.config.MaxResponseSize {
+		FetchFailures.WithLabelValues(host, "size").Inc()
+		return nil, fmt.Errorf("%w: %d bytes", ErrResponseTooLarge, f.config.MaxResponseSize)
+	}
+
+	return &fetchResponse{
+		URL:        resp.Request.URL.String(),
+		Status:     resp.StatusCode,
+		StatusText: http.StatusText(resp.StatusCode),
+		Headers:    resp.Header,
+		Body:       body,
+	}, nil
+}
+
+// newFetchRequest reads the arguments of fetch(url, { method, headers, body, timeout }),
+// where the timeout is in milliseconds.
+func newFetchRequest(runtime *goja.Runtime, call goja.FunctionCall) *fetchRequest {
+	request := &fetchRequest{
+		Method:  http.MethodGet,
+		URL:     call.Argument(0).String(),
+		Headers: map[string]string{},
+	}
+
+	options := call.Argument(1)
+	if goja.IsUndefined(options) || goja.IsNull(options) {
+		return request
+	}
+	object := options.ToObject(runtime)
+
+	if method := object.Get("method"); method != nil && !goja.IsUndefined(method) {
+		request.Method = strings.ToUpper(method.String())
+	}
+	if headers := object.Get("headers"); headers != nil && !goja.IsUndefined(headers) {
+		headersObject := headers.ToObject(runtime)
+		for _, name := range headersObject.Keys() {
+			request.Headers[name] = headersObject.Get(name).String()
+		}
+	}
+	if body := object.Get("body"); body != nil && !goja.IsUndefined(body) && !goja.IsNull(body) {
+		request.Body = mustBytes(runtime, body, "fetch")
+	}
+	if timeout := object.Get("timeout"); timeout != nil && !goja.IsUndefined(timeout) {
+		request.Timeout = time.Duration(timeout.ToInteger()) * time.Millisecond
+	}
+	return request
+}
+
+// newFetchResponse wraps the response in an object similar to the Response of the Fetch API.
+func newFetchResponse(runtime *goja.Runtime, response *fetchResponse) *goja.Object {
+	object := runtime.NewObject()
+	resolved := func(value interface{}) goja.Value {
+		promise, resolve, _ := runtime.NewPromise()
+		_ = resolve(value)
+		return runtime.ToValue(promise)
+	}
+
+	headers := runtime.NewObject()
+	setProperty(headers, "get", func(name string) goja.Value {
+		if values := response.Headers.Values(name); len(values) > 0 {
+			return runtime.ToValue(strings.Join(values, ", "))
+		}
+		return goja.Null()
+	})
+	setProperty(headers, "has", func(name string) bool {
+		return len(response.Headers.Values(name)) > 0
+	})
+
+	setProperty(object, "url", response.URL)
+	setProperty(object, "status", response.Status)
+	setProperty(object, "statusText", response.StatusText)
+	setProperty(object, "ok", response.Status >= 200 && response.Status < 300)
+	setProperty(object, "headers", headers)
+	setProperty(object, "text", func() goja.Value {
+		return resolved(string(response.Body))
+	})
+	setProperty(object, "json", func() goja.Value {
+		var decoded interface{}
+		if err := json.Unmarshal(response.Body, &decoded); err != nil {
+			promise, _, reject := runtime.NewPromise()
+			_ = reject(runtime.NewTypeError("fetch: invalid JSON response: %s", err))
+			return runtime.ToValue(promise)
+		}
+		return resolved(decoded)
+	})
+	setProperty(object, "arrayBuffer", func() goja.Value {
+		return resolved(runtime.NewArrayBuffer(append([]byte{}, response.Body...)))
+	})
+	setProperty(object, "bytes", func() goja.Value {
+		return resolved(newUint8Array(runtime, response.Body))
+	})
+	return object
+}
+
+// RegisterFetchAPI exposes a fetch function compatible with the Fetch API to
+// JS, meant to be awaited in async hook functions:
+//
+//	async function onTrafficFromClient(ctx, req) {
+//		const res = await fetch("http://policy.internal/decide", { method: "POST", body: "...", timeout: 500 })
+//		const decision = await res.json()
+//		return req
+//	}
+//
+// The request is sent without holding the VM lock, so the hooks of other
+// connections run while the function waits for the response. Outside hook
+// functions and scheduled jobs, e.g. in the top-level code of the script,
+// there is no event loop to wait in, so the returned promise is rejected
+// instead of blocking the VM.
+//
+// Fetching is disabled unless the plugin has a Fetcher.
+func (p *Plugin) RegisterFetchAPI() error {
+	runtime := p.VM
+	return runtime.Set("fetch", func(call goja.FunctionCall) goja.Value {
+		promise, resolve, reject := runtime.NewPromise()
+
+		if p.Fetcher == nil {
+			_ = reject(runtime.NewTypeError("fetch is disabled, because no hosts are allowed"))
+			return runtime.ToValue(promise)
+		}
+
+		if p.hookLoop == nil {
+			_ = reject(runtime.NewTypeError("fetch can only be called in hook functions and scheduled jobs"))
+			return runtime.ToValue(promise)
+		}
+
+		ctx := p.hookCtx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		request := newFetchRequest(runtime, call)
+		settle := func(response *fetchResponse, err error) {
+			if err != nil {
+				_ = reject(runtime.NewTypeError("fetch: %s", err))
+			} else {
+				_ = resolve(newFetchResponse(runtime, response))
+			}
+		}
+
+		p.hookLoop.run(func() func() {
+			response, err := p.Fetcher.Do(ctx, request)
+			return func() { settle(response, err) }
+		})
+		return runtime.ToValue(promise)
+	})
+}
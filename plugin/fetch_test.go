@@ -0,0 +1,217 @@
+package plugin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFetchTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/decide", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"allow": ` + string(body) + `, "token": "` + r.Header.Get("Authorization") + `"}`))
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("x", 100)))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://example.com/", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newFetchTestPlugin(t *testing.T, server *httptest.Server) *Plugin {
+	t.Helper()
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	p := newTestPlugin(t)
+	p.Fetcher = NewFetcher(NewFetchConfig(map[string]interface{}{
+		"fetchAllowedHosts":    serverURL.Host,
+		"fetchTimeout":         "5s",
+		"fetchMaxResponseSize": "50",
+	}))
+	require.NoError(t, p.RegisterFetchAPI())
+	require.NoError(t, p.VM.Set("Value", p.VM.ToValue(v1.NewValue)))
+	require.NoError(t, p.VM.Set("server", server.URL))
+	return p
+}
+
+func runFetchHook(t *testing.T, p *Plugin, ctx context.Context, body string) (map[string]interface{}, error) {
+	t.Helper()
+	_, err := p.VM.RunString(`async function onTrafficFromClient(ctx, req) {` + body + `}`)
+	require.NoError(t, err)
+	p.RegisterFunction("onTrafficFromClient")
+
+	result, err := p.RunFunction(ctx, "onTrafficFromClient", newTestRequest(t))
+	return result.AsMap(), err
+}
+
+func TestFetch(t *testing.T) {
+	p := newFetchTestPlugin(t, newFetchTestServer(t))
+
+	result, err := runFetchHook(t, p, context.Background(), `
+		const res = await fetch(server + "/decide", {
+			method: "POST",
+			headers: { Authorization: "Bearer abc" },
+			body: "true",
+		});
+		const decision = await res.json();
+		req.Fields["status"] = Value(res.status);
+		req.Fields["ok"] = Value(res.ok);
+		req.Fields["contentType"] = Value(res.headers.get("content-type"));
+		req.Fields["allow"] = Value(decision.allow);
+		req.Fields["token"] = Value(decision.token);
+		return req;
+	`)
+	require.NoError(t, err)
+	assert.InDelta(t, 200, result["status"], 0)
+	assert.Equal(t, true, result["ok"])
+	assert.Equal(t, "application/json", result["contentType"])
+	assert.Equal(t, true, result["allow"])
+	assert.Equal(t, "Bearer abc", result["token"])
+}
+
+func TestFetch_Denied(t *testing.T) {
+	p := newFetchTestPlugin(t, newFetchTestServer(t))
+	denied := testutil.ToFloat64(FetchFailures.WithLabelValues(DeniedHostLabel, "denied"))
+
+	for _, target := range []string{`"http://example.com/"`, `"file:///etc/passwd"`, `"http://%zz/"`} {
+		_, err := runFetchHook(t, p, context.Background(), `await fetch(`+target+`); return req;`)
+		require.ErrorIs(t, err, ErrPromiseRejected, target)
+	}
+	// Denied hosts are not used as labels, since scripts choose them.
+	assert.InDelta(t, denied+3, testutil.ToFloat64(FetchFailures.WithLabelValues(DeniedHostLabel, "denied")), 0)
+	assert.InDelta(t, 0, testutil.ToFloat64(FetchFailures.WithLabelValues("example.com", "denied")), 0)
+
+	_, err := runFetchHook(t, p, context.Background(), `await fetch(server + "/redirect"); return req;`)
+	require.ErrorIs(t, err, ErrPromiseRejected)
+}
+
+func TestFetch_OutsideHooks(t *testing.T) {
+	p := newFetchTestPlugin(t, newFetchTestServer(t))
+
+	// Top-level code has no event loop, so fetch does not block the VM.
+	_, err := p.VM.RunString(`
+		var failure;
+		fetch(server + "/decide").catch(function(err) { failure = err.message; });
+	`)
+	require.NoError(t, err)
+	assert.Equal(t, "fetch can only be called in hook functions and scheduled jobs", p.VM.Get("failure").String())
+}
+
+func TestFetch_Limits(t *testing.T) {
+	p := newFetchTestPlugin(t, newFetchTestServer(t))
+
+	_, err := runFetchHook(t, p, context.Background(), `await fetch(server + "/large"); return req;`)
+	require.ErrorIs(t, err, ErrPromiseRejected)
+	assert.Contains(t, err.Error(), ErrResponseTooLarge.Error())
+
+	start := time.Now()
+	_, err = runFetchHook(t, p, context.Background(), `await fetch(server + "/slow", { timeout: 50 }); return req;`)
+	require.ErrorIs(t, err, ErrPromiseRejected)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = runFetchHook(t, p, ctx, `await fetch(server + "/slow"); return req;`)
+	require.ErrorIs(t, err, ErrPromiseRejected)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestFetch_Disabled(t *testing.T) {
+	p := newTestPlugin(t)
+	require.NoError(t, p.RegisterFetchAPI())
+
+	_, err := runFetchHook(t, p, context.Background(), `await fetch("http://example.com/"); return req;`)
+	require.ErrorIs(t, err, ErrPromiseRejected)
+}
+
+func TestRunFunction_PendingPromise(t *testing.T) {
+	p := newTestPlugin(t)
+	_, err := runFetchHook(t, p, context.Background(), `await new Promise(() => {}); return req;`)
+	require.ErrorIs(t, err, ErrPromisePending)
+}
+
+func TestFetch_ConcurrentHooks(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		<-release
+		_, _ = w.Write([]byte("done"))
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+
+	p := newFetchTestPlugin(t, server)
+	_, err := p.VM.RunString(`
+	async function onTrafficFromClient(ctx, req) {
+		const res = await tracing.withSpan("fetch", () => fetch(server));
+		req.Fields["body"] = Value(await res.text());
+		return req;
+	}
+	function onTrafficToServer(ctx, req) {
+		req.Fields["seen"] = Value(true);
+		return req;
+	}`)
+	require.NoError(t, err)
+	require.NoError(t, p.RegisterTracingAPI())
+	p.RegisterFunctions([]string{"onTrafficFromClient", "onTrafficToServer"})
+
+	type hookResult struct {
+		result *v1.Struct
+		err    error
+	}
+	waiting, req := make(chan hookResult, 1), newTestRequest(t)
+	go func() {
+		result, err := p.RunFunction(context.Background(), "onTrafficFromClient", req)
+		waiting <- hookResult{result, err}
+	}()
+
+	// The hook of another connection runs while the first one waits for the
+	// response.
+	require.Eventually(t, func() bool {
+		result, err := p.RunFunction(context.Background(), "onTrafficToServer", newTestRequest(t))
+		return err == nil && result.AsMap()["seen"] == true
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case <-waiting:
+		t.Fatal("the fetch hook returned before the response")
+	default:
+	}
+
+	close(release)
+	select {
+	case hook := <-waiting:
+		require.NoError(t, hook.err)
+		assert.Equal(t, "done", hook.result.AsMap()["body"])
+		assert.Nil(t, hook.result.AsMap()["seen"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("the fetch hook did not return")
+	}
+}
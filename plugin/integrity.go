@@ -0,0 +1,135 @@
+package plugin
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+var (
+	ErrScriptChecksumMismatch = errors.New("script bundle checksum mismatch")
+	ErrScriptSignatureInvalid = errors.New("script bundle signature is invalid")
+	ErrInvalidPublicKey       = errors.New("invalid Ed25519 public key")
+)
+
+type IntegrityConfig struct {
+	// Checksum is the pinned SHA-256 digest of the checksum list in hex.
+	Checksum string
+	// PublicKey is an Ed25519 public key in base64, or the path of a PEM file.
+	PublicKey string
+	// SignaturePath is the path of the Ed25519 signature of the checksum
+	// list, in base64 or raw. It defaults to the script path plus .sig.
+	SignaturePath string
+}
+
+// NewIntegrityConfig returns a new IntegrityConfig from the plugin config.
+func NewIntegrityConfig(config map[string]interface{}) *IntegrityConfig {
+	integrityConfig := IntegrityConfig{
+		Checksum:      strings.ToLower(strings.TrimSpace(cast.ToString(config["scriptChecksum"]))),
+		PublicKey:     strings.TrimSpace(cast.ToString(config["scriptPublicKey"])),
+		SignaturePath: cast.ToString(config["scriptSignaturePath"]),
+	}
+	if integrityConfig.SignaturePath == "" {
+		integrityConfig.SignaturePath = cast.ToString(config["scriptPath"]) + ".sig"
+	}
+	return &integrityConfig
+}
+
+// Enabled tells whether the script bundle must be verified.
+func (c *IntegrityConfig) Enabled() bool {
+	return c.Checksum != "" || c.PublicKey != ""
+}
+
+// Checksums returns the checksum list of the bundle, which is what is
+// hashed and signed.
+func (b *ScriptBundle) Checksums() []byte {
+	return b.checksums
+}
+
+// Digest returns the SHA-256 digest of the checksum list in hex.
+func (b *ScriptBundle) Digest() string {
+	digest := sha256.Sum256(b.checksums)
+	return hex.EncodeToString(digest[:])
+}
+
+// Verify checks the pinned checksum and the signature of the bundle.
+func (b *ScriptBundle) Verify(config *IntegrityConfig) error {
+	if config.Checksum != "" &&
+		subtle.ConstantTimeCompare([]byte(config.Checksum), []byte(b.Digest())) != 1 {
+		return fmt.Errorf("%w: expected %s, got %s", ErrScriptChecksumMismatch, config.Checksum, b.Digest())
+	}
+
+	if config.PublicKey == "" {
+		return nil
+	}
+	publicKey, err := parsePublicKey(config.PublicKey)
+	if err != nil {
+		return err
+	}
+	signature, err := readSignature(config.SignaturePath)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, b.checksums, signature) {
+		return fmt.Errorf("%w: %s", ErrScriptSignatureInvalid, config.SignaturePath)
+	}
+	return nil
+}
+
+// parsePublicKey parses an Ed25519 public key in base64, or in a PEM file.
+func parsePublicKey(value string) (ed25519.PublicKey, error) {
+	if !strings.HasPrefix(value, "-----BEGIN") {
+		if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+			if len(decoded) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("%w: expected %d bytes, got %d", ErrInvalidPublicKey, ed25519.PublicKeySize, len(decoded))
+			}
+			return ed25519.PublicKey(decoded), nil
+		}
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPublicKey, err)
+		}
+		value = string(data)
+	}
+
+	block, _ := pem.Decode([]byte(value))
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block found", ErrInvalidPublicKey)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPublicKey, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T is not an Ed25519 key", ErrInvalidPublicKey, key)
+	}
+	return publicKey, nil
+}
+
+// readSignature reads a signature in base64, or raw as written by
+// openssl pkeyutl -sign.
+func readSignature(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrScriptSignatureInvalid, err)
+	}
+	if len(data) == ed25519.SignatureSize {
+		return data, nil
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: %s is neither a raw nor a base64 Ed25519 signature", ErrScriptSignatureInvalid, path)
+	}
+	return signature, nil
+}
@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScriptBundle_VerifyChecksum(t *testing.T) {
+	scriptPath := writeBundle(t)
+	bundle, err := LoadScriptBundle(scriptPath)
+	require.NoError(t, err)
+
+	config := NewIntegrityConfig(map[string]interface{}{
+		"scriptPath":     scriptPath,
+		"scriptChecksum": bundle.Digest(),
+	})
+	assert.True(t, config.Enabled())
+	require.NoError(t, bundle.Verify(config))
+
+	// Changing a required module changes the digest.
+	require.NoError(t, os.WriteFile(
+		filepath.Join(filepath.Dir(scriptPath), "lib", "data.json"), []byte(`{"answer": 0}`), 0o600))
+	tampered, err := LoadScriptBundle(scriptPath)
+	require.NoError(t, err)
+	assert.ErrorIs(t, tampered.Verify(config), ErrScriptChecksumMismatch)
+
+	assert.False(t, NewIntegrityConfig(map[string]interface{}{"scriptPath": scriptPath}).Enabled())
+}
+
+func TestScriptBundle_VerifySignature(t *testing.T) {
+	scriptPath := writeBundle(t)
+	bundle, err := LoadScriptBundle(scriptPath)
+	require.NoError(t, err)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signature := ed25519.Sign(privateKey, bundle.Checksums())
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	require.NoError(t, err)
+	pemPath := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(
+		pemPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+
+	// The signature is read from the default path in base64, or raw.
+	require.NoError(t, os.WriteFile(
+		scriptPath+".sig", []byte(base64.StdEncoding.EncodeToString(signature)+"\n"), 0o600))
+	for _, key := range []string{base64.StdEncoding.EncodeToString(publicKey), pemPath} {
+		config := NewIntegrityConfig(map[string]interface{}{
+			"scriptPath":      scriptPath,
+			"scriptPublicKey": key,
+		})
+		assert.Equal(t, scriptPath+".sig", config.SignaturePath)
+		require.NoError(t, bundle.Verify(config))
+	}
+
+	rawPath := filepath.Join(t.TempDir(), "raw.sig")
+	require.NoError(t, os.WriteFile(rawPath, signature, 0o600))
+	config := NewIntegrityConfig(map[string]interface{}{
+		"scriptPath":          scriptPath,
+		"scriptPublicKey":     pemPath,
+		"scriptSignaturePath": rawPath,
+	})
+	require.NoError(t, bundle.Verify(config))
+
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	config.PublicKey = base64.StdEncoding.EncodeToString(otherKey)
+	assert.ErrorIs(t, bundle.Verify(config), ErrScriptSignatureInvalid)
+
+	config.PublicKey = base64.StdEncoding.EncodeToString([]byte("short"))
+	assert.ErrorIs(t, bundle.Verify(config), ErrInvalidPublicKey)
+
+	config.PublicKey = base64.StdEncoding.EncodeToString(publicKey)
+	config.SignaturePath = filepath.Join(t.TempDir(), "missing.sig")
+	assert.ErrorIs(t, bundle.Verify(config), ErrScriptSignatureInvalid)
+}
@@ -0,0 +1,135 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/dop251/goja"
+)
+
+// WildcardHook registers a listener for all hooks.
+const WildcardHook = "*"
+
+var ErrUnknownHook = errors.New("unknown hook")
+
+// Listener is a JS function registered via gatewayd.on. Listeners of a hook
+// are run in ascending order of priority, and in registration order for
+// listeners with the same priority. Global functions named after a hook are
+// run as listeners with priority 0, before any listener registered with the
+// same priority.
+type Listener struct {
+	Callable goja.Callable
+	Priority int
+	seq      int
+}
+
+// On registers a listener for the given hook, or for all hooks if the hook
+// is the wildcard. It must be called while holding the VM lock, or before
+// the plugin is served.
+func (p *Plugin) On(hook string, callable goja.Callable, priority int) error {
+	if _, ok := Hooks[hook]; !ok && hook != WildcardHook {
+		return fmt.Errorf("%w: %q", ErrUnknownHook, hook)
+	}
+
+	if p.Listeners == nil {
+		p.Listeners = map[string][]*Listener{}
+	}
+	p.listenerSeq++
+	p.Listeners[hook] = append(p.Listeners[hook], &Listener{
+		Callable: callable,
+		Priority: priority,
+		seq:      p.listenerSeq,
+	})
+	p.Logger.Trace("Registering listener", "hook", hook, "priority", priority)
+
+	return nil
+}
+
+// getListeners returns the functions to run for the given hook, sorted by
+// priority. The VM lock must be held by the caller.
+func (p *Plugin) getListeners(name string) []goja.Callable {
+	listeners := []*Listener{}
+	if p.Bindings[name] != nil {
+		listeners = append(listeners, &Listener{Callable: p.Bindings[name]})
+	}
+	listeners = append(listeners, p.Listeners[name]...)
+	listeners = append(listeners, p.Listeners[WildcardHook]...)
+
+	sort.SliceStable(listeners, func(i, j int) bool {
+		if listeners[i].Priority != listeners[j].Priority {
+			return listeners[i].Priority < listeners[j].Priority
+		}
+		return listeners[i].seq < listeners[j].seq
+	})
+
+	callables := make([]goja.Callable, 0, len(listeners))
+	for _, listener := range listeners {
+		callables = append(callables, listener.Callable)
+	}
+	return callables
+}
+
+// hasListeners tells whether any function is registered for the given hook.
+// The onTick hook is also needed if it drives the scheduler.
+// The VM lock must be held by the caller.
+func (p *Plugin) hasListeners(name string) bool {
+	if name == "onTick" && p.Scheduler != nil && p.Scheduler.config.UseOnTick && p.Scheduler.HasJobs() {
+		return true
+	}
+	return p.Bindings[name] != nil ||
+		len(p.Listeners[name]) > 0 ||
+		len(p.Listeners[WildcardHook]) > 0
+}
+
+// RegisterListenerAPI exposes the gatewayd.on function to JS, which
+// registers a function for one or more hooks:
+//
+//	gatewayd.on("onTrafficFromClient", fn)
+//	gatewayd.on(["onTrafficFromClient", "onTrafficToServer"], fn, { priority: 10 })
+//	gatewayd.on("*", fn)
+func (p *Plugin) RegisterListenerAPI() error {
+	runtime := p.VM
+	gatewayd := runtime.NewObject()
+
+	if err := gatewayd.Set("on", func(call goja.FunctionCall) goja.Value {
+		callable, ok := goja.AssertFunction(call.Argument(1))
+		if !ok {
+			panic(runtime.NewTypeError("gatewayd.on requires a function as the second argument"))
+		}
+
+		var hooks []string
+		if hook, ok := call.Argument(0).Export().(string); ok {
+			hooks = []string{hook}
+		} else if err := runtime.ExportTo(call.Argument(0), &hooks); err != nil || len(hooks) == 0 {
+			panic(runtime.NewTypeError("gatewayd.on requires a hook name or a list of hook names"))
+		}
+
+		priority := 0
+		if options := call.Argument(2); !goja.IsUndefined(options) && !goja.IsNull(options) {
+			if value := options.ToObject(runtime).Get("priority"); value != nil && !goja.IsUndefined(value) {
+				priority = int(value.ToInteger())
+			}
+		}
+
+		for _, hook := range hooks {
+			if err := p.On(hook, callable, priority); err != nil {
+				panic(runtime.NewTypeError("gatewayd.on: " + err.Error()))
+			}
+		}
+		return goja.Undefined()
+	}); err != nil {
+		return err
+	}
+
+	hooks := make([]string, 0, len(Hooks))
+	for name := range Hooks {
+		hooks = append(hooks, name)
+	}
+	sort.Strings(hooks)
+	if err := gatewayd.Set("hooks", hooks); err != nil {
+		return err
+	}
+
+	return runtime.Set("gatewayd", gatewayd)
+}
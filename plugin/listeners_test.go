@@ -0,0 +1,80 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newListenerTestPlugin(t *testing.T, script string) *Plugin {
+	t.Helper()
+	p := newTestPlugin(t)
+	require.NoError(t, p.RegisterListenerAPI())
+	require.NoError(t, p.VM.Set("Value", p.VM.ToValue(v1.NewValue)))
+	_, err := p.VM.RunString(script)
+	require.NoError(t, err)
+	p.RegisterFunctions([]string{"onTrafficFromClient", "onTrafficToServer", "onBooted"})
+	return p
+}
+
+func TestOn_MultipleHooks(t *testing.T) {
+	p := newListenerTestPlugin(t, `
+		gatewayd.on(["onTrafficFromClient", "onTrafficToServer"], function(ctx, req) {
+			req.Fields["calledBy"] = Value(ctx.hook);
+			return req;
+		});
+	`)
+
+	for _, name := range []string{"onTrafficFromClient", "onTrafficToServer"} {
+		result, err := p.RunFunction(context.Background(), name, newTestRequest(t))
+		require.NoError(t, err)
+		assert.Equal(t, name, result.AsMap()["calledBy"])
+	}
+
+	hooks := p.GetHooks()
+	assert.ElementsMatch(t, []interface{}{
+		int32(v1.HookName_HOOK_NAME_ON_TRAFFIC_FROM_CLIENT),
+		int32(v1.HookName_HOOK_NAME_ON_TRAFFIC_TO_SERVER),
+	}, hooks)
+}
+
+func TestOn_Priority(t *testing.T) {
+	p := newListenerTestPlugin(t, `
+		function append(name) {
+			return function(ctx, req) {
+				const order = req.Fields["order"] ? req.Fields["order"].GetStringValue() : "";
+				req.Fields["order"] = Value(order + name);
+				return req;
+			};
+		}
+		function onBooted(ctx, req) { return append("g")(ctx, req); }
+		gatewayd.on("onBooted", append("c"), { priority: 10 });
+		gatewayd.on("onBooted", append("a"), { priority: -1 });
+		gatewayd.on("onBooted", append("b"));
+		gatewayd.on("*", append("w"), { priority: 5 });
+	`)
+
+	result, err := p.RunFunction(context.Background(), "onBooted", newTestRequest(t))
+	require.NoError(t, err)
+	assert.Equal(t, "agbwc", result.AsMap()["order"])
+}
+
+func TestOn_Wildcard(t *testing.T) {
+	p := newListenerTestPlugin(t, `gatewayd.on("*", function(ctx, req) { return req; });`)
+	assert.Len(t, p.GetHooks(), len(Hooks))
+}
+
+func TestOn_Invalid(t *testing.T) {
+	p := newListenerTestPlugin(t, ``)
+
+	_, err := p.VM.RunString(`gatewayd.on("onUnknown", function(ctx, req) { return req; })`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), ErrUnknownHook.Error())
+
+	_, err = p.VM.RunString(`gatewayd.on("onBooted", 42)`)
+	require.Error(t, err)
+	assert.Empty(t, p.GetHooks())
+}
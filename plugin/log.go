@@ -0,0 +1,206 @@
+package plugin
+
+import (
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/hashicorp/go-hclog"
+	"github.com/spf13/cast"
+)
+
+type LogConfig struct {
+	// Name is the name of the logger of the script. It defaults to the file
+	// name of the script without the extension.
+	Name  string
+	Level hclog.Level
+	// RateLimit is the number of messages per second a script can log, with
+	// bursts of up to Burst messages. Rate limiting is disabled if it is zero.
+	RateLimit float64
+	Burst     int
+}
+
+// NewLogConfig returns a new LogConfig from the plugin config. Without a log
+// level, scripts log at the level of the plugin.
+func NewLogConfig(config map[string]interface{}, level hclog.Level) *LogConfig {
+	logConfig := LogConfig{
+		Name:      cast.ToString(config["scriptLogName"]),
+		Level:     level,
+		RateLimit: cast.ToFloat64(config["scriptLogRateLimit"]),
+		Burst:     cast.ToInt(config["scriptLogBurst"]),
+	}
+	if logConfig.Name == "" {
+		scriptPath := cast.ToString(config["scriptPath"])
+		logConfig.Name = strings.TrimSuffix(filepath.Base(scriptPath), filepath.Ext(scriptPath))
+	}
+	if scriptLevel := hclog.LevelFromString(cast.ToString(config["scriptLogLevel"])); scriptLevel != hclog.NoLevel {
+		logConfig.Level = scriptLevel
+	}
+	if logConfig.Burst <= 0 {
+		// A rate below one message per second still allows one message.
+		logConfig.Burst = max(1, int(math.Ceil(logConfig.RateLimit)))
+	}
+	return &logConfig
+}
+
+// logLimiter is a token bucket that limits the rate of log messages.
+type logLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	dropped int
+}
+
+// allow tells whether a message can be logged and returns the number of
+// messages dropped since the last allowed message.
+func (l *logLimiter) allow(now time.Time) (bool, int) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		l.dropped++
+		return false, 0
+	}
+	l.tokens--
+	dropped := l.dropped
+	l.dropped = 0
+	return true, dropped
+}
+
+// ScriptLogger is the logger of the log module. It has its own name and
+// level, which is independent of the --log-level flag, and its messages are
+// rate limited.
+type ScriptLogger struct {
+	logger  hclog.Logger
+	limiter *logLimiter
+	secrets *Secrets
+}
+
+// NewScriptLogger returns a new ScriptLogger derived from the plugin logger.
+// The plugin logger must have independent levels, so that the level of the
+// script does not change the level of the plugin.
+func NewScriptLogger(config *LogConfig, logger hclog.Logger, secrets *Secrets) *ScriptLogger {
+	scriptLogger := &ScriptLogger{
+		logger:  logger.Named(config.Name),
+		secrets: secrets,
+	}
+	scriptLogger.logger.SetLevel(config.Level)
+	if config.RateLimit > 0 {
+		scriptLogger.limiter = &logLimiter{
+			rate:   config.RateLimit,
+			burst:  float64(config.Burst),
+			tokens: float64(config.Burst),
+			last:   time.Now(),
+		}
+	}
+	return scriptLogger
+}
+
+// Log logs the message with the fields, unless the script exceeds its rate limit.
+func (s *ScriptLogger) Log(logger hclog.Logger, level hclog.Level, message string, fields []interface{}) {
+	if logger.GetLevel() > level {
+		return
+	}
+
+	allowed, dropped := s.limiter.allow(time.Now())
+	if !allowed {
+		ScriptLogMessagesDropped.Inc()
+		return
+	}
+	if dropped > 0 {
+		logger.Warn("Dropped log messages, because the script exceeded its rate limit", "dropped", dropped)
+	}
+	logger.Log(level, s.secrets.Redact(message), fields...)
+}
+
+// toFields converts the properties of a JS object to hclog key-value pairs,
+// sorted by key. Secrets are redacted from string values.
+func (s *ScriptLogger) toFields(runtime *goja.Runtime, value goja.Value) []interface{} {
+	if value == nil || goja.IsUndefined(value) || goja.IsNull(value) {
+		return nil
+	}
+	object := value.ToObject(runtime)
+	keys := object.Keys()
+	sort.Strings(keys)
+
+	fields := make([]interface{}, 0, 2*len(keys))
+	for _, key := range keys {
+		field := object.Get(key).Export()
+		if text, ok := field.(string); ok {
+			field = s.secrets.Redact(text)
+		}
+		fields = append(fields, key, field)
+	}
+	return fields
+}
+
+// newLoggerObject returns the JS object of a logger with the bound fields.
+func (s *ScriptLogger) newLoggerObject(runtime *goja.Runtime, logger hclog.Logger, bound []interface{}) *goja.Object {
+	object := runtime.NewObject()
+
+	levels := map[string]hclog.Level{
+		"trace": hclog.Trace,
+		"debug": hclog.Debug,
+		"info":  hclog.Info,
+		"warn":  hclog.Warn,
+		"error": hclog.Error,
+	}
+	for name, level := range levels {
+		setProperty(object, name, func(call goja.FunctionCall) goja.Value {
+			fields := append(append([]interface{}{}, bound...), s.toFields(runtime, call.Argument(1))...)
+			s.Log(logger, level, call.Argument(0).String(), fields)
+			return goja.Undefined()
+		})
+	}
+
+	setProperty(object, "with", func(call goja.FunctionCall) goja.Value {
+		fields := append(append([]interface{}{}, bound...), s.toFields(runtime, call.Argument(0))...)
+		return s.newLoggerObject(runtime, logger, fields)
+	})
+	setProperty(object, "named", func(name string) *goja.Object {
+		return s.newLoggerObject(runtime, logger.Named(name), bound)
+	})
+	setProperty(object, "isEnabled", func(name string) bool {
+		level, ok := levels[strings.ToLower(name)]
+		return ok && logger.GetLevel() <= level
+	})
+	setProperty(object, "getLevel", func() string {
+		return logger.GetLevel().String()
+	})
+	setProperty(object, "setLevel", func(name string) {
+		level, ok := levels[strings.ToLower(name)]
+		if !ok {
+			panic(runtime.NewTypeError("log.setLevel: unknown level %q", name))
+		}
+		logger.SetLevel(level)
+	})
+	return object
+}
+
+// Require is the loader of the native log module:
+//
+//	const log = require("log")
+//	log.info("cache refreshed", { entries: 120, durationMs: 4 })
+//	const queryLog = log.with({ component: "rewriter" })
+//	queryLog.debug("rewrote query", { table: "users" })
+//	log.named("jobs").warn("job is slow")
+//	log.setLevel("debug")
+//	log.isEnabled("trace")
+//
+// Fields are written as attributes of the JSON log lines.
+func (s *ScriptLogger) Require(runtime *goja.Runtime, module *goja.Object) {
+	if err := module.Set("exports", s.newLoggerObject(runtime, s.logger, nil)); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,136 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dop251/goja"
+	jsRequire "github.com/dop251/goja_nodejs/require"
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestScriptLogger(t *testing.T, config map[string]interface{}) (*goja.Runtime, *bytes.Buffer) {
+	t.Helper()
+	output := &bytes.Buffer{}
+	logger := hclog.New(&hclog.LoggerOptions{
+		Level:             hclog.Info,
+		Output:            output,
+		JSONFormat:        true,
+		IndependentLevels: true,
+	})
+
+	t.Setenv("TEST_LOG_TOKEN", "s3cr3t")
+	secrets, err := NewSecrets("token=env:TEST_LOG_TOKEN", "")
+	require.NoError(t, err)
+
+	scriptLogger := NewScriptLogger(NewLogConfig(config, hclog.Info), logger, secrets)
+	runtime := goja.New()
+	registry := jsRequire.Registry{}
+	registry.RegisterNativeModule("log", scriptLogger.Require)
+	registry.Enable(runtime)
+	return runtime, output
+}
+
+func logLines(t *testing.T, output *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	lines := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestNewLogConfig(t *testing.T) {
+	config := NewLogConfig(map[string]interface{}{
+		"scriptPath":         "./scripts/index.js",
+		"scriptLogLevel":     "debug",
+		"scriptLogRateLimit": "10",
+	}, hclog.Info)
+	assert.Equal(t, "index", config.Name)
+	assert.Equal(t, hclog.Debug, config.Level)
+	assert.Equal(t, 10, config.Burst)
+
+	config = NewLogConfig(map[string]interface{}{"scriptLogRateLimit": "0.5"}, hclog.Info)
+	assert.Equal(t, 1, config.Burst, "fractional rates allow a message")
+	config = NewLogConfig(map[string]interface{}{"scriptLogRateLimit": "2.5"}, hclog.Info)
+	assert.Equal(t, 3, config.Burst)
+
+	config = NewLogConfig(map[string]interface{}{"scriptLogName": "rewriter", "scriptLogLevel": "loud"}, hclog.Warn)
+	assert.Equal(t, "rewriter", config.Name)
+	assert.Equal(t, hclog.Warn, config.Level)
+}
+
+func TestScriptLogger_Require(t *testing.T) {
+	runtime, output := newTestScriptLogger(t, map[string]interface{}{
+		"scriptLogName":  "policy",
+		"scriptLogLevel": "debug",
+	})
+
+	_, err := runtime.RunString(`
+		const log = require("log");
+		log.trace("hidden");
+		log.debug("rewrote query", { table: "users", rows: 3, token: "s3cr3t" });
+		log.with({ component: "cache" }).named("jobs").warn("slow", { durationMs: 1500 });
+		log.setLevel("error");
+		log.info("hidden");
+		log.error("failed");
+	`)
+	require.NoError(t, err)
+
+	lines := logLines(t, output)
+	require.Len(t, lines, 3)
+
+	assert.Equal(t, "debug", lines[0]["@level"])
+	assert.Equal(t, "policy", lines[0]["@module"])
+	assert.Equal(t, "rewrote query", lines[0]["@message"])
+	assert.Equal(t, "users", lines[0]["table"])
+	assert.InDelta(t, 3, lines[0]["rows"], 0)
+	assert.Equal(t, Redacted, lines[0]["token"])
+
+	assert.Equal(t, "warn", lines[1]["@level"])
+	assert.Equal(t, "policy.jobs", lines[1]["@module"])
+	assert.Equal(t, "cache", lines[1]["component"])
+
+	assert.Equal(t, "error", lines[2]["@level"])
+
+	value, err := runtime.RunString(`[log.getLevel(), log.isEnabled("warn"), log.isEnabled("error")].join()`)
+	require.NoError(t, err)
+	assert.Equal(t, "error,false,true", value.String())
+
+	_, err = runtime.RunString(`log.setLevel("loud")`)
+	require.Error(t, err)
+}
+
+func TestScriptLogger_RateLimit(t *testing.T) {
+	runtime, output := newTestScriptLogger(t, map[string]interface{}{
+		"scriptLogRateLimit": "1",
+		"scriptLogBurst":     "2",
+	})
+	dropped := testutil.ToFloat64(ScriptLogMessagesDropped)
+
+	_, err := runtime.RunString(`
+		const log = require("log");
+		for (let i = 0; i < 10; i++) log.info("noisy", { i });
+	`)
+	require.NoError(t, err)
+	assert.Len(t, logLines(t, output), 2)
+	assert.InDelta(t, dropped+8, testutil.ToFloat64(ScriptLogMessagesDropped), 0)
+
+	limiter := &logLimiter{rate: 1, burst: 1, tokens: 0, last: time.Now(), dropped: 8}
+	allowed, _ := limiter.allow(limiter.last)
+	assert.False(t, allowed)
+	allowed, count := limiter.allow(limiter.last.Add(time.Second))
+	assert.True(t, allowed)
+	assert.Equal(t, 9, count)
+}
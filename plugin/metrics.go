@@ -121,3 +121,142 @@ var (
 		Help:      "The total number of calls to the onTrafficToClient method",
 	})
 )
+
+var (
+	AuditEntries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "audit_entries_total",
+		Help:      "The total number of entries written to the audit trail",
+	})
+	AuditEntriesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "audit_entries_dropped_total",
+		Help:      "The total number of audit entries dropped because the buffer was full",
+	})
+	AuditWriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "audit_write_errors_total",
+		Help:      "The total number of audit entries that could not be written",
+	})
+)
+
+var (
+	FetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Name:      "fetch_duration_seconds",
+		Help:      "The duration of the HTTP requests sent by scripts via fetch, by allowed host",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"host"})
+	FetchFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "fetch_failures_total",
+		Help:      "The total number of HTTP requests sent by scripts via fetch that failed, by allowed host or <denied>",
+	}, []string{"host", "reason"})
+)
+
+var (
+	SchedulerJobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "scheduler_job_runs_total",
+		Help:      "The total number of runs of scheduled jobs",
+	}, []string{"job"})
+	SchedulerJobFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "scheduler_job_failures_total",
+		Help:      "The total number of runs of scheduled jobs that failed or timed out",
+	}, []string{"job", "reason"})
+	SchedulerJobsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "scheduler_jobs_skipped_total",
+		Help:      "The total number of runs of scheduled jobs skipped because the previous run was not finished",
+	}, []string{"job"})
+	SchedulerJobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Name:      "scheduler_job_duration_seconds",
+		Help:      "The duration of the runs of scheduled jobs",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"job"})
+)
+
+var ScriptLogMessagesDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: metrics.Namespace,
+	Name:      "script_log_messages_dropped_total",
+	Help:      "The total number of log messages of the script dropped by the rate limit",
+})
+
+var (
+	RuntimeLimitExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "runtime_limit_exceeded_total",
+		Help:      "The total number of times the JS runtime exceeded a resource limit",
+	}, []string{"limit"})
+	RuntimeRecycles = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "runtime_recycles_total",
+		Help:      "The total number of times the JS runtime was replaced after exceeding a resource limit",
+	})
+	RuntimeRecycleFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "runtime_recycle_failures_total",
+		Help:      "The total number of times the JS runtime could not be replaced",
+	})
+)
+
+var ScriptBundleInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metrics.Namespace,
+	Name:      "script_bundle_info",
+	Help:      "The name and version of the loaded script bundle, which is always 1",
+}, []string{"name", "version"})
+
+var (
+	ScriptCompileDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Name:      "script_compile_duration_seconds",
+		Help:      "The duration of the compilation of the script and the modules it requires",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"kind"})
+	ProgramCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "program_cache_lookups_total",
+		Help:      "The total number of lookups of compiled programs in the cache",
+	}, []string{"kind", "result"})
+	RuntimeInstantiateDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Name:      "runtime_instantiate_duration_seconds",
+		Help:      "The duration of the setup of a new JS runtime, including the run of the script",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+var RewriteRuleHits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metrics.Namespace,
+	Name:      "rewrite_rule_hits_total",
+	Help:      "The total number of queries matched by each rewrite rule",
+}, []string{"rule", "phase"})
+
+var (
+	QueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Name:      "query_duration_seconds",
+		Help:      "The time from the query of the client to the ReadyForQuery of the server, per query fingerprint, or other",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"fingerprint"})
+	SlowQueries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "slow_queries_total",
+		Help:      "The total number of queries slower than the slow query threshold",
+	})
+)
+
+var (
+	PluginMode = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Name:      "mode",
+		Help:      "The mode of the plugin, which is 1 for the current mode and 0 for the others",
+	}, []string{"mode"})
+	ModeRejectedQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "mode_rejected_queries_total",
+		Help:      "The total number of requests rejected by the read-only or the maintenance mode",
+	}, []string{"mode"})
+)
@@ -0,0 +1,262 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/hashicorp/go-hclog"
+	"github.com/spf13/cast"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ModeNormal      = "normal"
+	ModeReadOnly    = "read-only"
+	ModeMaintenance = "maintenance"
+
+	// ReadOnlyCode is the SQLSTATE of the writes rejected in read-only mode,
+	// which is read_only_sql_transaction.
+	ReadOnlyCode = "25006"
+	// MaintenanceCode is the SQLSTATE of the queries rejected in maintenance
+	// mode, which is cannot_connect_now.
+	MaintenanceCode = "57P03"
+)
+
+var ErrInvalidMode = errors.New("invalid mode")
+
+// modes are the modes, with the default message of the rejected queries.
+var modes = map[string]string{
+	ModeNormal:      "",
+	ModeReadOnly:    "the database is in read-only mode",
+	ModeMaintenance: "the database is in maintenance mode",
+}
+
+type ModeConfig struct {
+	// Mode is the mode on start: normal, read-only or maintenance.
+	Mode string
+	// Message is the message of the rejected queries, which defaults to one
+	// per mode.
+	Message string
+	// FilePath is the path of a YAML file with the mode and the message,
+	// which overrides them and is read again on signals and ticks.
+	FilePath string
+}
+
+// NewModeConfig returns a new ModeConfig from the plugin config.
+func NewModeConfig(config map[string]interface{}) *ModeConfig {
+	return &ModeConfig{
+		Mode:     cast.ToString(config["mode"]),
+		Message:  cast.ToString(config["modeMessage"]),
+		FilePath: cast.ToString(config["modeFilePath"]),
+	}
+}
+
+// ModeSwitch is the mode of the plugin, which can be switched at runtime. In
+// read-only mode, writes are rejected. In maintenance mode, all the queries
+// are rejected, except those of the transactions that are already open.
+type ModeSwitch struct {
+	mu       sync.RWMutex
+	mode     string
+	message  string
+	filePath string
+	modTime  time.Time
+	logger   hclog.Logger
+}
+
+// NewModeSwitch returns a new ModeSwitch in the mode of the config, or of the
+// mode file if there is one.
+func NewModeSwitch(config *ModeConfig, logger hclog.Logger) (*ModeSwitch, error) {
+	m := &ModeSwitch{filePath: config.FilePath, logger: logger}
+	mode := config.Mode
+	if mode == "" {
+		mode = ModeNormal
+	}
+	if err := m.Set(mode, config.Message); err != nil {
+		return nil, err
+	}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Get returns the mode and the message of the rejected queries.
+func (m *ModeSwitch) Get() (string, string) {
+	if m == nil {
+		return ModeNormal, ""
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.mode, m.message
+}
+
+// Set switches to the mode. The message of the rejected queries defaults to
+// one per mode.
+func (m *ModeSwitch) Set(mode, message string) error {
+	if m == nil {
+		return nil
+	}
+	defaultMessage, ok := modes[mode]
+	if !ok {
+		return fmt.Errorf("%w: %q, expected normal, read-only or maintenance", ErrInvalidMode, mode)
+	}
+	if message == "" {
+		message = defaultMessage
+	}
+
+	m.mu.Lock()
+	previous := m.mode
+	m.mode, m.message = mode, message
+	m.mu.Unlock()
+
+	for name := range modes {
+		value := 0.0
+		if name == mode {
+			value = 1
+		}
+		PluginMode.WithLabelValues(name).Set(value)
+	}
+	if previous != "" && previous != mode {
+		m.logger.Info("Switched mode", "from", previous, "to", mode)
+	}
+	return nil
+}
+
+// Reload reads the mode file again, if it changed.
+func (m *ModeSwitch) Reload() error {
+	if m == nil || m.filePath == "" {
+		return nil
+	}
+	info, err := os.Stat(m.filePath)
+	if err != nil {
+		return err
+	}
+	m.mu.RLock()
+	unchanged := info.ModTime().Equal(m.modTime)
+	m.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(m.filePath)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Mode    string `yaml:"mode"`
+		Message string `yaml:"message"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrInvalidMode, m.filePath, err)
+	}
+	if file.Mode == "" {
+		file.Mode = ModeNormal
+	}
+	if err := m.Set(file.Mode, file.Message); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.modTime = info.ModTime()
+	m.mu.Unlock()
+	return nil
+}
+
+// reloadMode reads the mode file again, logging errors.
+func (p *Plugin) reloadMode() {
+	if err := p.Mode.Reload(); err != nil {
+		p.Logger.Error("Failed to reload the mode file", "error", err)
+	}
+}
+
+// checkMode answers the request with an error in maintenance mode, unless
+// it continues a transaction opened before the request, and tells whether it
+// did. It is run before the JS functions.
+func (p *Plugin) checkMode(req *v1.Struct, traffic *ClientTraffic) bool {
+	mode, message := p.Mode.Get()
+	if mode != ModeMaintenance || traffic == nil || len(traffic.Queries) == 0 {
+		return false
+	}
+	if traffic.Transaction.Status != TransactionStatusIdle {
+		return false
+	}
+	p.rejectQueries(req, mode, MaintenanceCode, message)
+	return true
+}
+
+// checkWrites answers the request with an error in read-only mode if one of
+// the queries sent to the server writes, and tells whether it did. It is run
+// on the request returned by the JS functions and the rewrite rules, which
+// can turn reads into writes.
+func (p *Plugin) checkWrites(req *v1.Struct, traffic *ClientTraffic) bool {
+	mode, message := p.Mode.Get()
+	if mode != ModeReadOnly || traffic == nil {
+		return false
+	}
+	for _, text := range sentQueries(getBytesField(req, "request"), traffic) {
+		if isWriteQuery(text) {
+			p.rejectQueries(req, mode, ReadOnlyCode, message)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Plugin) rejectQueries(req *v1.Struct, mode, code, message string) {
+	ModeRejectedQueries.WithLabelValues(mode).Inc()
+	p.reply(req, &Reply{Error: newErrorResponse("ERROR", code, message)})
+}
+
+// sentQueries returns the texts of the queries of the request: its simple
+// queries and the statements it parses, and the statements parsed by earlier
+// requests that it executes.
+func sentQueries(data []byte, traffic *ClientTraffic) []string {
+	texts, parsed := []string{}, map[string]bool{}
+	for _, msg := range splitMessages(data) {
+		switch msg.kind {
+		case 'Q':
+			texts = append(texts, strings.TrimRight(string(msg.body), "\x00"))
+		case 'P':
+			reader := newMessageReader(msg.body)
+			name, text := reader.readString(), reader.readString()
+			if reader.ok {
+				parsed[name] = true
+				texts = append(texts, text)
+			}
+		}
+	}
+	for _, query := range traffic.Queries {
+		if query.Protocol == QueryProtocolExtended && !parsed[query.Statement] {
+			texts = append(texts, query.Text)
+		}
+	}
+	return texts
+}
+
+// Register exposes the mode to JS:
+//
+//	mode.get()                                  // { mode: "normal", message: "" }
+//	mode.set("maintenance", "back at 10:00 UTC") // or "read-only" and "normal"
+func (m *ModeSwitch) Register(runtime *goja.Runtime) error {
+	object := runtime.NewObject()
+	setProperty(object, "get", func() map[string]interface{} {
+		mode, message := m.Get()
+		return map[string]interface{}{"mode": mode, "message": message}
+	})
+	setProperty(object, "set", func(mode string, message goja.Value) {
+		text := ""
+		if message != nil && !goja.IsUndefined(message) && !goja.IsNull(message) {
+			text = message.String()
+		}
+		if err := m.Set(mode, text); err != nil {
+			panic(runtime.NewTypeError("mode.set: %s", err))
+		}
+	})
+	return runtime.Set("mode", object)
+}
@@ -0,0 +1,140 @@
+package plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModeSwitch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mode.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("mode: read-only\n"), 0o600))
+
+	// The mode file overrides the config.
+	m, err := NewModeSwitch(&ModeConfig{Mode: ModeMaintenance, FilePath: path}, hclog.NewNullLogger())
+	require.NoError(t, err)
+	mode, message := m.Get()
+	assert.Equal(t, ModeReadOnly, mode)
+	assert.Equal(t, "the database is in read-only mode", message)
+	assert.InDelta(t, 1, testutil.ToFloat64(PluginMode.WithLabelValues(ModeReadOnly)), 0)
+	assert.InDelta(t, 0, testutil.ToFloat64(PluginMode.WithLabelValues(ModeNormal)), 0)
+
+	// The file is only read again once changed.
+	require.NoError(t, m.Set(ModeNormal, ""))
+	require.NoError(t, m.Reload())
+	mode, _ = m.Get()
+	assert.Equal(t, ModeNormal, mode)
+
+	require.NoError(t, os.WriteFile(path, []byte("mode: maintenance\nmessage: back soon\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	require.NoError(t, m.Reload())
+	mode, message = m.Get()
+	assert.Equal(t, ModeMaintenance, mode)
+	assert.Equal(t, "back soon", message)
+
+	require.ErrorIs(t, m.Set("off", ""), ErrInvalidMode)
+	_, err = NewModeSwitch(&ModeConfig{Mode: "off"}, hclog.NewNullLogger())
+	require.ErrorIs(t, err, ErrInvalidMode)
+
+	var nilSwitch *ModeSwitch
+	mode, _ = nilSwitch.Get()
+	assert.Equal(t, ModeNormal, mode)
+	require.NoError(t, nilSwitch.Reload())
+}
+
+func TestSentQueries(t *testing.T) {
+	tracker := NewConnectionTracker()
+	sendQueries(t, tracker, newParseMessage("insert", "INSERT INTO users VALUES ($1)"))
+	traffic := tracker.TrackClient(newTrafficRequest(t, concat(
+		newParseMessage("", "SELECT 1"),
+		newBindMessage("", "", nil),
+		newExecuteMessage(""),
+		newBindMessage("", "insert", nil),
+		newExecuteMessage(""),
+		newFrontendMessage('S'))))
+
+	// The queries of the rewritten request are used, with the statements
+	// parsed by earlier requests.
+	request := concat(
+		newQueryMessage("SELECT 2"),
+		newParseMessage("", "SELECT 3"),
+		newBindMessage("", "", nil),
+		newExecuteMessage(""),
+		newBindMessage("", "insert", nil),
+		newExecuteMessage(""),
+		newFrontendMessage('S'))
+	assert.Equal(t, []string{"SELECT 2", "SELECT 3", "INSERT INTO users VALUES ($1)"}, sentQueries(request, traffic))
+}
+
+func TestPlugin_Mode(t *testing.T) {
+	p := newTestPlugin(t)
+	p.Connections = NewConnectionTracker()
+	mode, err := NewModeSwitch(&ModeConfig{Mode: ModeReadOnly}, hclog.NewNullLogger())
+	require.NoError(t, err)
+	p.Mode = mode
+	require.NoError(t, mode.Register(p.VM))
+	require.NoError(t, p.VM.Set("Value", p.VM.ToValue(v1.NewValue)))
+	require.NoError(t, p.VM.Set("Query", newQueryMessage))
+	_, err = p.VM.RunString(`
+	function onTrafficFromClient(ctx, req) {
+		req.Fields["mode"] = Value(mode.get().mode);
+		if (ctx.query && ctx.query.text === "SELECT 'archive'") {
+			req.Fields["request"] = Value(Query("DELETE FROM users"));
+		} else if (ctx.query && ctx.query.text === "DELETE FROM sessions") {
+			req.Fields["request"] = Value(Query("SELECT count(*) FROM sessions"));
+		}
+		return req;
+	}
+	function onSignal(ctx, req) {
+		mode.set("maintenance", "back at 10:00 UTC");
+		return req;
+	}`)
+	require.NoError(t, err)
+	p.RegisterFunctions([]string{"onTrafficFromClient", "onSignal"})
+
+	send := func(query string) *v1.Struct {
+		t.Helper()
+		result, err := p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, newQueryMessage(query)))
+		require.NoError(t, err)
+		return result
+	}
+
+	// Writes are rejected in read-only mode, once the JS function rewrote
+	// the request.
+	readOnlyError := concat(newErrorResponse("ERROR", ReadOnlyCode, "the database is in read-only mode"), newReadyForQuery('I'))
+	result := send("SELECT * FROM users")
+	assert.Equal(t, ModeReadOnly, result.AsMap()["mode"])
+	assert.False(t, isTerminated(result))
+	result = send("INSERT INTO users VALUES (1)")
+	assert.Equal(t, readOnlyError, getBytesField(result, "response"))
+	result = send("SELECT 'archive'")
+	assert.Equal(t, readOnlyError, getBytesField(result, "response"))
+	result = send("DELETE FROM sessions")
+	assert.False(t, isTerminated(result))
+
+	// Transactions opened before the maintenance can finish.
+	send("BEGIN")
+	_, err = p.OnTrafficFromServer(context.Background(), newServerResponse(t, newReadyForQuery('T')))
+	require.NoError(t, err)
+	_, err = p.OnSignal(context.Background(), &v1.Struct{Fields: map[string]*v1.Value{}})
+	require.NoError(t, err)
+
+	assert.False(t, isTerminated(send("SELECT 1")))
+	assert.False(t, isTerminated(send("COMMIT")))
+	_, err = p.OnTrafficFromServer(context.Background(), newServerResponse(t, newReadyForQuery('I')))
+	require.NoError(t, err)
+
+	result = send("BEGIN")
+	assert.Equal(t,
+		concat(newErrorResponse("ERROR", MaintenanceCode, "back at 10:00 UTC"), newReadyForQuery('I')),
+		getBytesField(result, "response"))
+	assert.Equal(t, TransactionStatusIdle, p.Connections.Info(result).Transaction.Status)
+}
@@ -35,8 +35,65 @@ var (
 			"metricsEnabled": sdkConfig.GetEnv("METRICS_ENABLED", "true"),
 			"metricsUnixDomainSocket": sdkConfig.GetEnv(
 				"METRICS_UNIX_DOMAIN_SOCKET", "/tmp/gatewayd-plugin-js.sock"),
-			"metricsEndpoint": sdkConfig.GetEnv("METRICS_ENDPOINT", "/metrics"),
-			"scriptPath":      sdkConfig.GetEnv("SCRIPT_PATH", "./scripts/index.js"),
+			"metricsEndpoint":   sdkConfig.GetEnv("METRICS_ENDPOINT", "/metrics"),
+			"logRedactMaxBytes": sdkConfig.GetEnv("LOG_REDACT_MAX_BYTES", "64"),
+			"logRedactKeys": sdkConfig.GetEnv(
+				"LOG_REDACT_KEYS", "password,secret,token,authorization"),
+			"logQueryFingerprints": sdkConfig.GetEnv("LOG_QUERY_FINGERPRINTS", "false"),
+			"scriptPath":           sdkConfig.GetEnv("SCRIPT_PATH", "./scripts/index.js"),
+			"scriptVersion":        sdkConfig.GetEnv("SCRIPT_VERSION", ""),
+			"scriptConfigPath":     sdkConfig.GetEnv("SCRIPT_CONFIG_PATH", ""),
+			"scriptChecksum":       sdkConfig.GetEnv("SCRIPT_CHECKSUM", ""),
+			"scriptPublicKey":      sdkConfig.GetEnv("SCRIPT_PUBLIC_KEY", ""),
+			"scriptSignaturePath":  sdkConfig.GetEnv("SCRIPT_SIGNATURE_PATH", ""),
+			"runtimeMaxCallStackSize": sdkConfig.GetEnv(
+				"RUNTIME_MAX_CALL_STACK_SIZE", "0"),
+			"runtimeMaxHeapGrowth":  sdkConfig.GetEnv("RUNTIME_MAX_HEAP_GROWTH", "0"),
+			"runtimeMaxValueSize":   sdkConfig.GetEnv("RUNTIME_MAX_VALUE_SIZE", "0"),
+			"runtimeMaxArrayLength": sdkConfig.GetEnv("RUNTIME_MAX_ARRAY_LENGTH", "0"),
+			"runtimeCheckInterval":  sdkConfig.GetEnv("RUNTIME_CHECK_INTERVAL", "10ms"),
+			"scriptConfigEnvPrefix": sdkConfig.GetEnv(
+				"SCRIPT_CONFIG_ENV_PREFIX", "JS_CONFIG_"),
+			"scriptLogName":      sdkConfig.GetEnv("SCRIPT_LOG_NAME", ""),
+			"scriptLogLevel":     sdkConfig.GetEnv("SCRIPT_LOG_LEVEL", ""),
+			"scriptLogRateLimit": sdkConfig.GetEnv("SCRIPT_LOG_RATE_LIMIT", "100"),
+			"scriptLogBurst":     sdkConfig.GetEnv("SCRIPT_LOG_BURST", "200"),
+			"scriptEnvAllowList": sdkConfig.GetEnv("SCRIPT_ENV_ALLOW_LIST", ""),
+			"scriptSecrets":      sdkConfig.GetEnv("SCRIPT_SECRETS", ""),
+			"fetchAllowedHosts":  sdkConfig.GetEnv("FETCH_ALLOWED_HOSTS", ""),
+			"fetchTimeout":       sdkConfig.GetEnv("FETCH_TIMEOUT", "5s"),
+			"fetchMaxResponseSize": sdkConfig.GetEnv(
+				"FETCH_MAX_RESPONSE_SIZE", "1048576"),
+			"fetchMaxIdleConnsPerHost": sdkConfig.GetEnv(
+				"FETCH_MAX_IDLE_CONNS_PER_HOST", "10"),
+			"schedulerUseOnTick":  sdkConfig.GetEnv("SCHEDULER_USE_ON_TICK", "false"),
+			"schedulerResolution": sdkConfig.GetEnv("SCHEDULER_RESOLUTION", "1s"),
+			"schedulerJobTimeout": sdkConfig.GetEnv("SCHEDULER_JOB_TIMEOUT", "30s"),
+			"tracingExporter":     sdkConfig.GetEnv("TRACING_EXPORTER", "none"),
+			"tracingEndpoint":     sdkConfig.GetEnv("TRACING_ENDPOINT", "localhost:4317"),
+			"tracingInsecure":     sdkConfig.GetEnv("TRACING_INSECURE", "true"),
+			"tracingFilePath":     sdkConfig.GetEnv("TRACING_FILE_PATH", "./traces.json"),
+			"tracingSampleRatio":  sdkConfig.GetEnv("TRACING_SAMPLE_RATIO", "1.0"),
+			"auditEnabled":        sdkConfig.GetEnv("AUDIT_ENABLED", "false"),
+			"auditHooks": sdkConfig.GetEnv(
+				"AUDIT_HOOKS", "onOpened,onTrafficFromClient,onClosed"),
+			"auditOutput":         sdkConfig.GetEnv("AUDIT_OUTPUT", "file"),
+			"auditFilePath":       sdkConfig.GetEnv("AUDIT_FILE_PATH", "./audit.log"),
+			"auditFileMaxSize":    sdkConfig.GetEnv("AUDIT_FILE_MAX_SIZE", "100"),
+			"auditFileMaxBackups": sdkConfig.GetEnv("AUDIT_FILE_MAX_BACKUPS", "5"),
+			"auditSyslogNetwork":  sdkConfig.GetEnv("AUDIT_SYSLOG_NETWORK", "unixgram"),
+			"auditSyslogAddress":  sdkConfig.GetEnv("AUDIT_SYSLOG_ADDRESS", "/dev/log"),
+			"auditBufferSize":     sdkConfig.GetEnv("AUDIT_BUFFER_SIZE", "1024"),
+			"auditFlushInterval":  sdkConfig.GetEnv("AUDIT_FLUSH_INTERVAL", "1s"),
+			"rewriteRulesPath":    sdkConfig.GetEnv("REWRITE_RULES_PATH", ""),
+			"slowQueryThreshold":  sdkConfig.GetEnv("SLOW_QUERY_THRESHOLD", "1s"),
+			"mode":                sdkConfig.GetEnv("MODE", "normal"),
+			"modeMessage":         sdkConfig.GetEnv("MODE_MESSAGE", ""),
+			"modeFilePath":        sdkConfig.GetEnv("MODE_FILE_PATH", ""),
+			"queryMetricsMaxFingerprints": sdkConfig.GetEnv(
+				"QUERY_METRICS_MAX_FINGERPRINTS", "100"),
+			"sentryCaptureScriptErrors": sdkConfig.GetEnv(
+				"SENTRY_CAPTURE_SCRIPT_ERRORS", "False"),
 		},
 		"hooks":      []interface{}{},
 		"tags":       []interface{}{"plugin", "javascript", "js"},
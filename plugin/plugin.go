@@ -5,15 +5,22 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/dop251/goja"
 	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
 	"github.com/hashicorp/go-hclog"
 	goplugin "github.com/hashicorp/go-plugin"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
 )
 
-var ErrUnexpectedReturnType = errors.New("unexpected JS return type")
+var (
+	ErrUnexpectedReturnType = errors.New("unexpected JS return type")
+	ErrPromiseRejected      = errors.New("JS promise rejected")
+	ErrPromisePending       = errors.New("JS promise did not settle")
+	ErrRuntimeRecycled      = errors.New("JS runtime was recycled while the function was waiting")
+)
 
 type Plugin struct {
 	goplugin.GRPCPlugin
@@ -22,6 +29,40 @@ type Plugin struct {
 	VM       *goja.Runtime
 	Mu       sync.Mutex
 	Bindings map[string]goja.Callable
+	// Listeners are the functions registered via gatewayd.on, keyed by hook name.
+	Listeners map[string][]*Listener
+	Auditor   *Auditor
+	Secrets   *Secrets
+	Fetcher   *Fetcher
+	Scheduler *Scheduler
+	Reporter  *Reporter
+	Tracing   *Tracing
+	// Redactor removes sensitive data from the requests logged by the hooks.
+	Redactor *Redactor
+	Limits   *ResourceLimits
+	// Connections tracks the state of the client connections.
+	Connections *ConnectionTracker
+	// Rewriter runs the rewrite rules on the queries sent by clients.
+	Rewriter *Rewriter
+	// SlowQuery is the config of the slow query log.
+	SlowQuery *SlowQueryConfig
+	// QueryLabels are the fingerprints recorded in the query duration metric.
+	QueryLabels *FingerprintLabels
+	// Mode rejects writes in read-only mode and queries in maintenance mode.
+	Mode *ModeSwitch
+	// Setup registers the helpers and runs the script in a new VM. It is
+	// called again when the VM is recycled.
+	Setup func(vm *goja.Runtime) error
+
+	listenerSeq int
+	// hookCtx is the context of the running hook, if any.
+	hookCtx context.Context //nolint:containedctx
+	// hookName and hookReq are the name of the running hook and the request
+	// passed to the running JS function, if any.
+	hookName string
+	hookReq  *v1.Struct
+	// hookLoop runs the asynchronous calls of the running function, if any.
+	hookLoop *eventLoop
 }
 
 type JSPlugin struct {
@@ -47,35 +88,173 @@ func (p *Plugin) RegisterFunctions(names []string) {
 	}
 }
 
-func (p *Plugin) RunFunction(ctx context.Context, name string, req *v1.Struct) (*v1.Struct, error) {
-	if p.Bindings[name] == nil {
+func (p *Plugin) RunFunction(ctx context.Context, name string, req *v1.Struct) (_ *v1.Struct, err error) {
+	// The span covers the wait for the VM and the run of the JS functions.
+	ctx, span := p.Tracing.StartHook(ctx, name)
+	defer func() { endSpan(span, err) }()
+
+	waitStart := time.Now()
+	p.Mu.Lock()
+	defer p.Mu.Unlock()
+	span.SetAttributes(attribute.Int64("gatewayd.js.vm_wait_us", time.Since(waitStart).Microseconds()))
+
+	listeners := p.getListeners(name)
+	span.SetAttributes(attribute.Int("gatewayd.js.listeners", len(listeners)))
+	if len(listeners) == 0 {
 		p.Logger.Debug("RunFunction", "name", name, "err", "function not found")
 		return req, nil
 	}
 
-	p.Mu.Lock()
-	jsReq, err := p.Bindings[name](goja.Undefined(), p.VM.ToValue(ctx), p.VM.ToValue(req))
-	p.Mu.Unlock()
+	loop := newEventLoop()
+	defer loop.close()
+	p.hookCtx, p.hookName, p.hookLoop = ctx, name, loop
+	defer func() { p.hookCtx, p.hookName, p.hookReq, p.hookLoop = nil, "", nil, nil }()
+
+	// Each listener receives the request returned by the previous one.
+	hookContext := p.newHookContext(ctx, name, req)
+	result := req
+	for _, listener := range listeners {
+		p.hookReq = result
+		stopWatching := p.watchHeap()
+		jsReq, err := listener(goja.Undefined(), hookContext, newStructValue(p.VM, result))
+		stopWatching()
+		if err == nil {
+			jsReq, err = p.settle(jsReq, loop)
+		}
+		if err != nil {
+			p.Logger.Error("RunFunction", "name", name, "err", err)
+			p.Reporter.CaptureException(name, req, err)
+			p.recycle(err)
+			return req, err
+		}
 
-	if err != nil {
-		p.Logger.Error("RunFunction", "name", name, "err", err)
-		return req, err
+		var ok bool
+		result, ok = exportStruct(jsReq)
+		if !ok {
+			return req, fmt.Errorf("%w: JS function %q returned %T, expected *v1.Struct",
+				ErrUnexpectedReturnType, name, jsReq.Export())
+		}
+		if err := p.Limits.CheckValue(result); err != nil {
+			p.Logger.Error("RunFunction", "name", name, "err", err)
+			p.recycle(err)
+			return req, err
+		}
 	}
 
-	result, ok := jsReq.Export().(*v1.Struct)
+	return result, nil
+}
+
+// settle returns the result of async functions. The promise must have
+// settled by the time the function returned, which is the case when it only
+// awaits already settled promises.
+func settle(value goja.Value) (goja.Value, error) {
+	promise, ok := value.Export().(*goja.Promise)
 	if !ok {
-		return req, fmt.Errorf("%w: JS function %q returned %T, expected *v1.Struct",
-			ErrUnexpectedReturnType, name, jsReq.Export())
+		return value, nil
 	}
 
-	return result, nil
+	switch promise.State() {
+	case goja.PromiseStateFulfilled:
+		return promise.Result(), nil
+	case goja.PromiseStateRejected:
+		return nil, fmt.Errorf("%w: %s", ErrPromiseRejected, promise.Result())
+	default:
+		return nil, ErrPromisePending
+	}
+}
+
+// settle returns the result of async functions, waiting for the asynchronous
+// calls of the loop, like fetch, while the promise is pending. The VM lock is
+// released while waiting, so other hooks can run, and held again to settle
+// the promises of the calls, which resumes the function.
+func (p *Plugin) settle(value goja.Value, loop *eventLoop) (goja.Value, error) {
+	promise, ok := value.Export().(*goja.Promise)
+	for ok && promise.State() == goja.PromiseStatePending && loop.pending > 0 {
+		vm := p.VM
+		hookCtx, hookName, hookReq := p.hookCtx, p.hookName, p.hookReq
+		loop.suspend(vm)
+		p.Mu.Unlock()
+		job := <-loop.jobs
+		p.Mu.Lock()
+		loop.resume()
+		loop.pending--
+		if p.VM != vm {
+			return nil, ErrRuntimeRecycled
+		}
+		p.hookCtx, p.hookName, p.hookReq, p.hookLoop = hookCtx, hookName, hookReq, loop
+
+		stopWatching := p.watchHeap()
+		job()
+		stopWatching()
+	}
+	return settle(value)
+}
+
+// eventLoop runs the asynchronous calls of a JS function. Their I/O runs in
+// goroutines, and their promises are settled by jobs run on the VM by settle.
+type eventLoop struct {
+	jobs    chan func()
+	done    chan struct{}
+	pending int
+
+	mu        sync.Mutex
+	suspended bool
+}
+
+func newEventLoop() *eventLoop {
+	return &eventLoop{jobs: make(chan func()), done: make(chan struct{})}
+}
+
+// run runs the work in a goroutine. The work returns the job that settles the
+// promise of the call, which is dropped if the function already returned.
+func (l *eventLoop) run(work func() func()) {
+	l.pending++
+	go func() {
+		job := work()
+		select {
+		case l.jobs <- job:
+		case <-l.done:
+		}
+	}()
+}
+
+// suspend records that the function waits without the VM lock. Interrupts
+// of the function that were not handled yet are cleared, so that they do not
+// stop the functions run meanwhile.
+func (l *eventLoop) suspend(vm *goja.Runtime) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.suspended = true
+	vm.ClearInterrupt()
+}
+
+func (l *eventLoop) resume() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.suspended = false
+}
+
+// interrupt interrupts the VM, unless the function waits without the VM lock.
+func (l *eventLoop) interrupt(vm *goja.Runtime, value interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.suspended {
+		vm.Interrupt(value)
+	}
+}
+
+func (l *eventLoop) close() {
+	close(l.done)
 }
 
 func (p *Plugin) GetHooks() []interface{} {
+	p.Mu.Lock()
+	defer p.Mu.Unlock()
+
 	hooks := []interface{}{}
-	for name := range p.Bindings {
-		if p.Bindings[name] != nil {
-			hooks = append(hooks, int32(Hooks[name]))
+	for name, hook := range Hooks {
+		if p.hasListeners(name) {
+			hooks = append(hooks, int32(hook))
 		}
 	}
 	return hooks
@@ -120,10 +299,10 @@ func (p *Plugin) GetPluginConfig(_ context.Context, _ *v1.Struct) (*v1.Struct, e
 // cannot be modified via plugins.
 func (p *Plugin) OnConfigLoaded(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnConfigLoaded.Inc()
-	p.Logger.Debug("OnConfigLoaded", "req", req)
+	p.logHook("OnConfigLoaded", "req", req)
 	// The JS function MUST return the request object, which is a *v1.Struct.
 	req, err := p.RunFunction(ctx, "onConfigLoaded", req)
-	p.Logger.Debug("OnConfigLoaded", "req", req.AsMap(), "err", err)
+	p.logHook("OnConfigLoaded", "req", req, "err", err)
 	return req, err
 }
 
@@ -131,9 +310,9 @@ func (p *Plugin) OnConfigLoaded(ctx context.Context, req *v1.Struct) (*v1.Struct
 // This is a notification and the plugin cannot modify the logger.
 func (p *Plugin) OnNewLogger(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnNewLogger.Inc()
-	p.Logger.Debug("OnNewLogger", "req", req)
+	p.logHook("OnNewLogger", "req", req)
 	req, err := p.RunFunction(ctx, "onNewLogger", req)
-	p.Logger.Debug("OnNewLogger", "req", req.AsMap(), "err", err)
+	p.logHook("OnNewLogger", "req", req, "err", err)
 	return req, err
 }
 
@@ -141,9 +320,9 @@ func (p *Plugin) OnNewLogger(ctx context.Context, req *v1.Struct) (*v1.Struct, e
 // This is a notification and the plugin cannot modify the pool.
 func (p *Plugin) OnNewPool(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnNewPool.Inc()
-	p.Logger.Debug("OnNewPool", "req", req)
+	p.logHook("OnNewPool", "req", req)
 	req, err := p.RunFunction(ctx, "onNewPool", req)
-	p.Logger.Debug("OnNewPool", "req", req.AsMap(), "err", err)
+	p.logHook("OnNewPool", "req", req, "err", err)
 	return req, err
 }
 
@@ -151,9 +330,9 @@ func (p *Plugin) OnNewPool(ctx context.Context, req *v1.Struct) (*v1.Struct, err
 // This is a notification and the plugin cannot modify the client.
 func (p *Plugin) OnNewClient(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnNewClient.Inc()
-	p.Logger.Debug("OnNewClient", "req", req)
+	p.logHook("OnNewClient", "req", req)
 	req, err := p.RunFunction(ctx, "onNewClient", req)
-	p.Logger.Debug("OnNewClient", "req", req.AsMap(), "err", err)
+	p.logHook("OnNewClient", "req", req, "err", err)
 	return req, err
 }
 
@@ -161,9 +340,9 @@ func (p *Plugin) OnNewClient(ctx context.Context, req *v1.Struct) (*v1.Struct, e
 // This is a notification and the plugin cannot modify the proxy.
 func (p *Plugin) OnNewProxy(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnNewProxy.Inc()
-	p.Logger.Debug("OnNewProxy", "req", req)
+	p.logHook("OnNewProxy", "req", req)
 	req, err := p.RunFunction(ctx, "onNewProxy", req)
-	p.Logger.Debug("OnNewProxy", "req", req.AsMap(), "err", err)
+	p.logHook("OnNewProxy", "req", req, "err", err)
 	return req, err
 }
 
@@ -171,9 +350,9 @@ func (p *Plugin) OnNewProxy(ctx context.Context, req *v1.Struct) (*v1.Struct, er
 // This is a notification and the plugin cannot modify the server.
 func (p *Plugin) OnNewServer(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnNewServer.Inc()
-	p.Logger.Debug("OnNewServer", "req", req)
+	p.logHook("OnNewServer", "req", req)
 	req, err := p.RunFunction(ctx, "onNewServer", req)
-	p.Logger.Debug("OnNewServer", "req", req.AsMap(), "err", err)
+	p.logHook("OnNewServer", "req", req, "err", err)
 	return req, err
 }
 
@@ -181,72 +360,76 @@ func (p *Plugin) OnNewServer(ctx context.Context, req *v1.Struct) (*v1.Struct, e
 // This is a notification and the plugin cannot modify the signal.
 func (p *Plugin) OnSignal(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnSignal.Inc()
-	p.Logger.Debug("OnSignal", "req", req)
+	p.logHook("OnSignal", "req", req)
+	p.reloadMode()
 	req, err := p.RunFunction(ctx, "onSignal", req)
-	p.Logger.Debug("OnSignal", "req", req.AsMap(), "err", err)
+	p.logHook("OnSignal", "req", req, "err", err)
 	return req, err
 }
 
 // OnRun is called when GatewayD is started.
 func (p *Plugin) OnRun(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnRun.Inc()
-	p.Logger.Debug("OnRun", "req", req)
+	p.logHook("OnRun", "req", req)
 	req, err := p.RunFunction(ctx, "onRun", req)
-	p.Logger.Debug("OnRun", "req", req.AsMap(), "err", err)
+	p.logHook("OnRun", "req", req, "err", err)
 	return req, err
 }
 
 // OnBooting is called when GatewayD is booting.
 func (p *Plugin) OnBooting(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnBooting.Inc()
-	p.Logger.Debug("OnBooting", "req", req)
+	p.logHook("OnBooting", "req", req)
 	req, err := p.RunFunction(ctx, "onBooting", req)
-	p.Logger.Debug("OnBooting", "req", req.AsMap(), "err", err)
+	p.logHook("OnBooting", "req", req, "err", err)
 	return req, err
 }
 
 // OnBooted is called when GatewayD is booted.
 func (p *Plugin) OnBooted(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnBooted.Inc()
-	p.Logger.Debug("OnBooted", "req", req)
+	p.logHook("OnBooted", "req", req)
 	req, err := p.RunFunction(ctx, "onBooted", req)
-	p.Logger.Debug("OnBooted", "req", req.AsMap(), "err", err)
+	p.logHook("OnBooted", "req", req, "err", err)
 	return req, err
 }
 
 // OnOpening is called when a new client connection is being opened.
 func (p *Plugin) OnOpening(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnOpening.Inc()
-	p.Logger.Debug("OnOpening", "req", req)
+	p.logHook("OnOpening", "req", req)
 	req, err := p.RunFunction(ctx, "onOpening", req)
-	p.Logger.Debug("OnOpening", "req", req.AsMap(), "err", err)
+	p.logHook("OnOpening", "req", req, "err", err)
 	return req, err
 }
 
 // OnOpened is called when a new client connection is opened.
 func (p *Plugin) OnOpened(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnOpened.Inc()
-	p.Logger.Debug("OnOpened", "req", req)
+	p.logHook("OnOpened", "req", req)
 	req, err := p.RunFunction(ctx, "onOpened", req)
-	p.Logger.Debug("OnOpened", "req", req.AsMap(), "err", err)
+	p.Auditor.AuditHook("onOpened", req, err)
+	p.logHook("OnOpened", "req", req, "err", err)
 	return req, err
 }
 
 // OnClosing is called when a client connection is being closed.
 func (p *Plugin) OnClosing(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnClosing.Inc()
-	p.Logger.Debug("OnClosing", "req", req)
+	p.logHook("OnClosing", "req", req)
 	req, err := p.RunFunction(ctx, "onClosing", req)
-	p.Logger.Debug("OnClosing", "req", req.AsMap(), "err", err)
+	p.logHook("OnClosing", "req", req, "err", err)
 	return req, err
 }
 
 // OnClosed is called when a client connection is closed.
 func (p *Plugin) OnClosed(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnClosed.Inc()
-	p.Logger.Debug("OnClosed", "req", req)
+	p.logHook("OnClosed", "req", req)
 	req, err := p.RunFunction(ctx, "onClosed", req)
-	p.Logger.Debug("OnClosed", "req", req.AsMap(), "err", err)
+	p.Connections.Forget(req)
+	p.Auditor.AuditHook("onClosed", req, err)
+	p.logHook("OnClosed", "req", req, "err", err)
 	return req, err
 }
 
@@ -254,27 +437,29 @@ func (p *Plugin) OnClosed(ctx context.Context, req *v1.Struct) (*v1.Struct, erro
 // This is a notification and the plugin cannot modify the request at this point.
 func (p *Plugin) OnTraffic(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnTraffic.Inc()
-	p.Logger.Debug("OnTraffic", "req", req)
+	p.logHook("OnTraffic", "req", req)
 	req, err := p.RunFunction(ctx, "onTraffic", req)
-	p.Logger.Debug("OnTraffic", "req", req.AsMap(), "err", err)
+	p.logHook("OnTraffic", "req", req, "err", err)
 	return req, err
 }
 
 // OnShutdown is called when GatewayD is shutting down.
 func (p *Plugin) OnShutdown(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnShutdown.Inc()
-	p.Logger.Debug("OnShutdown", "req", req)
+	p.logHook("OnShutdown", "req", req)
 	req, err := p.RunFunction(ctx, "onShutdown", req)
-	p.Logger.Debug("OnShutdown", "req", req.AsMap(), "err", err)
+	p.logHook("OnShutdown", "req", req, "err", err)
 	return req, err
 }
 
 // OnTick is called when GatewayD is ticking (if enabled).
 func (p *Plugin) OnTick(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnTick.Inc()
-	p.Logger.Debug("OnTick", "req", req)
+	p.logHook("OnTick", "req", req)
+	p.reloadMode()
 	req, err := p.RunFunction(ctx, "onTick", req)
-	p.Logger.Debug("OnTick", "req", req.AsMap(), "err", err)
+	p.Scheduler.OnTick()
+	p.logHook("OnTick", "req", req, "err", err)
 	return req, err
 }
 
@@ -283,9 +468,33 @@ func (p *Plugin) OnTick(ctx context.Context, req *v1.Struct) (*v1.Struct, error)
 // or a response.
 func (p *Plugin) OnTrafficFromClient(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnTrafficFromClient.Inc()
-	p.Logger.Debug("OnTrafficFromClient", "req", req.AsMap())
-	req, err := p.RunFunction(ctx, "onTrafficFromClient", req)
-	p.Logger.Debug("OnTrafficFromClient", "req", req.AsMap(), "err", err)
+	p.logHook("OnTrafficFromClient", "req", req)
+	// The JS functions see the queries rewritten by the rules of the before
+	// phase, and are skipped if a rule answered the query.
+	req = p.Rewriter.Apply(RewritePhaseBefore, req, p.Connections)
+	var err error
+	if !isTerminated(req) {
+		traffic := p.Connections.TrackClient(req)
+		ctx = withClientTraffic(ctx, traffic)
+		if !p.checkMode(req, traffic) {
+			req, err = p.RunFunction(ctx, "onTrafficFromClient", req)
+		}
+		if err == nil && !isTerminated(req) {
+			req = p.Rewriter.Apply(RewritePhaseAfter, req, p.Connections)
+		}
+		// Writes are rejected in read-only mode once the JS functions and the
+		// rules, which can rewrite the queries, are done with the request.
+		// The rejection answers the request, even if the JS function failed.
+		if !isTerminated(req) && p.checkWrites(req, traffic) {
+			err = nil
+		}
+		// The queries are timed once sent to the server.
+		if !isTerminated(req) {
+			p.Connections.Sent(req, traffic)
+		}
+	}
+	p.Auditor.AuditHook("onTrafficFromClient", req, err)
+	p.logHook("OnTrafficFromClient", "req", req, "err", err)
 	return req, err
 }
 
@@ -294,9 +503,9 @@ func (p *Plugin) OnTrafficFromClient(ctx context.Context, req *v1.Struct) (*v1.S
 // or a response while also sending the request to the server.
 func (p *Plugin) OnTrafficToServer(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnTrafficToServer.Inc()
-	p.Logger.Debug("OnTrafficToServer", "req", req)
+	p.logHook("OnTrafficToServer", "req", req)
 	req, err := p.RunFunction(ctx, "onTrafficToServer", req)
-	p.Logger.Debug("OnTrafficToServer", "req", req.AsMap(), "err", err)
+	p.logHook("OnTrafficToServer", "req", req, "err", err)
 	return req, err
 }
 
@@ -305,9 +514,12 @@ func (p *Plugin) OnTrafficToServer(ctx context.Context, req *v1.Struct) (*v1.Str
 // or a response.
 func (p *Plugin) OnTrafficFromServer(ctx context.Context, resp *v1.Struct) (*v1.Struct, error) {
 	OnTrafficFromServer.Inc()
-	p.Logger.Debug("OnTrafficFromServer", "resp", resp)
+	p.logHook("OnTrafficFromServer", "resp", resp)
+	traffic := p.Connections.TrackServer(resp)
+	p.observeQueries(resp, traffic)
+	ctx = withServerTraffic(ctx, traffic)
 	resp, err := p.RunFunction(ctx, "onTrafficFromServer", resp)
-	p.Logger.Debug("OnTrafficFromServer", "resp", resp.AsMap(), "err", err)
+	p.logHook("OnTrafficFromServer", "resp", resp, "err", err)
 	return resp, err
 }
 
@@ -316,8 +528,9 @@ func (p *Plugin) OnTrafficFromServer(ctx context.Context, resp *v1.Struct) (*v1.
 // or a response.
 func (p *Plugin) OnTrafficToClient(ctx context.Context, resp *v1.Struct) (*v1.Struct, error) {
 	OnTrafficToClient.Inc()
-	p.Logger.Debug("OnTrafficToClient", "resp", resp)
+	p.logHook("OnTrafficToClient", "resp", resp)
+	ctx = withServerTraffic(ctx, p.Connections.Completed(resp))
 	resp, err := p.RunFunction(ctx, "onTrafficToClient", resp)
-	p.Logger.Debug("OnTrafficToClient", "resp", resp.AsMap(), "err", err)
+	p.logHook("OnTrafficToClient", "resp", resp, "err", err)
 	return resp, err
 }
@@ -0,0 +1,311 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	pgQuery "github.com/wasilibs/go-pgquery"
+)
+
+const (
+	// MinPgSQLMessageLength is the length of the type byte plus the length field.
+	MinPgSQLMessageLength = 5
+	// ProtocolVersion3 is the protocol version sent in a v3.0 StartupMessage.
+	ProtocolVersion3 = 196608
+)
+
+// getBytesField returns the bytes stored in the given field of the request,
+// or nil if the field does not exist.
+func getBytesField(req *v1.Struct, field string) []byte {
+	if req == nil || req.GetFields() == nil {
+		return nil
+	}
+	if value, ok := req.GetFields()[field]; ok {
+		return value.GetBytesValue()
+	}
+	return nil
+}
+
+// getClientAddress returns the remote address of the client connection
+// attached to the request by GatewayD, or an empty string if it is missing.
+func getClientAddress(req *v1.Struct) string {
+	if req == nil || req.GetFields() == nil {
+		return ""
+	}
+	client, ok := req.GetFields()["client"]
+	if !ok || client.GetStructValue() == nil {
+		return ""
+	}
+	return client.GetStructValue().GetFields()["remote"].GetStringValue()
+}
+
+// getQuery extracts the query text from a simple query (Q) message.
+func getQuery(msg []byte) (string, bool) {
+	if len(msg) < MinPgSQLMessageLength || msg[0] != 'Q' {
+		return "", false
+	}
+	size := int(binary.BigEndian.Uint32(msg[1:MinPgSQLMessageLength])) + 1
+	if size > len(msg) || size < MinPgSQLMessageLength {
+		size = len(msg)
+	}
+	return string(bytes.TrimRight(msg[MinPgSQLMessageLength:size], "\x00")), true
+}
+
+// getFingerprint returns the fingerprint of the query, or an empty string
+// if the query cannot be parsed.
+func getFingerprint(query string) string {
+	fingerprint, err := pgQuery.Fingerprint(query)
+	if err != nil {
+		return ""
+	}
+	return fingerprint
+}
+
+// parseStartupParameters decodes the parameters of a v3 StartupMessage.
+// It returns false if the message is not a StartupMessage.
+func parseStartupParameters(msg []byte) (map[string]string, bool) {
+	startup, ok := parseStartupMessage(msg)
+	if !ok || startup.Type != StartupTypeStartup {
+		return nil, false
+	}
+	return startup.Parameters, true
+}
+
+const (
+	StartupTypeStartup = "startup"
+	StartupTypeSSL     = "ssl"
+	StartupTypeGSSENC  = "gssenc"
+	StartupTypeCancel  = "cancel"
+
+	sslRequestCode    = 80877103
+	gssencRequestCode = 80877104
+	cancelRequestCode = 80877102
+)
+
+// StartupMessage is one of the first messages sent by a client, which have
+// no type byte: a StartupMessage, an SSLRequest, a GSSENCRequest or a
+// CancelRequest.
+type StartupMessage struct {
+	Type string
+	// ProtocolVersion and Parameters are those of a StartupMessage.
+	ProtocolVersion string
+	Parameters      map[string]string
+	// ProcessID and SecretKey are those of a CancelRequest.
+	ProcessID uint32
+	SecretKey []byte
+}
+
+// parseStartupMessage decodes a message sent by a client before the startup.
+// It returns false if the message is not one of them.
+func parseStartupMessage(msg []byte) (*StartupMessage, bool) {
+	if len(msg) < 8 || int(binary.BigEndian.Uint32(msg[0:4])) != len(msg) {
+		return nil, false
+	}
+
+	code := binary.BigEndian.Uint32(msg[4:8])
+	switch {
+	case code == sslRequestCode && len(msg) == 8:
+		return &StartupMessage{Type: StartupTypeSSL}, true
+	case code == gssencRequestCode && len(msg) == 8:
+		return &StartupMessage{Type: StartupTypeGSSENC}, true
+	case code == cancelRequestCode && len(msg) >= 16:
+		return &StartupMessage{
+			Type:      StartupTypeCancel,
+			ProcessID: binary.BigEndian.Uint32(msg[8:12]),
+			SecretKey: append([]byte{}, msg[12:]...),
+		}, true
+	case code>>16 == ProtocolVersion3>>16:
+		params := map[string]string{}
+		fields := bytes.Split(bytes.TrimRight(msg[8:], "\x00"), []byte{0})
+		for i := 0; i+1 < len(fields); i += 2 {
+			params[string(fields[i])] = string(fields[i+1])
+		}
+		return &StartupMessage{
+			Type:            StartupTypeStartup,
+			ProtocolVersion: fmt.Sprintf("%d.%d", code>>16, code&0xFFFF),
+			Parameters:      params,
+		}, true
+	default:
+		return nil, false
+	}
+}
+
+// ErrorField is a field of an ErrorResponse, such as the detail ('D') or
+// the hint ('H').
+type ErrorField struct {
+	Type  byte
+	Value string
+}
+
+// newErrorResponse encodes an ErrorResponse message with the severity, the
+// SQLSTATE code, the message and the other fields.
+func newErrorResponse(severity, code, text string, fields ...ErrorField) []byte {
+	fields = append([]ErrorField{
+		{Type: 'S', Value: severity},
+		{Type: 'V', Value: severity},
+		{Type: 'C', Value: code},
+		{Type: 'M', Value: text},
+	}, fields...)
+
+	body := []byte{}
+	for _, field := range fields {
+		if field.Value == "" {
+			continue
+		}
+		body = append(append(append(body, field.Type), field.Value...), 0)
+	}
+	return newMessage('E', append(body, 0))
+}
+
+// newMessage encodes a message with a type byte.
+func newMessage(kind byte, body []byte) []byte {
+	msg := binary.BigEndian.AppendUint32([]byte{kind}, uint32(len(body)+4))
+	return append(msg, body...)
+}
+
+// Column is a column of a RowDescription message, whose values are sent in
+// text format.
+type Column struct {
+	Name    string
+	TypeOID uint32
+	// TypeSize is the size of the type, or -1 for variable-length types.
+	TypeSize int16
+}
+
+// TextOID is the OID of the text type.
+const TextOID = 25
+
+// textColumns returns text columns with the names.
+func textColumns(names []string) []Column {
+	columns := make([]Column, len(names))
+	for i, name := range names {
+		columns[i] = Column{Name: name, TypeOID: TextOID, TypeSize: -1}
+	}
+	return columns
+}
+
+// newRowDescription encodes a RowDescription message.
+func newRowDescription(columns []Column) []byte {
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(columns)))
+	for _, column := range columns {
+		body = append(append(body, column.Name...), 0)
+		body = binary.BigEndian.AppendUint32(body, 0)                       // table OID
+		body = binary.BigEndian.AppendUint16(body, 0)                       // column number
+		body = binary.BigEndian.AppendUint32(body, column.TypeOID)          // type OID
+		body = binary.BigEndian.AppendUint16(body, uint16(column.TypeSize)) // type size
+		body = binary.BigEndian.AppendUint32(body, 0xFFFFFFFF)              // type modifier (-1)
+		body = binary.BigEndian.AppendUint16(body, 0)                       // text format
+	}
+	return newMessage('T', body)
+}
+
+// newDataRow encodes a DataRow message, where nil values are NULL.
+func newDataRow(values []*string) []byte {
+	body := binary.BigEndian.AppendUint16(nil, uint16(len(values)))
+	for _, value := range values {
+		if value == nil {
+			body = binary.BigEndian.AppendUint32(body, 0xFFFFFFFF)
+			continue
+		}
+		body = append(binary.BigEndian.AppendUint32(body, uint32(len(*value))), *value...)
+	}
+	return newMessage('D', body)
+}
+
+// newCommandComplete encodes a CommandComplete message with the command tag,
+// e.g. SELECT 1.
+func newCommandComplete(tag string) []byte {
+	return newMessage('C', append([]byte(tag), 0))
+}
+
+// newReadyForQuery encodes a ReadyForQuery message with the transaction
+// status: I (idle), T (in a transaction) or E (in a failed transaction).
+func newReadyForQuery(status byte) []byte {
+	return newMessage('Z', []byte{status})
+}
+
+// message is a frontend or backend message with a type byte.
+type message struct {
+	kind byte
+	body []byte
+}
+
+// splitMessages splits the data into messages with a type byte. It stops at
+// the first incomplete or malformed message, e.g. a StartupMessage, which
+// has no type byte.
+func splitMessages(data []byte) []message {
+	messages := []message{}
+	for len(data) >= MinPgSQLMessageLength {
+		length := int(binary.BigEndian.Uint32(data[1:MinPgSQLMessageLength]))
+		if length < MinPgSQLMessageLength-1 || length+1 > len(data) {
+			break
+		}
+		messages = append(messages, message{kind: data[0], body: data[MinPgSQLMessageLength : length+1]})
+		data = data[length+1:]
+	}
+	return messages
+}
+
+// messageReader reads the fields of the body of a message. Reads past the
+// end of the body set ok to false and return zero values.
+type messageReader struct {
+	data []byte
+	ok   bool
+}
+
+func newMessageReader(body []byte) *messageReader {
+	return &messageReader{data: body, ok: true}
+}
+
+func (r *messageReader) readString() string {
+	index := bytes.IndexByte(r.data, 0)
+	if index < 0 {
+		r.ok = false
+		return ""
+	}
+	value := string(r.data[:index])
+	r.data = r.data[index+1:]
+	return value
+}
+
+func (r *messageReader) readInt16() int {
+	if len(r.data) < 2 {
+		r.ok = false
+		return 0
+	}
+	value := int(int16(binary.BigEndian.Uint16(r.data)))
+	r.data = r.data[2:]
+	return value
+}
+
+func (r *messageReader) readInt32() int {
+	if len(r.data) < 4 {
+		r.ok = false
+		return 0
+	}
+	value := int(int32(binary.BigEndian.Uint32(r.data)))
+	r.data = r.data[4:]
+	return value
+}
+
+func (r *messageReader) readBytes(n int) []byte {
+	if n < 0 || len(r.data) < n {
+		r.ok = false
+		return nil
+	}
+	value := r.data[:n]
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *messageReader) readByte() byte {
+	if len(r.data) < 1 {
+		r.ok = false
+		return 0
+	}
+	value := r.data[0]
+	r.data = r.data[1:]
+	return value
+}
@@ -0,0 +1,145 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/dop251/goja_nodejs/require"
+)
+
+const (
+	// CompiledModuleName is the native module that runs the compiled modules.
+	CompiledModuleName = "gatewayd:compiled"
+	// maxCachedPrograms is the number of programs after which the cache is
+	// cleared, which only happens if the modules keep changing on disk.
+	maxCachedPrograms = 1024
+	// moduleWrapper wraps the source of modules like require does, on the
+	// same line, so that the line numbers of stack traces are unchanged.
+	moduleWrapper = "(function(exports,require,module,__filename,__dirname){"
+)
+
+// compiledModuleStub is the source returned to require for JS modules, which
+// runs the compiled module instead of compiling its source again.
+var compiledModuleStub = []byte(
+	`require("` + CompiledModuleName + `")(exports, require, module, __filename, __dirname);`)
+
+type programKey struct {
+	name   string
+	digest [sha256.Size]byte
+}
+
+// ProgramCache compiles the script and the modules it requires once, so that
+// new VMs only have to run the compiled programs. Programs are keyed by the
+// file name and the SHA-256 digest of the source, so a module that changes
+// on disk is compiled again.
+type ProgramCache struct {
+	mu       sync.Mutex
+	loader   require.SourceLoader
+	programs map[programKey]*goja.Program
+	// modules are the programs of the modules last loaded by path.
+	modules map[string]*goja.Program
+}
+
+// NewProgramCache returns a new ProgramCache that reads the modules with the
+// loader, or from disk if it is nil.
+func NewProgramCache(loader require.SourceLoader) *ProgramCache {
+	if loader == nil {
+		loader = require.DefaultSourceLoader
+	}
+	return &ProgramCache{
+		loader:   loader,
+		programs: map[programKey]*goja.Program{},
+		modules:  map[string]*goja.Program{},
+	}
+}
+
+// Compile returns the compiled program of the source, compiling it on a
+// cache miss. The kind is the label of the metrics, i.e. script or module.
+func (c *ProgramCache) Compile(kind, name string, source []byte) (*goja.Program, error) {
+	key := programKey{name: name, digest: sha256.Sum256(source)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if program, ok := c.programs[key]; ok {
+		ProgramCacheLookups.WithLabelValues(kind, "hit").Inc()
+		return program, nil
+	}
+	ProgramCacheLookups.WithLabelValues(kind, "miss").Inc()
+
+	start := time.Now()
+	program, err := goja.Compile(name, string(source), false)
+	if err != nil {
+		return nil, err
+	}
+	ScriptCompileDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+
+	if len(c.programs) >= maxCachedPrograms {
+		clear(c.programs)
+	}
+	c.programs[key] = program
+	return program, nil
+}
+
+// Load is the source loader of require. It compiles the JS modules through
+// the cache and returns a stub that runs them. Other files, such as JSON
+// modules, are returned as is.
+func (c *ProgramCache) Load(path string) ([]byte, error) {
+	source, err := c.loader(path)
+	if err != nil {
+		return nil, err
+	}
+	switch filepath.Ext(path) {
+	case ".js", ".cjs", ".mjs":
+	default:
+		return source, nil
+	}
+
+	wrapped := make([]byte, 0, len(moduleWrapper)+len(source)+3)
+	wrapped = append(append(append(wrapped, moduleWrapper...), source...), "\n})"...)
+	program, err := c.Compile("module", path, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.modules[path] = program
+	c.mu.Unlock()
+	return compiledModuleStub, nil
+}
+
+// Require is the loader of the native module that runs the compiled modules,
+// which is only required by the stubs returned by Load.
+func (c *ProgramCache) Require(runtime *goja.Runtime, module *goja.Object) {
+	run := func(call goja.FunctionCall) goja.Value {
+		filename := call.Argument(3).String()
+
+		c.mu.Lock()
+		program, ok := c.modules[filename]
+		c.mu.Unlock()
+		if !ok {
+			panic(runtime.NewGoError(fmt.Errorf("module %s was not compiled", filename)))
+		}
+
+		value, err := runtime.RunProgram(program)
+		if err != nil {
+			panic(err)
+		}
+		function, ok := goja.AssertFunction(value)
+		if !ok {
+			panic(runtime.NewTypeError("module %s did not compile to a function", filename))
+		}
+		// exports, require, module, __filename and __dirname, with exports as this.
+		if _, err := function(call.Argument(0), call.Arguments...); err != nil {
+			panic(err)
+		}
+		return goja.Undefined()
+	}
+	if err := module.Set("exports", run); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,93 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dop251/goja"
+	jsRequire "github.com/dop251/goja_nodejs/require"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCachedRuntime returns a new VM that requires the modules through the cache.
+func newCachedRuntime(programs *ProgramCache) *goja.Runtime {
+	vm := goja.New()
+	registry := jsRequire.NewRegistry(jsRequire.WithLoader(programs.Load))
+	registry.RegisterNativeModule(CompiledModuleName, programs.Require)
+	registry.Enable(vm)
+	return vm
+}
+
+func TestProgramCache_Compile(t *testing.T) {
+	programs := NewProgramCache(nil)
+	misses := testutil.ToFloat64(ProgramCacheLookups.WithLabelValues("script", "miss"))
+	hits := testutil.ToFloat64(ProgramCacheLookups.WithLabelValues("script", "hit"))
+
+	first, err := programs.Compile("script", "index.js", []byte("var a = 1;"))
+	require.NoError(t, err)
+	second, err := programs.Compile("script", "index.js", []byte("var a = 1;"))
+	require.NoError(t, err)
+	assert.Same(t, first, second)
+
+	changed, err := programs.Compile("script", "index.js", []byte("var a = 2;"))
+	require.NoError(t, err)
+	assert.NotSame(t, first, changed)
+
+	assert.InDelta(t, misses+2, testutil.ToFloat64(ProgramCacheLookups.WithLabelValues("script", "miss")), 0)
+	assert.InDelta(t, hits+1, testutil.ToFloat64(ProgramCacheLookups.WithLabelValues("script", "hit")), 0)
+
+	// The program runs in any number of VMs.
+	for range 2 {
+		vm := goja.New()
+		_, err := vm.RunProgram(changed)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), vm.Get("a").ToInteger())
+	}
+
+	_, err = programs.Compile("script", "index.js", []byte("var = ;"))
+	assert.Error(t, err)
+}
+
+func TestProgramCache_Modules(t *testing.T) {
+	dir := t.TempDir()
+	libPath := filepath.Join(dir, "lib.js")
+	require.NoError(t, os.WriteFile(libPath, []byte(`
+const data = require("./data.json");
+exports.answer = data.answer;
+exports.fail = function () { throw new Error("failed"); };
+`), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "data.json"), []byte(`{"answer": 42}`), 0o600))
+	scriptPath := filepath.Join(dir, "index.js")
+	script := `const lib = require("./lib"); var answer = lib.answer;`
+
+	programs := NewProgramCache(nil)
+	hits := testutil.ToFloat64(ProgramCacheLookups.WithLabelValues("module", "hit"))
+
+	for range 2 {
+		vm := newCachedRuntime(programs)
+		_, err := vm.RunScript(scriptPath, script)
+		require.NoError(t, err)
+		assert.Equal(t, int64(42), vm.Get("answer").ToInteger())
+
+		// Stack traces point to the lines of the module.
+		_, err = vm.RunScript(scriptPath, `lib.fail()`)
+		var exception *goja.Exception
+		require.ErrorAs(t, err, &exception)
+		assert.Contains(t, exception.String(), libPath+":4:")
+	}
+	// The module was compiled for the first VM only.
+	assert.InDelta(t, hits+1, testutil.ToFloat64(ProgramCacheLookups.WithLabelValues("module", "hit")), 0)
+
+	// A module that changes on disk is compiled again for new VMs.
+	require.NoError(t, os.WriteFile(libPath, []byte(`exports.answer = 7;`), 0o600))
+	vm := newCachedRuntime(programs)
+	_, err := vm.RunScript(scriptPath, script)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), vm.Get("answer").ToInteger())
+
+	_, err = vm.RunScript(scriptPath, `require("./missing")`)
+	assert.Error(t, err)
+}
@@ -0,0 +1,100 @@
+package plugin
+
+import (
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+const (
+	QueryProtocolSimple   = "simple"
+	QueryProtocolExtended = "extended"
+)
+
+// Query is a query sent by a client with the simple or the extended query
+// protocol. The parameters are strings in text format, bytes in binary
+// format, or nil for NULL.
+type Query struct {
+	Protocol  string
+	Text      string
+	Params    []interface{}
+	Statement string
+	Portal    string
+	// Duration is the time from the request of the client to the
+	// ReadyForQuery of the server, once the server answered.
+	Duration time.Duration
+}
+
+// readBindParams reads the parameter values of a Bind message, whose format
+// codes apply to all the parameters if there is only one.
+func readBindParams(reader *messageReader) []interface{} {
+	formatCount := reader.readInt16()
+	if formatCount < 0 {
+		reader.ok = false
+		return nil
+	}
+	formats := make([]int, formatCount)
+	for i := range formats {
+		formats[i] = reader.readInt16()
+	}
+	count := reader.readInt16()
+	if !reader.ok || count < 0 {
+		reader.ok = false
+		return nil
+	}
+
+	params := make([]interface{}, 0, count)
+	for i := range count {
+		size := reader.readInt32()
+		if size < 0 {
+			params = append(params, nil)
+			continue
+		}
+		value := reader.readBytes(size)
+		if !reader.ok {
+			return nil
+		}
+		format := 0
+		switch len(formats) {
+		case 0:
+		case 1:
+			format = formats[0]
+		default:
+			if i < len(formats) {
+				format = formats[i]
+			}
+		}
+		if format == 0 {
+			params = append(params, string(value))
+		} else {
+			params = append(params, append([]byte{}, value...))
+		}
+	}
+	return params
+}
+
+// newQueryObject returns the JS object of a query, whose binary parameters
+// are Uint8Arrays.
+func newQueryObject(runtime *goja.Runtime, query *Query) *goja.Object {
+	params := make([]interface{}, len(query.Params))
+	for i, param := range query.Params {
+		if data, ok := param.([]byte); ok {
+			params[i] = newUint8Array(runtime, data)
+		} else {
+			params[i] = param
+		}
+	}
+
+	object := runtime.NewObject()
+	setProperty(object, "protocol", query.Protocol)
+	setProperty(object, "text", query.Text)
+	setProperty(object, "params", params)
+	setProperty(object, "statement", query.Statement)
+	setProperty(object, "portal", query.Portal)
+	if query.Duration > 0 {
+		setProperty(object, "durationMs", float64(query.Duration.Microseconds())/1000)
+	} else {
+		setProperty(object, "durationMs", nil)
+	}
+	return object
+}
@@ -0,0 +1,183 @@
+package plugin
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFrontendMessage(kind byte, body ...[]byte) []byte {
+	size := 4
+	for _, part := range body {
+		size += len(part)
+	}
+	msg := binary.BigEndian.AppendUint32([]byte{kind}, uint32(size))
+	for _, part := range body {
+		msg = append(msg, part...)
+	}
+	return msg
+}
+
+func cstring(value string) []byte {
+	return append([]byte(value), 0)
+}
+
+func int16Bytes(values ...int) []byte {
+	data := []byte{}
+	for _, value := range values {
+		data = binary.BigEndian.AppendUint16(data, uint16(int16(value)))
+	}
+	return data
+}
+
+func newParseMessage(name, query string) []byte {
+	return newFrontendMessage('P', cstring(name), cstring(query), int16Bytes(0))
+}
+
+// newBindMessage returns a Bind message with the format codes and the
+// parameters, where nil is NULL.
+func newBindMessage(portal, statement string, formats []int, params ...[]byte) []byte {
+	body := [][]byte{cstring(portal), cstring(statement), int16Bytes(len(formats)), int16Bytes(formats...)}
+	body = append(body, int16Bytes(len(params)))
+	for _, param := range params {
+		if param == nil {
+			body = append(body, binary.BigEndian.AppendUint32(nil, 0xFFFFFFFF))
+			continue
+		}
+		body = append(body, binary.BigEndian.AppendUint32(nil, uint32(len(param))), param)
+	}
+	return newFrontendMessage('B', append(body, int16Bytes(0))...)
+}
+
+func newExecuteMessage(portal string) []byte {
+	return newFrontendMessage('E', cstring(portal), []byte{0, 0, 0, 0})
+}
+
+// trackQueries returns the queries of the request.
+func trackQueries(t *testing.T, tracker *ConnectionTracker, request []byte) []*Query {
+	t.Helper()
+	traffic := tracker.TrackClient(newTrafficRequest(t, request))
+	if traffic == nil {
+		return nil
+	}
+	return traffic.Queries
+}
+
+func concat(messages ...[]byte) []byte {
+	data := []byte{}
+	for _, msg := range messages {
+		data = append(data, msg...)
+	}
+	return data
+}
+
+func TestConnectionTracker_ExtendedQuery(t *testing.T) {
+	tracker := NewConnectionTracker()
+	sync := newFrontendMessage('S')
+
+	// Drivers usually prepare the statement first, and execute it later.
+	queries := trackQueries(t, tracker, concat(
+		newParseMessage("s1", "SELECT * FROM users WHERE id = $1 AND tag = $2 AND note = $3"),
+		newFrontendMessage('D', []byte{'S'}, cstring("s1")),
+		sync))
+	assert.Empty(t, queries)
+
+	queries = trackQueries(t, tracker, concat(
+		newBindMessage("", "s1", []int{0, 1, 0}, []byte("42"), []byte{0, 1}, nil),
+		newExecuteMessage(""),
+		sync))
+	require.Len(t, queries, 1)
+	assert.Equal(t, &Query{
+		Protocol:  QueryProtocolExtended,
+		Text:      "SELECT * FROM users WHERE id = $1 AND tag = $2 AND note = $3",
+		Params:    []interface{}{"42", []byte{0, 1}, nil},
+		Statement: "s1",
+		Portal:    "",
+	}, queries[0])
+
+	// The unnamed statement is parsed, bound and executed at once, with one
+	// format code for all the parameters.
+	queries = trackQueries(t, tracker, concat(
+		newParseMessage("", "SELECT $1::int"),
+		newBindMessage("p1", "", []int{1}, []byte{0, 0, 0, 7}),
+		newExecuteMessage("p1"),
+		sync))
+	require.Len(t, queries, 1)
+	assert.Equal(t, "SELECT $1::int", queries[0].Text)
+	assert.Equal(t, []interface{}{[]byte{0, 0, 0, 7}}, queries[0].Params)
+	assert.Equal(t, "p1", queries[0].Portal)
+
+	// Other connections have their own statements.
+	other, err := v1.NewStruct(map[string]interface{}{
+		"client":  map[string]interface{}{"remote": "127.0.0.1:6000"},
+		"request": concat(newBindMessage("", "s1", nil), newExecuteMessage("")),
+	})
+	require.NoError(t, err)
+	queries = tracker.TrackClient(other).Queries
+	require.Len(t, queries, 1)
+	assert.Empty(t, queries[0].Text)
+
+	// Closed statements are forgotten.
+	trackQueries(t, tracker, newFrontendMessage('C', []byte{'S'}, cstring("s1")))
+	queries = trackQueries(t, tracker, concat(newBindMessage("", "s1", nil), newExecuteMessage("")))
+	require.Len(t, queries, 1)
+	assert.Empty(t, queries[0].Text)
+
+	tracker.Forget(newTrafficRequest(t, nil))
+	assert.NotContains(t, tracker.connections, "127.0.0.1:5000")
+	assert.Contains(t, tracker.connections, "127.0.0.1:6000")
+}
+
+func TestConnectionTracker_SimpleQuery(t *testing.T) {
+	tracker := NewConnectionTracker()
+
+	queries := trackQueries(t, tracker, newQueryMessage("SELECT 1"))
+	require.Len(t, queries, 1)
+	assert.Equal(t, &Query{Protocol: QueryProtocolSimple, Text: "SELECT 1", Params: []interface{}{}}, queries[0])
+
+	// Startup messages and malformed messages are ignored.
+	assert.Empty(t, trackQueries(t, tracker, newStartupMessage("user", "alice")))
+	assert.Empty(t, trackQueries(t, tracker, newFrontendMessage('B', []byte{1, 2})))
+	assert.Empty(t, trackQueries(t, tracker, []byte{'Q', 0, 0}))
+
+	var nilTracker *ConnectionTracker
+	assert.Nil(t, nilTracker.TrackClient(newTrafficRequest(t, newQueryMessage("SELECT 1"))))
+	nilTracker.Forget(newTrafficRequest(t, nil))
+}
+
+func TestPlugin_OnTrafficFromClientQuery(t *testing.T) {
+	p := newTestPlugin(t)
+	p.Connections = NewConnectionTracker()
+	require.NoError(t, p.VM.Set("Value", p.VM.ToValue(v1.NewValue)))
+	_, err := p.VM.RunString(`function onTrafficFromClient(ctx, req) {
+		if (ctx.query !== null) {
+			req.Fields["protocol"] = Value(ctx.query.protocol);
+			req.Fields["text"] = Value(ctx.query.text);
+			req.Fields["first"] = Value(ctx.query.params[0]);
+			req.Fields["binary"] = Value(ctx.query.params[1] instanceof Uint8Array);
+			req.Fields["count"] = Value(ctx.queries.length);
+		}
+		return req;
+	}`)
+	require.NoError(t, err)
+	p.RegisterFunction("onTrafficFromClient")
+
+	req := newTrafficRequest(t, concat(
+		newParseMessage("", "SELECT $1, $2"),
+		newBindMessage("", "", []int{0, 1}, []byte("a"), []byte{1}),
+		newExecuteMessage(""),
+		newFrontendMessage('S')))
+	result, err := p.OnTrafficFromClient(context.Background(), req)
+	require.NoError(t, err)
+
+	fields := result.AsMap()
+	assert.Equal(t, QueryProtocolExtended, fields["protocol"])
+	assert.Equal(t, "SELECT $1, $2", fields["text"])
+	assert.Equal(t, "a", fields["first"])
+	assert.Equal(t, true, fields["binary"])
+	assert.InDelta(t, 1, fields["count"], 0)
+}
@@ -0,0 +1,123 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/spf13/cast"
+)
+
+type RedactionConfig struct {
+	// MaxBytes is the number of bytes of byte fields, such as queries and
+	// results, that are logged. Only the size is logged if it is zero and
+	// byte fields are logged in full if it is negative.
+	MaxBytes int
+	// Keys are the names of the fields whose values are masked.
+	Keys []string
+	// QueryFingerprints logs the fingerprints of queries instead of their
+	// bytes, so that no literal values are logged.
+	QueryFingerprints bool
+}
+
+// NewRedactionConfig returns a new RedactionConfig from the plugin config.
+func NewRedactionConfig(config map[string]interface{}) *RedactionConfig {
+	redactionConfig := RedactionConfig{
+		MaxBytes:          cast.ToInt(config["logRedactMaxBytes"]),
+		QueryFingerprints: cast.ToBool(config["logQueryFingerprints"]),
+	}
+	for _, key := range strings.Split(cast.ToString(config["logRedactKeys"]), ",") {
+		if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+			redactionConfig.Keys = append(redactionConfig.Keys, key)
+		}
+	}
+	return &redactionConfig
+}
+
+// Redactor removes sensitive data from the requests and responses of hooks
+// before they are logged.
+type Redactor struct {
+	config  *RedactionConfig
+	keys    map[string]bool
+	secrets *Secrets
+}
+
+// NewRedactor returns a new Redactor. Secret values are redacted from strings.
+func NewRedactor(config *RedactionConfig, secrets *Secrets) *Redactor {
+	keys := make(map[string]bool, len(config.Keys))
+	for _, key := range config.Keys {
+		keys[key] = true
+	}
+	return &Redactor{config: config, keys: keys, secrets: secrets}
+}
+
+// Redact returns the redacted fields of the request. Without a Redactor,
+// the fields are returned as is.
+func (r *Redactor) Redact(req *v1.Struct) map[string]interface{} {
+	if r == nil {
+		return req.AsMap()
+	}
+	return r.redactMap(req.AsMap())
+}
+
+func (r *Redactor) redactMap(fields map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		if r.keys[strings.ToLower(key)] {
+			redacted[key] = Redacted
+			continue
+		}
+		redacted[key] = r.redactValue(value)
+	}
+	return redacted
+}
+
+func (r *Redactor) redactValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return r.redactMap(value)
+	case []interface{}:
+		redacted := make([]interface{}, len(value))
+		for i, item := range value {
+			redacted[i] = r.redactValue(item)
+		}
+		return redacted
+	case []byte:
+		return r.redactBytes(value)
+	case string:
+		return r.secrets.Redact(value)
+	default:
+		return value
+	}
+}
+
+// redactBytes logs the fingerprint of queries or truncates the bytes.
+func (r *Redactor) redactBytes(data []byte) interface{} {
+	if r.config.QueryFingerprints {
+		if query, ok := getQuery(data); ok {
+			return map[string]interface{}{
+				"fingerprint": getFingerprint(query),
+				"size":        len(data),
+			}
+		}
+		return fmt.Sprintf("[%d bytes]", len(data))
+	}
+
+	switch {
+	case r.config.MaxBytes < 0 || len(data) <= r.config.MaxBytes:
+		return r.secrets.Redact(fmt.Sprintf("%q", data))
+	case r.config.MaxBytes == 0:
+		return fmt.Sprintf("[%d bytes]", len(data))
+	default:
+		return r.secrets.Redact(fmt.Sprintf("%q... [%d bytes]", data[:r.config.MaxBytes], len(data)))
+	}
+}
+
+// logHook logs the request or response of a hook at debug level after
+// redacting it.
+func (p *Plugin) logHook(method, key string, req *v1.Struct, args ...interface{}) {
+	if !p.Logger.IsDebug() {
+		return
+	}
+	p.Logger.Debug(method, append([]interface{}{key, p.Redactor.Redact(req)}, args...)...)
+}
@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRedactedRequest(t *testing.T) *v1.Struct {
+	t.Helper()
+	req, err := v1.NewStruct(map[string]interface{}{
+		"client": map[string]interface{}{"remote": "127.0.0.1:5000"},
+		"request": newQueryMessage(
+			"SELECT * FROM users WHERE email = 'alice@example.com' AND ssn = '123-45-6789'"),
+		"password": "hunter2",
+	})
+	require.NoError(t, err)
+	return req
+}
+
+func TestRedactor_Redact(t *testing.T) {
+	req := newRedactedRequest(t)
+
+	redacted := NewRedactor(NewRedactionConfig(map[string]interface{}{
+		"logRedactMaxBytes": "20",
+		"logRedactKeys":     "Password, remote",
+	}), nil).Redact(req)
+	assert.Equal(t, Redacted, redacted["password"])
+	assert.Equal(t, Redacted, redacted["client"].(map[string]interface{})["remote"])
+	assert.Equal(t, `"Q\x00\x00\x00RSELECT * FROM u"... [83 bytes]`, redacted["request"])
+
+	redacted = NewRedactor(NewRedactionConfig(map[string]interface{}{}), nil).Redact(req)
+	assert.Equal(t, "[83 bytes]", redacted["request"])
+	assert.Equal(t, "hunter2", redacted["password"])
+
+	redacted = NewRedactor(NewRedactionConfig(map[string]interface{}{
+		"logQueryFingerprints": "true",
+	}), nil).Redact(req)
+	query := redacted["request"].(map[string]interface{})
+	assert.Equal(t, getFingerprint("SELECT * FROM users WHERE email = 'a' AND ssn = 'b'"), query["fingerprint"])
+	assert.Equal(t, 83, query["size"])
+
+	var disabled *Redactor
+	assert.Equal(t, req.AsMap(), disabled.Redact(req))
+}
+
+func TestPlugin_HookLogsAreRedacted(t *testing.T) {
+	output := &bytes.Buffer{}
+	p := newTestPlugin(t)
+	p.Logger = hclog.New(&hclog.LoggerOptions{Level: hclog.Debug, Output: output, JSONFormat: true})
+	p.Redactor = NewRedactor(NewRedactionConfig(map[string]interface{}{
+		"logRedactMaxBytes": "0",
+		"logRedactKeys":     "password",
+	}), nil)
+
+	hooks := []func(context.Context, *v1.Struct) (*v1.Struct, error){
+		p.OnConfigLoaded, p.OnNewLogger, p.OnNewPool, p.OnNewClient, p.OnNewProxy,
+		p.OnNewServer, p.OnSignal, p.OnRun, p.OnBooting, p.OnBooted, p.OnOpening,
+		p.OnOpened, p.OnClosing, p.OnClosed, p.OnTraffic, p.OnShutdown, p.OnTick,
+		p.OnTrafficFromClient, p.OnTrafficToServer, p.OnTrafficFromServer, p.OnTrafficToClient,
+	}
+	for _, hook := range hooks {
+		_, err := hook(context.Background(), newRedactedRequest(t))
+		require.NoError(t, err)
+	}
+
+	logs := output.String()
+	assert.Contains(t, logs, "[83 bytes]")
+	assert.NotContains(t, logs, "hunter2")
+	assert.NotContains(t, logs, "alice@example.com")
+	assert.NotContains(t, logs, "U0VMRUNU", "no base64 encoded queries")
+}
@@ -0,0 +1,377 @@
+package plugin
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/dop251/goja"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+)
+
+// columnTypes are the types of the columns of respond.rows, by name.
+var columnTypes = map[string]Column{
+	"bool":        {TypeOID: 16, TypeSize: 1},
+	"bytea":       {TypeOID: 17, TypeSize: -1},
+	"int8":        {TypeOID: 20, TypeSize: 8},
+	"int2":        {TypeOID: 21, TypeSize: 2},
+	"int4":        {TypeOID: 23, TypeSize: 4},
+	"text":        {TypeOID: TextOID, TypeSize: -1},
+	"json":        {TypeOID: 114, TypeSize: -1},
+	"float4":      {TypeOID: 700, TypeSize: 4},
+	"float8":      {TypeOID: 701, TypeSize: 8},
+	"varchar":     {TypeOID: 1043, TypeSize: -1},
+	"date":        {TypeOID: 1082, TypeSize: 4},
+	"timestamp":   {TypeOID: 1114, TypeSize: 8},
+	"timestamptz": {TypeOID: 1184, TypeSize: 8},
+	"numeric":     {TypeOID: 1700, TypeSize: -1},
+	"uuid":        {TypeOID: 2950, TypeSize: 16},
+	"jsonb":       {TypeOID: 3802, TypeSize: -1},
+}
+
+// Reply is the answer of the plugin to the queries of a request, sent to the
+// client instead of forwarding the request to the server. It is either the
+// rows and the command tag of a result, or an error.
+type Reply struct {
+	// Columns are the columns of the rows, or nil for commands without rows.
+	Columns []Column
+	Rows    [][]*string
+	Command string
+	// Error is the ErrorResponse message, if the reply is an error.
+	Error []byte
+}
+
+// encode returns the messages that answer the request, in the order a server
+// would send them. The result answers the simple query, of which there is at
+// most one, or each Execute, and an error answers the first Execute and skips
+// the extended query messages until the Sync. ReadyForQuery carries the
+// transaction status.
+func (r *Reply) encode(request []byte, status byte) []byte {
+	result := func(description bool) []byte {
+		if r.Error != nil {
+			return r.Error
+		}
+		response := []byte{}
+		if description && r.Columns != nil {
+			response = append(response, newRowDescription(r.Columns)...)
+		}
+		for _, row := range r.Rows {
+			response = append(response, newDataRow(row)...)
+		}
+		return append(response, newCommandComplete(r.Command)...)
+	}
+
+	// The parameter types of the statements parsed by the request, for the
+	// ParameterDescription of Describe messages.
+	parameters := map[string][]byte{}
+	response, failed := []byte{}, false
+	for _, msg := range splitMessages(request) {
+		if failed && msg.kind != 'S' {
+			continue
+		}
+		switch msg.kind {
+		case 'Q':
+			response = append(append(response, result(true)...), newReadyForQuery(status)...)
+			if r.Error != nil {
+				return response
+			}
+		case 'P':
+			reader := newMessageReader(msg.body)
+			name := reader.readString()
+			reader.readString()
+			count := reader.readInt16()
+			types := reader.readBytes(4 * count)
+			if reader.ok {
+				parameters[name] = append(binary.BigEndian.AppendUint16(nil, uint16(count)), types...)
+			}
+			response = append(response, newMessage('1', nil)...)
+		case 'B':
+			response = append(response, newMessage('2', nil)...)
+		case 'D':
+			if reader := newMessageReader(msg.body); reader.readByte() == 'S' {
+				description, ok := parameters[reader.readString()]
+				if !ok {
+					description = []byte{0, 0}
+				}
+				response = append(response, newMessage('t', description)...)
+			}
+			if r.Columns != nil {
+				response = append(response, newRowDescription(r.Columns)...)
+			} else {
+				response = append(response, newMessage('n', nil)...)
+			}
+		case 'E':
+			response = append(response, result(false)...)
+			failed = r.Error != nil
+		case 'C':
+			response = append(response, newMessage('3', nil)...)
+		case 'S':
+			response = append(response, newReadyForQuery(status)...)
+			failed = false
+		}
+	}
+	return response
+}
+
+// Replied records that the plugin answered the request, and returns the
+// transaction status of the ReadyForQuery messages of the reply. Errors undo
+// the transaction statements of the request, which did not run, if it was
+// tracked by TrackClient, and fail the transaction, if any.
+func (t *ConnectionTracker) Replied(req *v1.Struct, tracked, failed bool) byte {
+	if t == nil {
+		return 'I'
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conn, ok := t.connections[getClientAddress(req)]
+	if !ok {
+		return 'I'
+	}
+	if failed && tracked {
+		conn.transaction = conn.previous
+	}
+	switch conn.transaction.Status {
+	case TransactionStatusActive:
+		if failed {
+			conn.transaction.Status = TransactionStatusFailed
+			return 'E'
+		}
+		return 'T'
+	case TransactionStatusFailed:
+		return 'E'
+	default:
+		return 'I'
+	}
+}
+
+// reply answers the request with the reply.
+func (p *Plugin) reply(req *v1.Struct, reply *Reply) {
+	status := p.Connections.Replied(req, true, reply.Error != nil)
+	setResponse(req, reply.encode(getBytesField(req, "request"), status))
+}
+
+// RegisterRespondAPI exposes the respond object to JS, whose functions answer
+// the request of the running onTrafficFromClient function instead of the
+// server, and return the request:
+//
+//	return respond.rows(["id", { name: "name", type: "text" }], [[1, "alice"]]);
+//	return respond.error("42501", "permission denied", { severity, detail, hint });
+//	return respond.command("SET");
+//
+// The types of columns given by name are guessed from their first non-null
+// value. Values are sent in text format: booleans as t or f, Uint8Arrays as
+// bytea hex, Dates as timestamptz and objects as JSON.
+func (p *Plugin) RegisterRespondAPI() error {
+	runtime := p.VM
+	respond := runtime.NewObject()
+
+	request := func(function string) *v1.Struct {
+		if p.hookReq == nil || p.hookName != "onTrafficFromClient" {
+			panic(runtime.NewTypeError("%s: can only be called in onTrafficFromClient", function))
+		}
+		// The server answers each simple query of a request on its own, so a
+		// single reply cannot answer several of them.
+		queries := 0
+		for _, msg := range splitMessages(getBytesField(p.hookReq, "request")) {
+			if msg.kind == 'Q' {
+				queries++
+			}
+		}
+		if queries > 1 {
+			panic(runtime.NewTypeError("%s: cannot answer a request of %d simple queries", function, queries))
+		}
+		return p.hookReq
+	}
+
+	setProperty(respond, "rows", func(call goja.FunctionCall) goja.Value {
+		req := request("respond.rows")
+		rows := exportRows(runtime, call.Argument(1))
+		columns := resultColumns(runtime, call.Argument(0), rows)
+		reply := &Reply{Columns: columns, Rows: make([][]*string, len(rows)), Command: "SELECT " + strconv.Itoa(len(rows))}
+		for i, row := range rows {
+			if len(row) != len(columns) {
+				panic(runtime.NewTypeError("respond.rows: row %d has %d values, expected %d", i, len(row), len(columns)))
+			}
+			reply.Rows[i] = make([]*string, len(row))
+			for j, value := range row {
+				reply.Rows[i][j] = textValue(value)
+			}
+		}
+		if command := call.Argument(2); !goja.IsUndefined(command) && !goja.IsNull(command) {
+			reply.Command = command.String()
+		}
+		p.reply(req, reply)
+		return newStructValue(runtime, req)
+	})
+
+	setProperty(respond, "error", func(call goja.FunctionCall) goja.Value {
+		req := request("respond.error")
+		code, text := call.Argument(0), call.Argument(1)
+		if goja.IsUndefined(code) || goja.IsUndefined(text) {
+			panic(runtime.NewTypeError("respond.error: expected a SQLSTATE code and a message"))
+		}
+		severity, fields := "ERROR", []ErrorField{}
+		if options := call.Argument(2); !goja.IsUndefined(options) && !goja.IsNull(options) {
+			object := options.ToObject(runtime)
+			get := func(name string) string {
+				value := object.Get(name)
+				if value == nil || goja.IsUndefined(value) || goja.IsNull(value) {
+					return ""
+				}
+				return value.String()
+			}
+			if value := get("severity"); value != "" {
+				severity = value
+			}
+			fields = append(fields, ErrorField{Type: 'D', Value: get("detail")}, ErrorField{Type: 'H', Value: get("hint")})
+		}
+		p.reply(req, &Reply{Error: newErrorResponse(severity, code.String(), text.String(), fields...)})
+		return newStructValue(runtime, req)
+	})
+
+	setProperty(respond, "command", func(call goja.FunctionCall) goja.Value {
+		req := request("respond.command")
+		if goja.IsUndefined(call.Argument(0)) {
+			panic(runtime.NewTypeError("respond.command: expected a command tag"))
+		}
+		p.reply(req, &Reply{Command: call.Argument(0).String()})
+		return newStructValue(runtime, req)
+	})
+
+	return runtime.Set("respond", respond)
+}
+
+// exportRows returns the values of the rows, an array of arrays.
+func exportRows(runtime *goja.Runtime, value goja.Value) [][]goja.Value {
+	if goja.IsUndefined(value) || goja.IsNull(value) {
+		return nil
+	}
+	object := value.ToObject(runtime)
+	rows := make([][]goja.Value, 0, object.Get("length").ToInteger())
+	for i := range object.Get("length").ToInteger() {
+		row := object.Get(strconv.FormatInt(i, 10))
+		if row == nil || goja.IsUndefined(row) || goja.IsNull(row) {
+			panic(runtime.NewTypeError("respond.rows: row %d is not an array", i))
+		}
+		cells := row.ToObject(runtime)
+		values := make([]goja.Value, 0, cells.Get("length").ToInteger())
+		for j := range cells.Get("length").ToInteger() {
+			values = append(values, cells.Get(strconv.FormatInt(j, 10)))
+		}
+		rows = append(rows, values)
+	}
+	return rows
+}
+
+// resultColumns returns the columns, given as names or as { name, type }
+// objects.
+func resultColumns(runtime *goja.Runtime, value goja.Value, rows [][]goja.Value) []Column {
+	if goja.IsUndefined(value) || goja.IsNull(value) {
+		panic(runtime.NewTypeError("respond.rows: expected an array of columns"))
+	}
+	object := value.ToObject(runtime)
+	columns := make([]Column, 0, object.Get("length").ToInteger())
+	for i := range int(object.Get("length").ToInteger()) {
+		item := object.Get(strconv.Itoa(i))
+		if item == nil || goja.IsUndefined(item) || goja.IsNull(item) {
+			panic(runtime.NewTypeError("respond.rows: column %d is not a name or an object", i))
+		}
+
+		var name, typeName string
+		if spec, ok := item.(*goja.Object); ok {
+			name = spec.Get("name").String()
+			if value := spec.Get("type"); value != nil && !goja.IsUndefined(value) && !goja.IsNull(value) {
+				typeName = value.String()
+			}
+		} else {
+			name = item.String()
+		}
+		if typeName == "" {
+			typeName = guessType(rows, i)
+		}
+
+		column, ok := columnTypes[typeName]
+		if !ok {
+			panic(runtime.NewTypeError("respond.rows: unknown type %q of column %q", typeName, name))
+		}
+		column.Name = name
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// guessType returns the type of a column from its first non-null value.
+func guessType(rows [][]goja.Value, index int) string {
+	for _, row := range rows {
+		if index >= len(row) || row[index] == nil || goja.IsUndefined(row[index]) || goja.IsNull(row[index]) {
+			continue
+		}
+		switch value := row[index].Export().(type) {
+		case bool:
+			return "bool"
+		case int64:
+			return "int8"
+		case float64:
+			if value == math.Trunc(value) && math.Abs(value) < 1<<53 {
+				return "int8"
+			}
+			return "float8"
+		case []byte, goja.ArrayBuffer:
+			return "bytea"
+		case time.Time:
+			return "timestamptz"
+		case string:
+			return "text"
+		default:
+			return "json"
+		}
+	}
+	return "text"
+}
+
+// formatTimestamptz formats the time like PostgreSQL formats timestamptz
+// values, with an offset of hours only unless it has minutes, e.g. +00.
+func formatTimestamptz(t time.Time) string {
+	if _, offset := t.Zone(); offset%3600 != 0 {
+		return t.Format("2006-01-02 15:04:05.999999-07:00")
+	}
+	return t.Format("2006-01-02 15:04:05.999999-07")
+}
+
+// textValue returns the value in text format, or nil for NULL.
+func textValue(value goja.Value) *string {
+	if value == nil || goja.IsUndefined(value) || goja.IsNull(value) {
+		return nil
+	}
+	var text string
+	switch exported := value.Export().(type) {
+	case bool:
+		text = "f"
+		if exported {
+			text = "t"
+		}
+	case int64:
+		text = strconv.FormatInt(exported, 10)
+	case float64:
+		text = strconv.FormatFloat(exported, 'f', -1, 64)
+	case string:
+		text = exported
+	case []byte:
+		text = `\x` + hex.EncodeToString(exported)
+	case goja.ArrayBuffer:
+		text = `\x` + hex.EncodeToString(exported.Bytes())
+	case time.Time:
+		text = formatTimestamptz(exported)
+	default:
+		data, err := json.Marshal(exported)
+		if err != nil {
+			text = value.String()
+		} else {
+			text = string(data)
+		}
+	}
+	return &text
+}
@@ -0,0 +1,141 @@
+package plugin
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRespondPlugin(t *testing.T, script string) *Plugin {
+	t.Helper()
+	p := newTestPlugin(t)
+	p.Connections = NewConnectionTracker()
+	require.NoError(t, p.RegisterRespondAPI())
+	require.NoError(t, RegisterEncodingHelpers(p.VM))
+	_, err := p.VM.RunString(script)
+	require.NoError(t, err)
+	p.RegisterFunctions([]string{"onTrafficFromClient", "onTick"})
+	return p
+}
+
+func stringPtr(value string) *string {
+	return &value
+}
+
+func TestRespond_Rows(t *testing.T) {
+	p := newRespondPlugin(t, `function onTrafficFromClient(ctx, req) {
+		return respond.rows(
+			["id", "name", { name: "score", type: "numeric" }, "active", "data", "tags"],
+			[[1, "alice", 1.5, true, bytes([1, 255]), { a: 1 }], [2.5, null, "2", false, null, [1]]]);
+	}`)
+
+	result, err := p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, newQueryMessage("SELECT * FROM users")))
+	require.NoError(t, err)
+	assert.True(t, isTerminated(result))
+
+	// The types of the columns given by name are guessed from the first row.
+	columns := []Column{
+		{Name: "id", TypeOID: 20, TypeSize: 8},
+		{Name: "name", TypeOID: TextOID, TypeSize: -1},
+		{Name: "score", TypeOID: 1700, TypeSize: -1},
+		{Name: "active", TypeOID: 16, TypeSize: 1},
+		{Name: "data", TypeOID: 17, TypeSize: -1},
+		{Name: "tags", TypeOID: 114, TypeSize: -1},
+	}
+	assert.Equal(t, concat(
+		newRowDescription(columns),
+		newDataRow([]*string{stringPtr("1"), stringPtr("alice"), stringPtr("1.5"), stringPtr("t"), stringPtr(`\x01ff`), stringPtr(`{"a":1}`)}),
+		newDataRow([]*string{stringPtr("2.5"), nil, stringPtr("2"), stringPtr("f"), nil, stringPtr("[1]")}),
+		newCommandComplete("SELECT 2"),
+		newReadyForQuery('I'),
+	), getBytesField(result, "response"))
+}
+
+func TestRespond_ExtendedQuery(t *testing.T) {
+	p := newRespondPlugin(t, `function onTrafficFromClient(ctx, req) {
+		return ctx.query !== null && ctx.query.text.startsWith("DELETE")
+			? respond.error("42501", "permission denied", { hint: "ask an admin" })
+			: respond.rows([{ name: "flag", type: "bool" }], [[true]], "FETCH 1");
+	}`)
+
+	parse := newFrontendMessage('P', cstring("s1"), cstring("SELECT $1"), int16Bytes(1), binary.BigEndian.AppendUint32(nil, 23))
+	request := concat(
+		parse,
+		newFrontendMessage('D', []byte{'S'}, cstring("s1")),
+		newBindMessage("", "s1", nil, []byte("1")),
+		newFrontendMessage('D', []byte{'P'}, cstring("")),
+		newExecuteMessage(""),
+		newFrontendMessage('C', []byte{'S'}, cstring("s1")),
+		newFrontendMessage('S'))
+	result, err := p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, request))
+	require.NoError(t, err)
+
+	row := newRowDescription([]Column{{Name: "flag", TypeOID: 16, TypeSize: 1}})
+	assert.Equal(t, concat(
+		newMessage('1', nil),
+		newMessage('t', concat(int16Bytes(1), binary.BigEndian.AppendUint32(nil, 23))),
+		row,
+		newMessage('2', nil),
+		row,
+		newDataRow([]*string{stringPtr("t")}),
+		newCommandComplete("FETCH 1"),
+		newMessage('3', nil),
+		newReadyForQuery('I'),
+	), getBytesField(result, "response"))
+
+	// Errors skip the messages until the Sync, and fail the transaction.
+	_, err = p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, newQueryMessage("BEGIN")))
+	require.NoError(t, err)
+	result, err = p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, concat(
+		newParseMessage("", "DELETE FROM users"),
+		newBindMessage("", "", nil),
+		newExecuteMessage(""),
+		newFrontendMessage('C', []byte{'P'}, cstring("")),
+		newFrontendMessage('S'))))
+	require.NoError(t, err)
+	assert.Equal(t, concat(
+		newMessage('1', nil),
+		newMessage('2', nil),
+		newErrorResponse("ERROR", "42501", "permission denied", ErrorField{Type: 'H', Value: "ask an admin"}),
+		newReadyForQuery('E'),
+	), getBytesField(result, "response"))
+	assert.Equal(t, TransactionStatusFailed, p.Connections.Info(result).Transaction.Status)
+}
+
+func TestRespond_Command(t *testing.T) {
+	p := newRespondPlugin(t, `
+	function onTrafficFromClient(ctx, req) {
+		return respond.command("SET");
+	}
+	function onTick(ctx, req) {
+		return respond.command("SET");
+	}`)
+
+	_, err := p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, newQueryMessage("BEGIN")))
+	require.NoError(t, err)
+	result, err := p.OnTrafficFromClient(context.Background(),
+		newTrafficRequest(t, newQueryMessage("SET search_path = app")))
+	require.NoError(t, err)
+	assert.Equal(t, concat(newCommandComplete("SET"), newReadyForQuery('T')), getBytesField(result, "response"))
+
+	// The responses only answer the requests of clients.
+	_, err = p.OnTick(context.Background(), &v1.Struct{Fields: map[string]*v1.Value{}})
+	require.ErrorContains(t, err, "can only be called in onTrafficFromClient")
+
+	// The server answers each pipelined simple query, so a reply cannot.
+	_, err = p.RunFunction(context.Background(), "onTrafficFromClient",
+		newTrafficRequest(t, concat(newQueryMessage("SET a = 1"), newQueryMessage("SET b = 2"))))
+	require.ErrorContains(t, err, "cannot answer a request of 2 simple queries")
+}
+
+func TestFormatTimestamptz(t *testing.T) {
+	moment := time.Date(2024, 5, 1, 12, 30, 0, 500000000, time.UTC)
+	assert.Equal(t, "2024-05-01 12:30:00.5+00", formatTimestamptz(moment))
+	assert.Equal(t, "2024-05-01 14:30:00.5+02", formatTimestamptz(moment.In(time.FixedZone("", 2*3600))))
+	assert.Equal(t, "2024-05-01 18:00:00.5+05:30", formatTimestamptz(moment.In(time.FixedZone("", 5*3600+1800))))
+}
@@ -0,0 +1,577 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/spf13/cast"
+	pgQuery "github.com/wasilibs/go-pgquery"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// RewritePhaseBefore rules run before the JS onTrafficFromClient functions.
+	RewritePhaseBefore = "before"
+	// RewritePhaseAfter rules run on the request returned by the JS functions.
+	RewritePhaseAfter = "after"
+)
+
+var ErrInvalidRewriteRule = errors.New("invalid rewrite rule")
+
+type RewriteConfig struct {
+	// RulesPath is the path of the YAML file of the rewrite rules. No rules
+	// are run if it is empty.
+	RulesPath string
+}
+
+// NewRewriteConfig returns a new RewriteConfig from the plugin config.
+func NewRewriteConfig(config map[string]interface{}) *RewriteConfig {
+	return &RewriteConfig{RulesPath: cast.ToString(config["rewriteRulesPath"])}
+}
+
+// RewriteMatch are the conditions of a rule, which must all hold.
+type RewriteMatch struct {
+	// Fingerprint is the fingerprint of the query, as logged with
+	// LOG_QUERY_FINGERPRINTS.
+	Fingerprint string `yaml:"fingerprint"`
+	// Regex is a regular expression matched against the query text.
+	Regex string `yaml:"regex"`
+	// Statements are the kinds of statements, e.g. select or SelectStmt, one
+	// of which the query must contain.
+	Statements []string `yaml:"statements"`
+	// Tables are the tables, one of which the query must reference. A
+	// qualified name, e.g. public.users, only matches qualified references.
+	Tables []string `yaml:"tables"`
+}
+
+// TableReplacement replaces the references to a table with another table.
+type TableReplacement struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+// SyntheticError is the error of a synthetic response.
+type SyntheticError struct {
+	Code     string `yaml:"code"`
+	Message  string `yaml:"message"`
+	Severity string `yaml:"severity"`
+}
+
+// SyntheticResponse is the response sent to the client instead of
+// forwarding a simple query to the server: either the text columns and rows
+// of a result, or an error.
+type SyntheticResponse struct {
+	Columns []string    `yaml:"columns"`
+	Rows    [][]*string `yaml:"rows"`
+	// Command is the command tag, which defaults to SELECT and the number
+	// of rows.
+	Command string          `yaml:"command"`
+	Error   *SyntheticError `yaml:"error"`
+}
+
+// reply returns the reply of the response.
+func (r *SyntheticResponse) reply() *Reply {
+	if r.Error != nil {
+		severity := r.Error.Severity
+		if severity == "" {
+			severity = "ERROR"
+		}
+		return &Reply{Error: newErrorResponse(severity, r.Error.Code, r.Error.Message)}
+	}
+
+	reply := &Reply{Rows: r.Rows, Command: r.Command}
+	if len(r.Columns) > 0 {
+		reply.Columns = textColumns(r.Columns)
+	}
+	if reply.Command == "" {
+		reply.Command = "SELECT " + strconv.Itoa(len(r.Rows))
+	}
+	return reply
+}
+
+// RewriteRule rewrites the queries it matches, or answers them.
+type RewriteRule struct {
+	Name string `yaml:"name"`
+	// Phase is before (the default) or after.
+	Phase string       `yaml:"phase"`
+	Match RewriteMatch `yaml:"match"`
+	// ReplaceTable replaces the references to a table.
+	ReplaceTable *TableReplacement `yaml:"replaceTable"`
+	// Comment is prepended to the query as a comment, e.g. "+ SeqScan(users)"
+	// for a pg_hint_plan hint.
+	Comment string `yaml:"comment"`
+	// Limit is the maximum number of rows returned by SELECT statements,
+	// which is added or lowered.
+	Limit int `yaml:"limit"`
+	// Respond answers simple queries without forwarding them to the server.
+	Respond *SyntheticResponse `yaml:"respond"`
+
+	regex      *regexp.Regexp
+	statements []string
+}
+
+// compile validates the rule and prepares its conditions.
+func (r *RewriteRule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("%w: the name is required", ErrInvalidRewriteRule)
+	}
+	fail := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s: %s", ErrInvalidRewriteRule, r.Name, fmt.Sprintf(format, args...))
+	}
+
+	if r.Phase == "" {
+		r.Phase = RewritePhaseBefore
+	}
+	if r.Phase != RewritePhaseBefore && r.Phase != RewritePhaseAfter {
+		return fail("unknown phase %q", r.Phase)
+	}
+
+	match := r.Match
+	if match.Fingerprint == "" && match.Regex == "" && len(match.Statements) == 0 && len(match.Tables) == 0 {
+		return fail("at least one match condition is required")
+	}
+	if match.Regex != "" {
+		regex, err := regexp.Compile(match.Regex)
+		if err != nil {
+			return fail("%s", err)
+		}
+		r.regex = regex
+	}
+	r.statements = make([]string, 0, len(match.Statements))
+	for _, statement := range match.Statements {
+		r.statements = append(r.statements, statementKind(statement))
+	}
+
+	rewrites := r.ReplaceTable != nil || r.Comment != "" || r.Limit != 0
+	switch {
+	case !rewrites && r.Respond == nil:
+		return fail("at least one rewrite or a response is required")
+	case rewrites && r.Respond != nil:
+		return fail("a response cannot be combined with rewrites")
+	case r.ReplaceTable != nil && (r.ReplaceTable.From == "" || r.ReplaceTable.To == ""):
+		return fail("replaceTable requires from and to")
+	case strings.Contains(r.Comment, "*/"):
+		return fail("the comment cannot contain */")
+	case r.Limit < 0:
+		return fail("the limit cannot be negative")
+	}
+
+	if response := r.Respond; response != nil {
+		switch {
+		case response.Error != nil && (len(response.Columns) > 0 || response.Command != ""):
+			return fail("an error response cannot have columns or a command")
+		case response.Error != nil && response.Error.Code == "":
+			return fail("an error response requires a code")
+		case len(response.Columns) == 0 && len(response.Rows) > 0:
+			return fail("rows require columns")
+		}
+		for _, row := range response.Rows {
+			if len(row) != len(response.Columns) {
+				return fail("rows must have %d values", len(response.Columns))
+			}
+		}
+	}
+	return nil
+}
+
+// matches tells whether the query matches all the conditions of the rule.
+func (r *RewriteRule) matches(query *parsedQuery) bool {
+	if r.Match.Fingerprint != "" && query.fingerprint() != r.Match.Fingerprint {
+		return false
+	}
+	if r.regex != nil && !r.regex.MatchString(query.text) {
+		return false
+	}
+	if len(r.statements) > 0 && !slices.ContainsFunc(query.statements(), func(kind string) bool {
+		return slices.Contains(r.statements, kind)
+	}) {
+		return false
+	}
+	if len(r.Match.Tables) > 0 && !slices.ContainsFunc(query.relations(), func(rel relation) bool {
+		return slices.ContainsFunc(r.Match.Tables, rel.is)
+	}) {
+		return false
+	}
+	return true
+}
+
+// rewrite returns the rewritten query text.
+func (r *RewriteRule) rewrite(query *parsedQuery) string {
+	text := query.text
+	if r.ReplaceTable != nil {
+		text = replaceTable(query, r.ReplaceTable)
+	}
+	if r.Limit > 0 {
+		text = forceLimit(newParsedQuery(text), r.Limit)
+	}
+	if r.Comment != "" {
+		if strings.HasPrefix(r.Comment, "+") {
+			text = "/*" + r.Comment + " */ " + text
+		} else {
+			text = "/* " + r.Comment + " */ " + text
+		}
+	}
+	return text
+}
+
+// Rewriter runs the rewrite rules on the queries sent by clients, natively
+// and in the order of the rules file. Each rule sees the query rewritten by
+// the previous rules.
+type Rewriter struct {
+	rules map[string][]*RewriteRule
+}
+
+// NewRewriter returns a new Rewriter with the rules.
+func NewRewriter(rules []*RewriteRule) (*Rewriter, error) {
+	rewriter := &Rewriter{rules: map[string][]*RewriteRule{}}
+	names := map[string]bool{}
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, err
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("%w: duplicate rule %q", ErrInvalidRewriteRule, rule.Name)
+		}
+		names[rule.Name] = true
+		rewriter.rules[rule.Phase] = append(rewriter.rules[rule.Phase], rule)
+	}
+	return rewriter, nil
+}
+
+// LoadRewriteRules returns a new Rewriter with the rules of the YAML file.
+func LoadRewriteRules(path string) (*Rewriter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rules []*RewriteRule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidRewriteRule, path, err)
+	}
+	return NewRewriter(file.Rules)
+}
+
+// Len returns the number of rules.
+func (r *Rewriter) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.rules[RewritePhaseBefore]) + len(r.rules[RewritePhaseAfter])
+}
+
+// Apply runs the rules of the phase on the simple queries and the Parse
+// messages of the request. The request is rewritten in place, or answered
+// with the response of the first matching rule that has one. Responses are
+// only sent for requests of a single simple query, with the transaction
+// status of the connection, since the client waits for an answer to each
+// message of pipelined requests.
+func (r *Rewriter) Apply(phase string, req *v1.Struct, connections *ConnectionTracker) *v1.Struct {
+	if r == nil || len(r.rules[phase]) == 0 {
+		return req
+	}
+	data := getBytesField(req, "request")
+	if _, ok := parseStartupMessage(data); ok {
+		return req
+	}
+
+	messages := splitMessages(data)
+	rewritten, consumed, changed := []byte{}, 0, false
+	for _, msg := range messages {
+		consumed += MinPgSQLMessageLength + len(msg.body)
+
+		var name, text, rest string
+		switch msg.kind {
+		case 'Q':
+			text = strings.TrimRight(string(msg.body), "\x00")
+		case 'P':
+			reader := newMessageReader(msg.body)
+			name, text = reader.readString(), reader.readString()
+			if !reader.ok {
+				rewritten = append(rewritten, newMessage(msg.kind, msg.body)...)
+				continue
+			}
+			rest = string(reader.data)
+		default:
+			rewritten = append(rewritten, newMessage(msg.kind, msg.body)...)
+			continue
+		}
+
+		newText, reply := r.run(phase, text, msg.kind == 'Q' && len(messages) == 1)
+		if reply != nil {
+			// The rules of the before phase run before the request is tracked.
+			status := connections.Replied(req, phase == RewritePhaseAfter, reply.Error != nil)
+			setResponse(req, reply.encode(newMessage('Q', msg.body), status))
+			return req
+		}
+		if newText == text {
+			rewritten = append(rewritten, newMessage(msg.kind, msg.body)...)
+			continue
+		}
+		changed = true
+		if msg.kind == 'Q' {
+			rewritten = append(rewritten, newMessage('Q', append([]byte(newText), 0))...)
+		} else {
+			rewritten = append(rewritten, newMessage('P', []byte(name+"\x00"+newText+"\x00"+rest))...)
+		}
+	}
+
+	if changed {
+		req.Fields["request"] = v1.NewBytesValue(append(rewritten, data[consumed:]...))
+	}
+	return req
+}
+
+// run runs the rules of the phase on the query, and returns the rewritten
+// query or a reply, if the query can be answered.
+func (r *Rewriter) run(phase, text string, answerable bool) (string, *Reply) {
+	query := newParsedQuery(text)
+	for _, rule := range r.rules[phase] {
+		if rule.Respond != nil && !answerable || !rule.matches(query) {
+			continue
+		}
+		RewriteRuleHits.WithLabelValues(rule.Name, phase).Inc()
+		if rule.Respond != nil {
+			return text, rule.Respond.reply()
+		}
+		if rewritten := rule.rewrite(query); rewritten != query.text {
+			query = newParsedQuery(rewritten)
+		}
+	}
+	return query.text, nil
+}
+
+// relation is a reference to a table in a query.
+type relation struct {
+	catalog, schema, name string
+	// location is the byte offset of the reference in the query.
+	location int
+}
+
+// is tells whether the relation is the table, e.g. users or public.users.
+func (r relation) is(table string) bool {
+	schema, name, qualified := strings.Cut(table, ".")
+	if !qualified {
+		return r.name == table
+	}
+	return r.schema == schema && r.name == name
+}
+
+// parts returns the number of parts of the name of the relation.
+func (r relation) parts() int {
+	parts := 1
+	if r.schema != "" {
+		parts++
+	}
+	if r.catalog != "" {
+		parts++
+	}
+	return parts
+}
+
+// parsedQuery is a query text with its parse tree, fingerprint and tokens,
+// which are computed once when needed.
+type parsedQuery struct {
+	text string
+
+	parsed bool
+	tree   map[string]interface{}
+	fp     *string
+}
+
+func newParsedQuery(text string) *parsedQuery {
+	return &parsedQuery{text: text}
+}
+
+func (q *parsedQuery) fingerprint() string {
+	if q.fp == nil {
+		fingerprint := getFingerprint(q.text)
+		q.fp = &fingerprint
+	}
+	return *q.fp
+}
+
+// parse returns the parse tree as JSON values, or nil if the query cannot be
+// parsed.
+func (q *parsedQuery) parse() map[string]interface{} {
+	if !q.parsed {
+		q.parsed = true
+		if tree, err := pgQuery.ParseToJSON(q.text); err == nil {
+			_ = json.Unmarshal([]byte(tree), &q.tree)
+		}
+	}
+	return q.tree
+}
+
+// statementNodes returns the top-level statements, keyed by node type.
+func (q *parsedQuery) statementNodes() []map[string]interface{} {
+	nodes := []map[string]interface{}{}
+	for _, stmt := range cast.ToSlice(q.parse()["stmts"]) {
+		if node, ok := cast.ToStringMap(stmt)["stmt"].(map[string]interface{}); ok {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// statements returns the kinds of the statements of the query.
+func (q *parsedQuery) statements() []string {
+	kinds := []string{}
+	for _, node := range q.statementNodes() {
+		for kind := range node {
+			kinds = append(kinds, statementKind(kind))
+		}
+	}
+	return kinds
+}
+
+// relations returns the references to tables of the query.
+func (q *parsedQuery) relations() []relation {
+	relations := []relation{}
+	walkJSON(q.parse(), func(node map[string]interface{}) {
+		// RangeVar nodes are not always wrapped, e.g. the relation of an INSERT.
+		if _, ok := node["relpersistence"]; !ok {
+			return
+		}
+		relations = append(relations, relation{
+			catalog:  cast.ToString(node["catalogname"]),
+			schema:   cast.ToString(node["schemaname"]),
+			name:     cast.ToString(node["relname"]),
+			location: cast.ToInt(node["location"]),
+		})
+	})
+	return relations
+}
+
+// tokens returns the tokens of the query, without the comments.
+func (q *parsedQuery) tokens() []token {
+	scan, err := pgQuery.Scan(q.text)
+	if err != nil {
+		return nil
+	}
+	tokens := []token{}
+	for _, scanned := range scan.GetTokens() {
+		start, end := int(scanned.GetStart()), int(scanned.GetEnd())
+		if start < 0 || end > len(q.text) || start > end {
+			return nil
+		}
+		text := q.text[start:end]
+		if strings.HasPrefix(text, "--") || strings.HasPrefix(text, "/*") {
+			continue
+		}
+		tokens = append(tokens, token{start: start, end: end, text: text})
+	}
+	return tokens
+}
+
+type token struct {
+	start, end int
+	text       string
+}
+
+// edit replaces the bytes from start to end of a query.
+type edit struct {
+	start, end int
+	text       string
+}
+
+// applyEdits returns the text with the edits, which must not overlap.
+func applyEdits(text string, edits []edit) string {
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	for _, e := range edits {
+		text = text[:e.start] + e.text + text[e.end:]
+	}
+	return text
+}
+
+// replaceTable replaces the references to a table, keeping the rest of the
+// query as is.
+func replaceTable(query *parsedQuery, replacement *TableReplacement) string {
+	tokens := query.tokens()
+	edits := []edit{}
+	for _, rel := range query.relations() {
+		if !rel.is(replacement.From) {
+			continue
+		}
+		// The name of the relation is made of its parts separated by dots.
+		index := slices.IndexFunc(tokens, func(t token) bool { return t.start == rel.location })
+		last := index + 2*(rel.parts()-1)
+		if index < 0 || last >= len(tokens) {
+			continue
+		}
+		edits = append(edits, edit{start: tokens[index].start, end: tokens[last].end, text: replacement.To})
+	}
+	return applyEdits(query.text, edits)
+}
+
+// forceLimit adds a LIMIT to a single SELECT statement without one, and
+// lowers a constant LIMIT or LIMIT ALL above the limit.
+func forceLimit(query *parsedQuery, limit int) string {
+	nodes := query.statementNodes()
+	if len(nodes) != 1 {
+		return query.text
+	}
+	selectStmt, ok := nodes[0]["SelectStmt"].(map[string]interface{})
+	if !ok || selectStmt["intoClause"] != nil {
+		return query.text
+	}
+	tokens := query.tokens()
+	value := strconv.Itoa(limit)
+
+	count, ok := selectStmt["limitCount"].(map[string]interface{})
+	if !ok {
+		// The LIMIT is added after the last token, e.g. before a comment.
+		for i := len(tokens) - 1; i >= 0; i-- {
+			if tokens[i].text != ";" {
+				return applyEdits(query.text, []edit{{start: tokens[i].end, end: tokens[i].end, text: " LIMIT " + value}})
+			}
+		}
+		return query.text
+	}
+
+	constant, ok := count["A_Const"].(map[string]interface{})
+	if !ok {
+		// Parameters and expressions are kept.
+		return query.text
+	}
+	if !cast.ToBool(constant["isnull"]) && cast.ToInt(cast.ToStringMap(constant["ival"])["ival"]) <= limit {
+		return query.text
+	}
+	location := cast.ToInt(constant["location"])
+	for _, t := range tokens {
+		if t.start == location {
+			return applyEdits(query.text, []edit{{start: t.start, end: t.end, text: value}})
+		}
+	}
+	return query.text
+}
+
+// statementKind returns the kind of a statement node, e.g. select for
+// SelectStmt.
+func statementKind(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), "stmt")
+}
+
+// walkJSON calls visit for every object of the JSON value.
+func walkJSON(value interface{}, visit func(map[string]interface{})) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		visit(value)
+		for _, child := range value {
+			walkJSON(child, visit)
+		}
+	case []interface{}:
+		for _, child := range value {
+			walkJSON(child, visit)
+		}
+	}
+}
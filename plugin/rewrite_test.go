@@ -0,0 +1,250 @@
+package plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRewriter(t *testing.T, rules string) *Rewriter {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(rules), 0o600))
+	rewriter, err := LoadRewriteRules(path)
+	require.NoError(t, err)
+	return rewriter
+}
+
+// rewriteQuery returns the query of the request rewritten by the rules.
+func rewriteQuery(t *testing.T, rewriter *Rewriter, query string) string {
+	t.Helper()
+	req := rewriter.Apply(RewritePhaseBefore, newTrafficRequest(t, newQueryMessage(query)), nil)
+	text, ok := getQuery(getBytesField(req, "request"))
+	require.True(t, ok)
+	return text
+}
+
+func TestRewriter_ReplaceTable(t *testing.T) {
+	rewriter := newTestRewriter(t, `
+rules:
+  - name: orders
+    match: { tables: [orders] }
+    replaceTable: { from: orders, to: archive.orders_v2 }
+  - name: qualified
+    match: { tables: [public.users] }
+    replaceTable: { from: public.users, to: users_v2 }
+`)
+
+	assert.Equal(t,
+		"SELECT o.id FROM archive.orders_v2 o JOIN customers ON orders = 1 WHERE o.id IN (SELECT id FROM archive.orders_v2)",
+		rewriteQuery(t, rewriter,
+			"SELECT o.id FROM orders o JOIN customers ON orders = 1 WHERE o.id IN (SELECT id FROM orders)"))
+	assert.Equal(t, "INSERT INTO archive.orders_v2 VALUES ('orders')",
+		rewriteQuery(t, rewriter, "INSERT INTO orders VALUES ('orders')"))
+	assert.Equal(t, "UPDATE users_v2 SET a = 1; SELECT * FROM users",
+		rewriteQuery(t, rewriter, "UPDATE public.users SET a = 1; SELECT * FROM users"))
+	assert.Equal(t, "SELECT * FROM customers", rewriteQuery(t, rewriter, "SELECT * FROM customers"))
+}
+
+func TestRewriter_LimitAndComment(t *testing.T) {
+	rewriter := newTestRewriter(t, `
+rules:
+  - name: limit
+    match: { statements: [SelectStmt] }
+    comment: "+ SeqScan(reports)"
+    limit: 100
+`)
+
+	for query, expected := range map[string]string{
+		"SELECT * FROM reports":                           "/*+ SeqScan(reports) */ SELECT * FROM reports LIMIT 100",
+		"SELECT * FROM reports; -- all of them":           "/*+ SeqScan(reports) */ SELECT * FROM reports LIMIT 100; -- all of them",
+		"SELECT * FROM reports LIMIT 5000":                "/*+ SeqScan(reports) */ SELECT * FROM reports LIMIT 100",
+		"SELECT * FROM reports LIMIT ALL":                 "/*+ SeqScan(reports) */ SELECT * FROM reports LIMIT 100",
+		"SELECT * FROM reports LIMIT 10":                  "/*+ SeqScan(reports) */ SELECT * FROM reports LIMIT 10",
+		"SELECT * FROM reports LIMIT $1":                  "/*+ SeqScan(reports) */ SELECT * FROM reports LIMIT $1",
+		"SELECT * FROM reports FOR UPDATE":                "/*+ SeqScan(reports) */ SELECT * FROM reports FOR UPDATE LIMIT 100",
+		"SELECT * FROM reports FETCH FIRST 500 ROWS ONLY": "/*+ SeqScan(reports) */ SELECT * FROM reports FETCH FIRST 100 ROWS ONLY",
+		"DELETE FROM reports":                             "DELETE FROM reports",
+	} {
+		assert.Equal(t, expected, rewriteQuery(t, rewriter, query), query)
+	}
+
+	// Plain comments are padded.
+	rule := &RewriteRule{Comment: "app=billing"}
+	assert.Equal(t, "/* app=billing */ SELECT 1", rule.rewrite(newParsedQuery("SELECT 1")))
+}
+
+func TestRewriter_Respond(t *testing.T) {
+	rewriter := newTestRewriter(t, `
+rules:
+  - name: health-check
+    match: { fingerprint: `+getFingerprint("SELECT 1")+` }
+    respond:
+      columns: ["?column?", "note"]
+      rows: [[1, null]]
+  - name: no-drop
+    match: { regex: '(?i)^drop ' }
+    respond:
+      error: { code: "42501", message: "DROP is not allowed" }
+`)
+
+	before := testutil.ToFloat64(RewriteRuleHits.WithLabelValues("health-check", RewritePhaseBefore))
+	req := rewriter.Apply(RewritePhaseBefore, newTrafficRequest(t, newQueryMessage("select 1")), nil)
+	assert.True(t, isTerminated(req))
+	one := "1"
+	assert.Equal(t, concat(
+		newRowDescription(textColumns([]string{"?column?", "note"})),
+		newDataRow([]*string{&one, nil}),
+		newCommandComplete("SELECT 1"),
+		newReadyForQuery('I'),
+	), getBytesField(req, "response"))
+	assert.InDelta(t, before+1, testutil.ToFloat64(RewriteRuleHits.WithLabelValues("health-check", RewritePhaseBefore)), 0)
+
+	req = rewriter.Apply(RewritePhaseBefore, newTrafficRequest(t, newQueryMessage("DROP TABLE users")), nil)
+	assert.Equal(t,
+		concat(newErrorResponse("ERROR", "42501", "DROP is not allowed"), newReadyForQuery('I')),
+		getBytesField(req, "response"))
+
+	// Pipelined queries are not answered, since the response would only
+	// answer one of them.
+	pipelined := concat(newQueryMessage("SELECT 2"), newQueryMessage("select 1"), newQueryMessage("DROP TABLE users"))
+	req = rewriter.Apply(RewritePhaseBefore, newTrafficRequest(t, pipelined), nil)
+	assert.False(t, isTerminated(req))
+	assert.Equal(t, pipelined, getBytesField(req, "request"))
+
+	// Only simple queries are answered, and rules of other phases are not run.
+	req = rewriter.Apply(RewritePhaseBefore, newTrafficRequest(t, newParseMessage("", "SELECT 1")), nil)
+	assert.False(t, isTerminated(req))
+	req = rewriter.Apply(RewritePhaseAfter, newTrafficRequest(t, newQueryMessage("SELECT 1")), nil)
+	assert.False(t, isTerminated(req))
+}
+
+func TestRewriter_ExtendedQuery(t *testing.T) {
+	rewriter := newTestRewriter(t, `
+rules:
+  - name: users
+    match: { tables: [users] }
+    replaceTable: { from: users, to: people }
+`)
+
+	request := concat(
+		newParseMessage("s1", "SELECT * FROM users WHERE id = $1"),
+		newBindMessage("", "s1", nil, []byte("1")),
+		newExecuteMessage(""),
+		newFrontendMessage('S'),
+		[]byte{'X', 0})
+	req := rewriter.Apply(RewritePhaseBefore, newTrafficRequest(t, request), nil)
+
+	// The other messages and incomplete data are kept.
+	assert.Equal(t, concat(
+		newParseMessage("s1", "SELECT * FROM people WHERE id = $1"),
+		newBindMessage("", "s1", nil, []byte("1")),
+		newExecuteMessage(""),
+		newFrontendMessage('S'),
+		[]byte{'X', 0}), getBytesField(req, "request"))
+
+	var nilRewriter *Rewriter
+	assert.Equal(t, 0, nilRewriter.Len())
+	req = newTrafficRequest(t, newQueryMessage("SELECT * FROM users"))
+	assert.Equal(t, req, nilRewriter.Apply(RewritePhaseBefore, req, nil))
+}
+
+func TestNewRewriter_Invalid(t *testing.T) {
+	for name, rule := range map[string]*RewriteRule{
+		"name":      {Match: RewriteMatch{Regex: "x"}, Limit: 1},
+		"phase":     {Name: "r", Phase: "during", Match: RewriteMatch{Regex: "x"}, Limit: 1},
+		"match":     {Name: "r", Limit: 1},
+		"regex":     {Name: "r", Match: RewriteMatch{Regex: "("}, Limit: 1},
+		"action":    {Name: "r", Match: RewriteMatch{Regex: "x"}},
+		"both":      {Name: "r", Match: RewriteMatch{Regex: "x"}, Limit: 1, Respond: &SyntheticResponse{}},
+		"table":     {Name: "r", Match: RewriteMatch{Regex: "x"}, ReplaceTable: &TableReplacement{From: "a"}},
+		"comment":   {Name: "r", Match: RewriteMatch{Regex: "x"}, Comment: "*/ DROP"},
+		"limit":     {Name: "r", Match: RewriteMatch{Regex: "x"}, Limit: -1},
+		"code":      {Name: "r", Match: RewriteMatch{Regex: "x"}, Respond: &SyntheticResponse{Error: &SyntheticError{}}},
+		"row width": {Name: "r", Match: RewriteMatch{Regex: "x"}, Respond: &SyntheticResponse{Columns: []string{"a"}, Rows: [][]*string{{}}}},
+	} {
+		_, err := NewRewriter([]*RewriteRule{rule})
+		require.ErrorIs(t, err, ErrInvalidRewriteRule, name)
+	}
+
+	_, err := NewRewriter([]*RewriteRule{
+		{Name: "r", Match: RewriteMatch{Regex: "x"}, Limit: 1},
+		{Name: "r", Match: RewriteMatch{Regex: "y"}, Limit: 1},
+	})
+	require.ErrorIs(t, err, ErrInvalidRewriteRule)
+}
+
+func TestPlugin_OnTrafficFromClientRewrite(t *testing.T) {
+	p := newTestPlugin(t)
+	p.Connections = NewConnectionTracker()
+	p.Rewriter = newTestRewriter(t, `
+rules:
+  - name: health-check
+    match: { regex: '^SELECT 1$' }
+    respond: { columns: [ok], rows: [["t"]] }
+  - name: users
+    match: { tables: [users] }
+    replaceTable: { from: users, to: people }
+  - name: limit
+    phase: after
+    match: { statements: [select] }
+    limit: 10
+`)
+	require.NoError(t, p.VM.Set("Value", p.VM.ToValue(v1.NewValue)))
+	_, err := p.VM.RunString(`function onTrafficFromClient(ctx, req) {
+		req.Fields["seen"] = Value(ctx.query.text);
+		return req;
+	}`)
+	require.NoError(t, err)
+	p.RegisterFunction("onTrafficFromClient")
+
+	// The JS function sees the query rewritten by the before rules, and the
+	// after rules rewrite the request it returns.
+	result, err := p.OnTrafficFromClient(context.Background(),
+		newTrafficRequest(t, newQueryMessage("SELECT * FROM users")))
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT * FROM people", result.AsMap()["seen"])
+	text, _ := getQuery(getBytesField(result, "request"))
+	assert.Equal(t, "SELECT * FROM people LIMIT 10", text)
+
+	// Answered queries do not reach the JS function.
+	result, err = p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, newQueryMessage("SELECT 1")))
+	require.NoError(t, err)
+	assert.True(t, isTerminated(result))
+	assert.Nil(t, result.AsMap()["seen"])
+}
+
+func TestPlugin_RewriteErrorInTransaction(t *testing.T) {
+	p := newTestPlugin(t)
+	p.Connections = NewConnectionTracker()
+	p.Rewriter = newTestRewriter(t, `
+rules:
+  - name: no-drop
+    match: { regex: '(?i)^drop ' }
+    respond:
+      error: { code: "42501", message: "DROP is not allowed" }
+`)
+
+	_, err := p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, newQueryMessage("BEGIN")))
+	require.NoError(t, err)
+	_, err = p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, newQueryMessage("UPDATE t SET a = 1")))
+	require.NoError(t, err)
+
+	// The error fails the open transaction, which the request did not end.
+	req := newTrafficRequest(t, newQueryMessage("DROP TABLE users"))
+	result, err := p.OnTrafficFromClient(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t,
+		concat(newErrorResponse("ERROR", "42501", "DROP is not allowed"), newReadyForQuery('E')),
+		getBytesField(result, "response"))
+	info := p.Connections.Info(req)
+	require.NotNil(t, info)
+	assert.Equal(t, TransactionStatusFailed, info.Transaction.Status)
+	assert.Equal(t, 1, info.Transaction.Statements)
+}
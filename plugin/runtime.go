@@ -0,0 +1,214 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/spf13/cast"
+)
+
+var (
+	ErrMemoryLimitExceeded = errors.New("JS runtime exceeded the heap growth limit")
+	ErrValueTooLarge       = errors.New("JS value exceeds the size limit")
+)
+
+type ResourceLimits struct {
+	// MaxCallStackSize is the maximum depth of JS function calls.
+	MaxCallStackSize int
+	// MaxHeapGrowth is the number of bytes the heap can grow by while a JS
+	// function runs. The heap is shared by the whole plugin, so this is an
+	// upper bound of the memory allocated by the function.
+	MaxHeapGrowth uint64
+	// MaxValueSize is the maximum size in bytes of the strings and bytes, and
+	// MaxArrayLength the maximum length of the arrays, of the requests returned
+	// by JS functions. Values that stay inside the VM are not checked.
+	MaxValueSize   int
+	MaxArrayLength int
+	// CheckInterval is the interval of the heap checks.
+	CheckInterval time.Duration
+}
+
+// NewResourceLimits returns new ResourceLimits from the plugin config. A
+// limit of zero disables it, which is the default.
+func NewResourceLimits(config map[string]interface{}) *ResourceLimits {
+	limits := ResourceLimits{
+		MaxCallStackSize: cast.ToInt(config["runtimeMaxCallStackSize"]),
+		MaxHeapGrowth:    cast.ToUint64(config["runtimeMaxHeapGrowth"]) * 1024 * 1024,
+		MaxValueSize:     cast.ToInt(config["runtimeMaxValueSize"]),
+		MaxArrayLength:   cast.ToInt(config["runtimeMaxArrayLength"]),
+		CheckInterval:    cast.ToDuration(config["runtimeCheckInterval"]),
+	}
+	if limits.CheckInterval <= 0 {
+		limits.CheckInterval = 10 * time.Millisecond
+	}
+	return &limits
+}
+
+// apply sets the limits enforced by the VM itself.
+func (l *ResourceLimits) apply(vm *goja.Runtime) {
+	if l != nil && l.MaxCallStackSize > 0 {
+		vm.SetMaxCallStackSize(l.MaxCallStackSize)
+	}
+}
+
+// CheckValue checks the sizes of the strings, bytes and arrays of the
+// request returned by a JS function. It only sees the returned request, not
+// the values the function built along the way.
+func (l *ResourceLimits) CheckValue(req *v1.Struct) error {
+	if l == nil || req == nil {
+		return nil
+	}
+	for _, value := range req.GetFields() {
+		if err := l.checkValue(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *ResourceLimits) checkValue(value *v1.Value) error {
+	switch kind := value.GetKind().(type) {
+	case *v1.Value_StringValue:
+		if l.MaxValueSize > 0 && len(kind.StringValue) > l.MaxValueSize {
+			return fmt.Errorf("%w: string of %d bytes", ErrValueTooLarge, len(kind.StringValue))
+		}
+	case *v1.Value_BytesValue:
+		if l.MaxValueSize > 0 && len(kind.BytesValue) > l.MaxValueSize {
+			return fmt.Errorf("%w: %d bytes", ErrValueTooLarge, len(kind.BytesValue))
+		}
+	case *v1.Value_ListValue:
+		if l.MaxArrayLength > 0 && len(kind.ListValue.GetValues()) > l.MaxArrayLength {
+			return fmt.Errorf("%w: array of %d elements", ErrValueTooLarge, len(kind.ListValue.GetValues()))
+		}
+		for _, item := range kind.ListValue.GetValues() {
+			if err := l.checkValue(item); err != nil {
+				return err
+			}
+		}
+	case *v1.Value_StructValue:
+		return l.CheckValue(kind.StructValue)
+	}
+	return nil
+}
+
+// heapObjectsBytes returns the bytes of the heap occupied by objects, which
+// can be read without stopping the world.
+func heapObjectsBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// watchHeap interrupts the VM if the heap grows by more than the limit until
+// the returned function is called. The VM lock must be held by the caller.
+func (p *Plugin) watchHeap() func() {
+	if p.Limits == nil || p.Limits.MaxHeapGrowth == 0 {
+		return func() {}
+	}
+
+	vm := p.VM
+	start := heapObjectsBytes()
+	done := make(chan struct{})
+	var mu sync.Mutex
+	var finished bool
+
+	go func() {
+		ticker := time.NewTicker(p.Limits.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if current := heapObjectsBytes(); current > start && current-start > p.Limits.MaxHeapGrowth {
+					mu.Lock()
+					if !finished {
+						vm.Interrupt(ErrMemoryLimitExceeded)
+					}
+					mu.Unlock()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		mu.Lock()
+		finished = true
+		mu.Unlock()
+		vm.ClearInterrupt()
+	}
+}
+
+// limitExceeded returns the limit the error is caused by, if any.
+func limitExceeded(err error) (string, bool) {
+	var stackOverflow *goja.StackOverflowError
+	switch {
+	case errors.Is(err, ErrMemoryLimitExceeded):
+		return "heap", true
+	case errors.As(err, &stackOverflow):
+		return "call_stack", true
+	case errors.Is(err, ErrValueTooLarge):
+		return "value_size", true
+	default:
+		return "", false
+	}
+}
+
+// ResetRuntime replaces the VM with a new one, which is set up by Setup.
+// The listeners, bindings and scheduled jobs of the previous VM are dropped.
+// If Setup fails, the previous VM is kept along with its listeners, bindings
+// and jobs. The VM lock must be held by the caller once the plugin is served.
+func (p *Plugin) ResetRuntime() error {
+	vm := goja.New()
+	p.Limits.apply(vm)
+
+	previousVM, bindings, listeners, listenerSeq := p.VM, p.Bindings, p.Listeners, p.listenerSeq
+	jobs := p.Scheduler.swapJobs(map[string]*Job{})
+	p.VM = vm
+	p.Bindings = map[string]goja.Callable{}
+	p.Listeners = nil
+	p.listenerSeq = 0
+
+	if p.Setup == nil {
+		return nil
+	}
+	start := time.Now()
+	if err := p.Setup(vm); err != nil {
+		p.VM, p.Bindings, p.Listeners, p.listenerSeq = previousVM, bindings, listeners, listenerSeq
+		p.Scheduler.swapJobs(jobs)
+		if previousVM != nil {
+			previousVM.ClearInterrupt()
+		}
+		return err
+	}
+	RuntimeInstantiateDuration.Observe(time.Since(start).Seconds())
+	return nil
+}
+
+// recycle replaces a VM that exceeded a limit, so that a runaway script
+// cannot take down the plugin. The VM lock must be held by the caller.
+func (p *Plugin) recycle(err error) {
+	reason, ok := limitExceeded(err)
+	if !ok {
+		return
+	}
+
+	RuntimeLimitExceeded.WithLabelValues(reason).Inc()
+	p.Logger.Warn("Recycling JS runtime, because it exceeded a limit", "limit", reason, "err", err)
+	if err := p.ResetRuntime(); err != nil {
+		RuntimeRecycleFailures.Inc()
+		p.Logger.Error("Failed to recycle JS runtime, keeping the previous one", "err", err)
+		return
+	}
+	RuntimeRecycles.Inc()
+}
@@ -0,0 +1,193 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dop251/goja"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newLimitedPlugin returns a plugin whose setup counts the runtimes it creates.
+func newLimitedPlugin(t *testing.T, limits map[string]interface{}, script string) (*Plugin, *int) {
+	t.Helper()
+	p := newTestPlugin(t)
+	p.Limits = NewResourceLimits(limits)
+	setups := 0
+	p.Setup = func(vm *goja.Runtime) error {
+		setups++
+		if err := vm.Set("Value", NewValue); err != nil {
+			return err
+		}
+		if _, err := vm.RunString(script); err != nil {
+			return err
+		}
+		p.RegisterFunctions([]string{"onTrafficFromClient"})
+		return nil
+	}
+	require.NoError(t, p.ResetRuntime())
+	return p, &setups
+}
+
+func mustNewValue(t *testing.T, value interface{}) *v1.Value {
+	t.Helper()
+	result, err := v1.NewValue(value)
+	require.NoError(t, err)
+	return result
+}
+
+func TestNewResourceLimits(t *testing.T) {
+	limits := NewResourceLimits(map[string]interface{}{
+		"runtimeMaxCallStackSize": "100",
+		"runtimeMaxHeapGrowth":    "64",
+		"runtimeMaxValueSize":     "1024",
+		"runtimeMaxArrayLength":   "10",
+	})
+	assert.Equal(t, 100, limits.MaxCallStackSize)
+	assert.Equal(t, uint64(64*1024*1024), limits.MaxHeapGrowth)
+	assert.Equal(t, 1024, limits.MaxValueSize)
+	assert.Equal(t, 10, limits.MaxArrayLength)
+	assert.Equal(t, 10*time.Millisecond, limits.CheckInterval)
+
+	// The limits are disabled unless configured.
+	config, _ := PluginConfig["config"].(map[string]interface{})
+	defaults := NewResourceLimits(config)
+	assert.Zero(t, defaults.MaxCallStackSize)
+	assert.Zero(t, defaults.MaxHeapGrowth)
+	assert.Zero(t, defaults.MaxValueSize)
+	assert.Zero(t, defaults.MaxArrayLength)
+}
+
+func TestRunFunction_CallStackLimit(t *testing.T) {
+	p, setups := newLimitedPlugin(t, map[string]interface{}{"runtimeMaxCallStackSize": "50"}, `
+		var calls = 0;
+		function recurse(n) { return recurse(n + 1); }
+		function onTrafficFromClient(ctx, req) {
+			calls++;
+			if (req.Fields.recurse) { recurse(0); }
+			return req;
+		}
+	`)
+	recycles := testutil.ToFloat64(RuntimeRecycles)
+	exceeded := testutil.ToFloat64(RuntimeLimitExceeded.WithLabelValues("call_stack"))
+
+	_, err := p.RunFunction(context.Background(), "onTrafficFromClient", newTestRequest(t))
+	require.NoError(t, err)
+
+	req := newTestRequest(t)
+	req.Fields["recurse"] = mustNewValue(t, true)
+	_, err = p.RunFunction(context.Background(), "onTrafficFromClient", req)
+	var stackOverflow *goja.StackOverflowError
+	require.ErrorAs(t, err, &stackOverflow)
+
+	assert.Equal(t, 2, *setups)
+	assert.InDelta(t, recycles+1, testutil.ToFloat64(RuntimeRecycles), 0)
+	assert.InDelta(t, exceeded+1, testutil.ToFloat64(RuntimeLimitExceeded.WithLabelValues("call_stack")), 0)
+
+	// The new runtime starts from a clean state and keeps serving hooks.
+	value, err := p.VM.RunString(`calls`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), value.ToInteger())
+	_, err = p.RunFunction(context.Background(), "onTrafficFromClient", newTestRequest(t))
+	require.NoError(t, err)
+}
+
+func TestRunFunction_RecycleSetupFailure(t *testing.T) {
+	p, setups := newLimitedPlugin(t, map[string]interface{}{"runtimeMaxCallStackSize": "50"}, `
+		var calls = 0;
+		function recurse(n) { return recurse(n + 1); }
+		function onTrafficFromClient(ctx, req) {
+			calls++;
+			if (req.Fields.recurse) { recurse(0); }
+			return req;
+		}
+	`)
+	setup := p.Setup
+	p.Setup = func(vm *goja.Runtime) error {
+		if err := setup(vm); err != nil {
+			return err
+		}
+		return errors.New("setup failed")
+	}
+	vm := p.VM
+	failures := testutil.ToFloat64(RuntimeRecycleFailures)
+
+	req := newTestRequest(t)
+	req.Fields["recurse"] = mustNewValue(t, true)
+	_, err := p.RunFunction(context.Background(), "onTrafficFromClient", req)
+	var stackOverflow *goja.StackOverflowError
+	require.ErrorAs(t, err, &stackOverflow)
+	assert.Equal(t, 2, *setups)
+	assert.InDelta(t, failures+1, testutil.ToFloat64(RuntimeRecycleFailures), 0)
+
+	// The previous runtime is kept with its bindings and keeps serving hooks.
+	assert.Same(t, vm, p.VM)
+	assert.Contains(t, p.Bindings, "onTrafficFromClient")
+	_, err = p.RunFunction(context.Background(), "onTrafficFromClient", newTestRequest(t))
+	require.NoError(t, err)
+	value, err := p.VM.RunString(`calls`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), value.ToInteger())
+}
+
+func TestRunFunction_HeapLimit(t *testing.T) {
+	p, setups := newLimitedPlugin(t, map[string]interface{}{
+		"runtimeMaxHeapGrowth": "32",
+		"runtimeCheckInterval": "1ms",
+	}, `
+		function onTrafficFromClient(ctx, req) {
+			const hoard = [];
+			while (true) { hoard.push(new Array(1024).fill("x")); }
+		}
+	`)
+
+	_, err := p.RunFunction(context.Background(), "onTrafficFromClient", newTestRequest(t))
+	require.ErrorIs(t, err, ErrMemoryLimitExceeded)
+	assert.Equal(t, 2, *setups)
+}
+
+func TestRunFunction_ValueLimit(t *testing.T) {
+	p, setups := newLimitedPlugin(t, map[string]interface{}{
+		"runtimeMaxValueSize":   "16",
+		"runtimeMaxArrayLength": "3",
+	}, `
+		function onTrafficFromClient(ctx, req) {
+			if (req.Fields.size) {
+				req.Fields.key = Value("x".repeat(req.Fields.size.GetNumberValue()));
+			}
+			return req;
+		}
+	`)
+
+	req := newTestRequest(t)
+	req.Fields["size"] = mustNewValue(t, 8)
+	_, err := p.RunFunction(context.Background(), "onTrafficFromClient", req)
+	require.NoError(t, err)
+
+	req.Fields["size"] = mustNewValue(t, 32)
+	_, err = p.RunFunction(context.Background(), "onTrafficFromClient", req)
+	require.ErrorIs(t, err, ErrValueTooLarge)
+	assert.Equal(t, 2, *setups)
+
+	req = newTestRequest(t)
+	req.Fields["list"] = mustNewValue(t, []interface{}{1, 2, 3, 4})
+	require.ErrorIs(t, p.Limits.CheckValue(req), ErrValueTooLarge)
+}
+
+func TestScheduler_JobsDroppedOnRecycle(t *testing.T) {
+	p, scheduler := newTestScheduler(t, `
+		var runs = 0;
+		scheduler.every("1ms", function() { runs++; });
+	`)
+	time.Sleep(5 * time.Millisecond)
+	scheduler.Dispatch(time.Now())
+	scheduler.Stop()
+
+	require.NoError(t, p.ResetRuntime())
+	assert.False(t, scheduler.HasJobs())
+}
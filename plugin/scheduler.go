@@ -0,0 +1,370 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/spf13/cast"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	ErrJobTimeout   = errors.New("job timed out")
+	ErrDuplicateJob = errors.New("job already exists")
+)
+
+type SchedulerConfig struct {
+	// UseOnTick dispatches the jobs from the onTick hook of GatewayD
+	// instead of the timer of the plugin.
+	UseOnTick  bool
+	Resolution time.Duration
+	JobTimeout time.Duration
+}
+
+// NewSchedulerConfig returns a new SchedulerConfig from the plugin config.
+func NewSchedulerConfig(config map[string]interface{}) *SchedulerConfig {
+	schedulerConfig := SchedulerConfig{
+		UseOnTick:  cast.ToBool(config["schedulerUseOnTick"]),
+		Resolution: cast.ToDuration(config["schedulerResolution"]),
+		JobTimeout: cast.ToDuration(config["schedulerJobTimeout"]),
+	}
+	if schedulerConfig.Resolution <= 0 {
+		schedulerConfig.Resolution = time.Second
+	}
+	if schedulerConfig.JobTimeout <= 0 {
+		schedulerConfig.JobTimeout = 30 * time.Second
+	}
+	return &schedulerConfig
+}
+
+// Job is a JS function run periodically by the scheduler.
+type Job struct {
+	Name     string
+	Schedule string
+	Timeout  time.Duration
+
+	callable goja.Callable
+	interval time.Duration
+	cron     *cronSchedule
+	next     time.Time
+	running  bool
+}
+
+func (j *Job) scheduleNext(now time.Time) {
+	if j.cron != nil {
+		j.next = j.cron.next(now)
+	} else {
+		j.next = now.Add(j.interval)
+	}
+}
+
+// Scheduler runs the jobs registered by scripts via scheduler.every and
+// scheduler.cron. A job is skipped if its previous run has not finished.
+type Scheduler struct {
+	config *SchedulerConfig
+	plugin *Plugin
+	jobs   map[string]*Job
+	seq    int
+	mu     sync.Mutex
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewScheduler returns a new Scheduler that runs the jobs in the VM of the plugin.
+func NewScheduler(config *SchedulerConfig, plugin *Plugin) *Scheduler {
+	return &Scheduler{
+		config: config,
+		plugin: plugin,
+		jobs:   map[string]*Job{},
+	}
+}
+
+// Add registers a job with either an interval, such as 5m, or a cron
+// expression. An empty name is replaced with a generated one.
+func (s *Scheduler) Add(job *Job, cronExpression string) error {
+	if cronExpression != "" {
+		schedule, err := parseCron(cronExpression)
+		if err != nil {
+			return err
+		}
+		job.cron = schedule
+		job.Schedule = cronExpression
+	} else if job.interval <= 0 {
+		return fmt.Errorf("%w: the interval must be positive", ErrInvalidCronExpression)
+	} else {
+		job.Schedule = "every " + job.interval.String()
+	}
+	if job.Timeout <= 0 {
+		job.Timeout = s.config.JobTimeout
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job.Name == "" {
+		s.seq++
+		job.Name = "job-" + strconv.Itoa(s.seq)
+	}
+	if _, exists := s.jobs[job.Name]; exists {
+		return fmt.Errorf("%w: %q", ErrDuplicateJob, job.Name)
+	}
+	job.scheduleNext(time.Now())
+	s.jobs[job.Name] = job
+	return nil
+}
+
+// Remove unregisters a job. It returns false if the job does not exist.
+func (s *Scheduler) Remove(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, exists := s.jobs[name]
+	delete(s.jobs, name)
+	return exists
+}
+
+// swapJobs replaces the jobs and returns the previous ones, such as while
+// the runtime is replaced.
+func (s *Scheduler) swapJobs(jobs map[string]*Job) map[string]*Job {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.jobs
+	s.jobs = jobs
+	return previous
+}
+
+// HasJobs tells whether any job is registered.
+func (s *Scheduler) HasJobs() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.jobs) > 0
+}
+
+// Dispatch starts the jobs that are due. Jobs run in their own goroutine, so
+// that the caller, such as the onTick hook, is not blocked.
+func (s *Scheduler) Dispatch(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, job := range s.jobs {
+		if job.next.IsZero() || now.Before(job.next) {
+			continue
+		}
+		job.scheduleNext(now)
+
+		if job.running {
+			SchedulerJobsSkipped.WithLabelValues(job.Name).Inc()
+			s.plugin.Logger.Debug("Skipping job, because it is still running", "job", job.Name)
+			continue
+		}
+		job.running = true
+
+		s.wg.Add(1)
+		go func(job *Job) {
+			defer s.wg.Done()
+			s.run(job)
+			s.mu.Lock()
+			job.running = false
+			s.mu.Unlock()
+		}(job)
+	}
+}
+
+// OnTick dispatches the due jobs if the scheduler is driven by the onTick hook.
+func (s *Scheduler) OnTick() {
+	if s == nil || !s.config.UseOnTick {
+		return
+	}
+	s.Dispatch(time.Now())
+}
+
+// run runs the job while holding the VM lock. The VM is interrupted if the
+// job runs longer than its timeout.
+func (s *Scheduler) run(job *Job) {
+	p := s.plugin
+	ctx, cancel := context.WithTimeout(context.Background(), job.Timeout)
+	defer cancel()
+	ctx, span := p.Tracing.Start(ctx, "scheduler.job", attribute.String("gatewayd.js.job", job.Name))
+
+	p.Mu.Lock()
+	defer p.Mu.Unlock()
+
+	// The job is dropped if the runtime was recycled while it was waiting.
+	s.mu.Lock()
+	registered := s.jobs[job.Name] == job
+	s.mu.Unlock()
+	if !registered {
+		return
+	}
+
+	// While the job waits for fetch without the VM lock, the timeout of the
+	// job ends the request instead of interrupting the VM.
+	loop := newEventLoop()
+	defer loop.close()
+	vm := p.VM
+	var finished bool
+	var interruptMu sync.Mutex
+	timer := time.AfterFunc(job.Timeout, func() {
+		interruptMu.Lock()
+		defer interruptMu.Unlock()
+		if !finished {
+			loop.interrupt(vm, ErrJobTimeout)
+		}
+	})
+
+	p.hookCtx, p.hookLoop = ctx, loop
+	jobContext := p.newHookContext(ctx, "onTick", nil)
+	setProperty(jobContext, "job", job.Name)
+
+	start := time.Now()
+	stopWatching := p.watchHeap()
+	value, err := job.callable(goja.Undefined(), jobContext)
+	stopWatching()
+	if err == nil {
+		_, err = p.settle(value, loop)
+	}
+
+	timer.Stop()
+	interruptMu.Lock()
+	finished = true
+	vm.ClearInterrupt()
+	interruptMu.Unlock()
+	p.hookCtx, p.hookLoop = nil, nil
+
+	endSpan(span, err)
+	SchedulerJobDuration.WithLabelValues(job.Name).Observe(time.Since(start).Seconds())
+	SchedulerJobRuns.WithLabelValues(job.Name).Inc()
+
+	if err != nil {
+		reason := "error"
+		var interrupted *goja.InterruptedError
+		if errors.As(err, &interrupted) {
+			reason = "timeout"
+		}
+		SchedulerJobFailures.WithLabelValues(job.Name, reason).Inc()
+		p.Logger.Error("Job failed", "job", job.Name, "reason", reason, "err", err)
+		p.Reporter.CaptureException("onTick", nil, fmt.Errorf("job %q: %w", job.Name, err))
+		p.recycle(err)
+	}
+}
+
+// Start runs the timer of the scheduler, unless it is driven by the onTick hook.
+func (s *Scheduler) Start() {
+	if s == nil || s.config.UseOnTick || s.stop != nil {
+		return
+	}
+
+	s.stop = make(chan struct{})
+	ticker := time.NewTicker(s.config.Resolution)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				s.Dispatch(now)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the timer and waits for the running jobs to finish.
+func (s *Scheduler) Stop() {
+	if s == nil {
+		return
+	}
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.wg.Wait()
+}
+
+// Register exposes the scheduler object to JS:
+//
+//	scheduler.every("5m", fn, { name: "flush", timeout: 10000 })
+//	scheduler.cron("*/5 * * * *", fn, { name: "refresh" })
+//	scheduler.cancel("flush")
+//	scheduler.jobs()
+//
+// The timeout is in milliseconds. Job functions receive a context object
+// like hook functions, with the name of the job in ctx.job.
+func (s *Scheduler) Register(runtime *goja.Runtime) error {
+	newJob := func(call goja.FunctionCall, function string) *Job {
+		callable, ok := goja.AssertFunction(call.Argument(1))
+		if !ok {
+			panic(runtime.NewTypeError("%s requires a function as the second argument", function))
+		}
+		job := &Job{callable: callable}
+		if options := call.Argument(2); !goja.IsUndefined(options) && !goja.IsNull(options) {
+			object := options.ToObject(runtime)
+			if name := object.Get("name"); name != nil && !goja.IsUndefined(name) {
+				job.Name = name.String()
+			}
+			if timeout := object.Get("timeout"); timeout != nil && !goja.IsUndefined(timeout) {
+				job.Timeout = time.Duration(timeout.ToInteger()) * time.Millisecond
+			}
+		}
+		return job
+	}
+	add := func(job *Job, cronExpression, function string) goja.Value {
+		if s == nil {
+			panic(runtime.NewTypeError("%s: the scheduler is disabled", function))
+		}
+		if err := s.Add(job, cronExpression); err != nil {
+			panic(runtime.NewTypeError("%s: %s", function, err))
+		}
+		return runtime.ToValue(job.Name)
+	}
+
+	scheduler := runtime.NewObject()
+	setProperty(scheduler, "every", func(call goja.FunctionCall) goja.Value {
+		job := newJob(call, "scheduler.every")
+		interval, err := time.ParseDuration(call.Argument(0).String())
+		if err != nil {
+			panic(runtime.NewTypeError("scheduler.every: %s", err))
+		}
+		job.interval = interval
+		return add(job, "", "scheduler.every")
+	})
+	setProperty(scheduler, "cron", func(call goja.FunctionCall) goja.Value {
+		return add(newJob(call, "scheduler.cron"), call.Argument(0).String(), "scheduler.cron")
+	})
+	setProperty(scheduler, "cancel", func(name string) bool {
+		return s != nil && s.Remove(name)
+	})
+	setProperty(scheduler, "jobs", func() []map[string]interface{} {
+		jobs := []map[string]interface{}{}
+		if s == nil {
+			return jobs
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, job := range s.jobs {
+			jobs = append(jobs, map[string]interface{}{
+				"name":     job.Name,
+				"schedule": job.Schedule,
+				"next":     job.next.UnixMilli(),
+				"running":  job.running,
+			})
+		}
+		sort.Slice(jobs, func(i, j int) bool {
+			return jobs[i]["name"].(string) < jobs[j]["name"].(string) //nolint:forcetypeassert
+		})
+		return jobs
+	})
+
+	return runtime.Set("scheduler", scheduler)
+}
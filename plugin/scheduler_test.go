@@ -0,0 +1,127 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCron(t *testing.T) {
+	base := time.Date(2024, time.January, 15, 10, 7, 30, 0, time.UTC) // Monday
+	tests := []struct {
+		expression string
+		next       time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.January, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/5 * * * *", time.Date(2024, time.January, 15, 10, 10, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2024, time.January, 15, 13, 0, 0, 0, time.UTC)},
+		{"30 2 1 * *", time.Date(2024, time.February, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2024, time.January, 21, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, time.January, 21, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 3", time.Date(2024, time.January, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, time.January, 15, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.January, 16, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		schedule, err := parseCron(test.expression)
+		require.NoError(t, err, test.expression)
+		assert.Equal(t, test.next, schedule.next(base), test.expression)
+	}
+
+	for _, expression := range []string{"* * * *", "60 * * * *", "* * * * 8", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		_, err := parseCron(expression)
+		require.ErrorIs(t, err, ErrInvalidCronExpression, expression)
+	}
+
+	schedule, err := parseCron("0 0 30 2 *")
+	require.NoError(t, err)
+	assert.True(t, schedule.next(base).IsZero())
+}
+
+func newTestScheduler(t *testing.T, script string) (*Plugin, *Scheduler) {
+	t.Helper()
+	p := newTestPlugin(t)
+	scheduler := NewScheduler(NewSchedulerConfig(map[string]interface{}{
+		"schedulerUseOnTick":  "true",
+		"schedulerJobTimeout": "100ms",
+	}), p)
+	p.Scheduler = scheduler
+	require.NoError(t, scheduler.Register(p.VM))
+	_, err := p.VM.RunString(script)
+	require.NoError(t, err)
+	return p, scheduler
+}
+
+func TestScheduler_Register(t *testing.T) {
+	p, scheduler := newTestScheduler(t, `
+		var runs = [];
+		scheduler.every("1m", function(ctx) { runs.push(ctx.job); }, { name: "flush" });
+		scheduler.cron("*/5 * * * *", function(ctx) { runs.push(ctx.job); });
+	`)
+
+	value, err := p.VM.RunString(`scheduler.jobs().map((job) => job.name + ":" + job.schedule).join()`)
+	require.NoError(t, err)
+	assert.Equal(t, "flush:every 1m0s,job-1:*/5 * * * *", value.String())
+
+	_, err = p.VM.RunString(`scheduler.every("1m", function() {}, { name: "flush" })`)
+	require.Error(t, err)
+	_, err = p.VM.RunString(`scheduler.every("soon", function() {})`)
+	require.Error(t, err)
+	_, err = p.VM.RunString(`scheduler.cron("* *", function() {})`)
+	require.Error(t, err)
+
+	assert.Contains(t, p.GetHooks(), int32(Hooks["onTick"]), "onTick drives the scheduler")
+
+	scheduler.Dispatch(time.Now().Add(10 * time.Minute))
+	scheduler.Stop()
+	value, err = p.VM.RunString(`runs.sort().join()`)
+	require.NoError(t, err)
+	assert.Equal(t, "flush,job-1", value.String())
+
+	value, err = p.VM.RunString(`scheduler.cancel("flush") && !scheduler.cancel("flush") && scheduler.jobs().length`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), value.ToInteger())
+}
+
+func TestScheduler_OnTick(t *testing.T) {
+	p, scheduler := newTestScheduler(t, `
+		var count = 0;
+		scheduler.every("1ms", function() { count++; });
+	`)
+	time.Sleep(5 * time.Millisecond)
+
+	_, err := p.OnTick(context.Background(), newTestRequest(t))
+	require.NoError(t, err)
+	scheduler.Stop()
+
+	value, err := p.VM.RunString(`count`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), value.ToInteger())
+}
+
+func TestScheduler_TimeoutAndOverlap(t *testing.T) {
+	p, scheduler := newTestScheduler(t, `
+		scheduler.every("1ms", function() { while (true) {} }, { name: "busy" });
+	`)
+	time.Sleep(5 * time.Millisecond)
+
+	failures := testutil.ToFloat64(SchedulerJobFailures.WithLabelValues("busy", "timeout"))
+	skipped := testutil.ToFloat64(SchedulerJobsSkipped.WithLabelValues("busy"))
+
+	scheduler.Dispatch(time.Now())
+	scheduler.Dispatch(time.Now().Add(time.Second))
+	scheduler.Stop()
+
+	assert.InDelta(t, failures+1, testutil.ToFloat64(SchedulerJobFailures.WithLabelValues("busy", "timeout")), 0)
+	assert.InDelta(t, skipped+1, testutil.ToFloat64(SchedulerJobsSkipped.WithLabelValues("busy")), 0)
+
+	// The VM is usable again after the interrupt.
+	value, err := p.VM.RunString(`1 + 1`)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), value.ToInteger())
+}
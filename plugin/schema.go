@@ -0,0 +1,83 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/text/language"
+	textMessage "golang.org/x/text/message"
+)
+
+// configSchemaURL is the location of the schemas of script settings given to
+// the compiler, which appears in the errors of invalid schemas.
+const configSchemaURL = "file:///configSchema.json"
+
+// compileSchema compiles a JSON Schema, of draft 2020-12 unless it sets
+// $schema. Formats are asserted, and references to other documents are never
+// loaded.
+func compileSchema(schema map[string]interface{}) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat()
+	compiler.UseLoader(jsonschema.SchemeURLLoader{})
+	if err := compiler.AddResource(configSchemaURL, schema); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(configSchemaURL)
+}
+
+// validateSchema validates a JSON document against a compiled schema. It
+// returns one problem per violation, prefixed with the path of the value in
+// the document, e.g. config.tables[0].
+func validateSchema(schema *jsonschema.Schema, value interface{}, path string) []string {
+	err := schema.Validate(value)
+	if err == nil {
+		return nil
+	}
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return []string{path + ": " + err.Error()}
+	}
+	return schemaProblems(validationErr, path, textMessage.NewPrinter(language.English))
+}
+
+// schemaProblems returns the violations of the error, which are the leaves
+// of its tree of causes.
+func schemaProblems(err *jsonschema.ValidationError, path string, printer *textMessage.Printer) []string {
+	if len(err.Causes) == 0 {
+		return []string{instancePath(path, err.InstanceLocation) + ": " + err.ErrorKind.LocalizedString(printer)}
+	}
+	problems := []string{}
+	for _, cause := range err.Causes {
+		problems = append(problems, schemaProblems(cause, path, printer)...)
+	}
+	return problems
+}
+
+// instancePath converts the location of a value to a path like
+// config.tables[0].
+func instancePath(path string, location []string) string {
+	var result strings.Builder
+	result.WriteString(path)
+	for _, token := range location {
+		if isIndex(token) {
+			fmt.Fprintf(&result, "[%s]", token)
+		} else {
+			result.WriteString("." + token)
+		}
+	}
+	return result.String()
+}
+
+func isIndex(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, c := range token {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,164 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+const (
+	// Redacted replaces secret values in the script output.
+	Redacted = "[REDACTED]"
+
+	secretSourceEnv = "env:"
+)
+
+var ErrInvalidSecret = errors.New("invalid secret")
+
+// Secrets holds the secrets and environment variables scripts are allowed to
+// read. All methods are safe to call on a nil Secrets, which allows nothing.
+type Secrets struct {
+	values       map[string]string
+	envAllowList map[string]bool
+	replacer     *strings.Replacer
+}
+
+// NewSecrets loads the secrets and the environment variable allow-list.
+// Secrets are given as a comma-separated list of name=source pairs, where the
+// source is either the path to a file holding the secret, for example a
+// mounted Kubernetes secret, or env:NAME to read an environment variable.
+// The allow-list is a comma-separated list of environment variable names.
+func NewSecrets(secrets, envAllowList string) (*Secrets, error) {
+	s := &Secrets{
+		values:       map[string]string{},
+		envAllowList: map[string]bool{},
+	}
+
+	for _, name := range strings.Split(envAllowList, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			s.envAllowList[name] = true
+		}
+	}
+
+	for _, entry := range strings.Split(secrets, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, source, ok := strings.Cut(entry, "=")
+		if !ok || name == "" || source == "" {
+			return nil, fmt.Errorf("%w: %q must be in the name=source format", ErrInvalidSecret, entry)
+		}
+
+		if variable, ok := strings.CutPrefix(source, secretSourceEnv); ok {
+			value, found := os.LookupEnv(variable)
+			if !found {
+				return nil, fmt.Errorf("%w: environment variable %q of %q is not set",
+					ErrInvalidSecret, variable, name)
+			}
+			s.values[name] = value
+			continue
+		}
+
+		value, err := os.ReadFile(source)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q: %w", ErrInvalidSecret, name, err)
+		}
+		s.values[name] = strings.TrimRight(string(value), "\r\n")
+	}
+
+	// Longer secrets are replaced first, so that a secret containing
+	// another one is fully redacted.
+	values := make([]string, 0, len(s.values))
+	for _, value := range s.values {
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, Redacted)
+	}
+	s.replacer = strings.NewReplacer(pairs...)
+
+	return s, nil
+}
+
+// Redact replaces all secret values in the text.
+func (s *Secrets) Redact(text string) string {
+	if s == nil || len(s.values) == 0 {
+		return text
+	}
+	return s.replacer.Replace(text)
+}
+
+// Get returns the secret with the given name.
+func (s *Secrets) Get(name string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	value, ok := s.values[name]
+	return value, ok
+}
+
+// GetEnv returns the environment variable if it is in the allow-list.
+func (s *Secrets) GetEnv(name string) (string, bool) {
+	if s == nil || !s.envAllowList[name] {
+		return "", false
+	}
+	return os.LookupEnv(name)
+}
+
+// Register exposes the env and secrets objects to JS. Reading an environment
+// variable that is not in the allow-list or an unknown secret throws.
+func (s *Secrets) Register(runtime *goja.Runtime) error {
+	env := runtime.NewObject()
+	if err := env.Set("get", func(name string) goja.Value {
+		if s == nil || !s.envAllowList[name] {
+			panic(runtime.NewTypeError("env.get: %q is not in the allow-list", name))
+		}
+		if value, ok := s.GetEnv(name); ok {
+			return runtime.ToValue(value)
+		}
+		return goja.Undefined()
+	}); err != nil {
+		return err
+	}
+	if err := env.Set("has", func(name string) bool {
+		_, ok := s.GetEnv(name)
+		return ok
+	}); err != nil {
+		return err
+	}
+	if err := runtime.Set("env", env); err != nil {
+		return err
+	}
+
+	secrets := runtime.NewObject()
+	if err := secrets.Set("get", func(name string) string {
+		value, ok := s.Get(name)
+		if !ok {
+			panic(runtime.NewTypeError("secrets.get: unknown secret %q", name))
+		}
+		return value
+	}); err != nil {
+		return err
+	}
+	if err := secrets.Set("names", func() []string {
+		names := []string{}
+		if s != nil {
+			for name := range s.values {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}); err != nil {
+		return err
+	}
+	return runtime.Set("secrets", secrets)
+}
@@ -0,0 +1,81 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSecrets(t *testing.T) *Secrets {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "api-token")
+	require.NoError(t, os.WriteFile(path, []byte("s3cr3t-token\n"), 0o600))
+	t.Setenv("TEST_HMAC_KEY", "hmac-key")
+	t.Setenv("TEST_REGION", "eu-west-1")
+	t.Setenv("TEST_HIDDEN", "hidden")
+
+	secrets, err := NewSecrets("apiToken="+path+", hmacKey=env:TEST_HMAC_KEY", "TEST_REGION,TEST_UNSET")
+	require.NoError(t, err)
+	return secrets
+}
+
+func TestSecrets(t *testing.T) {
+	secrets := newTestSecrets(t)
+
+	value, ok := secrets.Get("apiToken")
+	assert.True(t, ok)
+	assert.Equal(t, "s3cr3t-token", value)
+	value, ok = secrets.Get("hmacKey")
+	assert.True(t, ok)
+	assert.Equal(t, "hmac-key", value)
+
+	value, ok = secrets.GetEnv("TEST_REGION")
+	assert.True(t, ok)
+	assert.Equal(t, "eu-west-1", value)
+	_, ok = secrets.GetEnv("TEST_HIDDEN")
+	assert.False(t, ok)
+
+	assert.Equal(t, "token=[REDACTED] key=[REDACTED]", secrets.Redact("token=s3cr3t-token key=hmac-key"))
+}
+
+func TestSecrets_Invalid(t *testing.T) {
+	_, err := NewSecrets("apiToken", "")
+	require.ErrorIs(t, err, ErrInvalidSecret)
+	_, err = NewSecrets("apiToken="+filepath.Join(t.TempDir(), "missing"), "")
+	require.ErrorIs(t, err, ErrInvalidSecret)
+	_, err = NewSecrets("apiToken=env:TEST_SECRET_NOT_SET", "")
+	require.ErrorIs(t, err, ErrInvalidSecret)
+}
+
+func TestSecrets_Register(t *testing.T) {
+	p := newTestPlugin(t)
+	require.NoError(t, newTestSecrets(t).Register(p.VM))
+
+	value, err := p.VM.RunString(`[
+		env.get("TEST_REGION"),
+		env.get("TEST_UNSET") === undefined,
+		env.has("TEST_HIDDEN"),
+		secrets.get("apiToken"),
+		secrets.names().join(","),
+	].join("|")`)
+	require.NoError(t, err)
+	assert.Equal(t, "eu-west-1|true|false|s3cr3t-token|apiToken,hmacKey", value.String())
+
+	_, err = p.VM.RunString(`env.get("TEST_HIDDEN")`)
+	require.Error(t, err)
+	_, err = p.VM.RunString(`secrets.get("unknown")`)
+	require.Error(t, err)
+}
+
+func TestSecrets_Nil(t *testing.T) {
+	var secrets *Secrets
+	p := newTestPlugin(t)
+	require.NoError(t, secrets.Register(p.VM))
+
+	assert.Equal(t, "text", secrets.Redact("text"))
+	_, err := p.VM.RunString(`env.get("HOME")`)
+	require.Error(t, err)
+}
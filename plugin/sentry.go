@@ -0,0 +1,212 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dop251/goja"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/getsentry/sentry-go"
+)
+
+// Reporter reports the errors of JS functions and the messages of scripts
+// to Sentry. Events are tagged with the version and the hash of the script.
+type Reporter struct {
+	hub           *sentry.Hub
+	scriptVersion string
+	scriptHash    string
+	secrets       *Secrets
+	// captureErrors enables the reports of the errors of JS functions, which
+	// are opt-in since their messages may contain queries.
+	captureErrors bool
+}
+
+// NewReporter returns a new Reporter that sends events via the client of
+// the hub. Secret values are redacted from the request metadata.
+func NewReporter(
+	hub *sentry.Hub, scriptVersion, scriptHash string, secrets *Secrets, captureErrors bool,
+) *Reporter {
+	return &Reporter{
+		hub:           hub,
+		scriptVersion: scriptVersion,
+		scriptHash:    scriptHash,
+		secrets:       secrets,
+		captureErrors: captureErrors,
+	}
+}
+
+// scrubbedFields are the fields of the requests that identify clients or
+// servers, e.g. addresses and startup parameters, which are never reported.
+var scrubbedFields = map[string]bool{
+	"remote": true, "local": true, "parameters": true, "user": true, "database": true,
+	"application_name": true, "applicationName": true,
+}
+
+// newScope returns a scope with the tags shared by all events.
+func (r *Reporter) newScope() (*sentry.Hub, *sentry.Scope) {
+	hub := r.hub.Clone()
+	scope := hub.Scope()
+	scope.SetTag("plugin", PluginID.GetName())
+	scope.SetTag("plugin.version", PluginID.GetVersion())
+	if r.scriptVersion != "" {
+		scope.SetTag("script.version", r.scriptVersion)
+	}
+	if r.scriptHash != "" {
+		scope.SetTag("script.hash", r.scriptHash)
+	}
+	return hub, scope
+}
+
+// CaptureException reports the error returned by the JS function of a hook,
+// if enabled. JS exceptions are reported with their JS stack trace. The
+// request is only reported as scrubbed metadata, so queries, results and
+// client details are never sent.
+func (r *Reporter) CaptureException(hook string, req *v1.Struct, err error) {
+	if r == nil || !r.captureErrors || err == nil {
+		return
+	}
+
+	hub, scope := r.newScope()
+	scope.SetTag("hook", hook)
+	if req != nil {
+		scope.SetContext("request", r.scrub(req.AsMap()))
+	}
+
+	event := sentry.NewEvent()
+	event.Level = sentry.LevelError
+	event.Platform = "javascript"
+	event.Message = r.secrets.Redact(err.Error())
+	event.Exception = []sentry.Exception{newSentryException(err, r.secrets)}
+	hub.CaptureEvent(event)
+}
+
+// CaptureMessage reports a message of a script and returns the event ID.
+func (r *Reporter) CaptureMessage(message string, level sentry.Level, tags map[string]string, extra map[string]interface{}) string {
+	if r == nil {
+		return ""
+	}
+
+	hub, scope := r.newScope()
+	scope.SetTags(tags)
+	for key, value := range extra {
+		scope.SetExtra(key, value)
+	}
+
+	event := sentry.NewEvent()
+	event.Level = level
+	event.Platform = "javascript"
+	event.Message = r.secrets.Redact(message)
+	if id := hub.CaptureEvent(event); id != nil {
+		return string(*id)
+	}
+	return ""
+}
+
+// scrub replaces the bytes in the request, such as queries and results,
+// with their length, drops the addresses and startup parameters, and
+// redacts the secrets in the strings.
+func (r *Reporter) scrub(fields map[string]interface{}) map[string]interface{} {
+	scrubbed := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		if scrubbedFields[key] {
+			continue
+		}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			scrubbed[key] = r.scrub(value)
+		case []byte:
+			scrubbed[key] = fmt.Sprintf("[%d bytes]", len(value))
+		case string:
+			if strings.Contains(strings.ToLower(key), "password") {
+				scrubbed[key] = Redacted
+			} else {
+				scrubbed[key] = r.secrets.Redact(value)
+			}
+		default:
+			scrubbed[key] = value
+		}
+	}
+	return scrubbed
+}
+
+// newSentryException converts the error to a Sentry exception. The frames of
+// JS exceptions are listed from the oldest call to the newest, as Sentry expects.
+func newSentryException(err error, secrets *Secrets) sentry.Exception {
+	exception := sentry.Exception{
+		Type:  fmt.Sprintf("%T", err),
+		Value: secrets.Redact(err.Error()),
+	}
+
+	var jsException *goja.Exception
+	if !errors.As(err, &jsException) {
+		return exception
+	}
+
+	exception.Type = "Error"
+	if object, ok := jsException.Value().(*goja.Object); ok {
+		if name := object.Get("name"); name != nil && !goja.IsUndefined(name) {
+			exception.Type = name.String()
+		}
+		if message := object.Get("message"); message != nil && !goja.IsUndefined(message) {
+			exception.Value = secrets.Redact(message.String())
+		}
+	} else if value := jsException.Value(); value != nil {
+		exception.Value = secrets.Redact(value.String())
+	}
+
+	stack := jsException.Stack()
+	frames := make([]sentry.Frame, 0, len(stack))
+	for i := len(stack) - 1; i >= 0; i-- {
+		position := stack[i].Position()
+		frames = append(frames, sentry.Frame{
+			Function: stack[i].FuncName(),
+			Filename: stack[i].SrcName(),
+			Lineno:   position.Line,
+			Colno:    position.Column,
+			InApp:    true,
+			Platform: "javascript",
+		})
+	}
+	if len(frames) > 0 {
+		exception.Stacktrace = &sentry.Stacktrace{Frames: frames}
+	}
+	return exception
+}
+
+// Register exposes the sentry object to JS:
+//
+//	sentry.captureMessage("cache miss rate is high", { level: "warning", tags: { table: "users" }, extra: { rate: 0.4 } })
+//
+// It returns the ID of the event, or an empty string if Sentry is disabled.
+func (r *Reporter) Register(runtime *goja.Runtime) error {
+	object := runtime.NewObject()
+	setProperty(object, "captureMessage", func(call goja.FunctionCall) goja.Value {
+		level := sentry.LevelInfo
+		tags := map[string]string{}
+		extra := map[string]interface{}{}
+		if options := call.Argument(1); !goja.IsUndefined(options) && !goja.IsNull(options) {
+			object := options.ToObject(runtime)
+			if value := object.Get("level"); value != nil && !goja.IsUndefined(value) {
+				level = sentry.Level(strings.ToLower(value.String()))
+			}
+			if value := object.Get("tags"); value != nil && !goja.IsUndefined(value) {
+				if err := runtime.ExportTo(value, &tags); err != nil {
+					panic(runtime.NewTypeError("sentry.captureMessage: tags must be an object of strings"))
+				}
+			}
+			if value := object.Get("extra"); value != nil && !goja.IsUndefined(value) {
+				if err := runtime.ExportTo(value, &extra); err != nil {
+					panic(runtime.NewTypeError("sentry.captureMessage: extra must be an object"))
+				}
+			}
+		}
+		switch level {
+		case sentry.LevelDebug, sentry.LevelInfo, sentry.LevelWarning, sentry.LevelError, sentry.LevelFatal:
+		default:
+			panic(runtime.NewTypeError("sentry.captureMessage: unknown level %q", level))
+		}
+		return runtime.ToValue(r.CaptureMessage(call.Argument(0).String(), level, tags, extra))
+	})
+	return runtime.Set("sentry", object)
+}
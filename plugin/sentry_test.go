@@ -0,0 +1,142 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTransport keeps the events in memory instead of sending them.
+type testTransport struct {
+	mu     sync.Mutex
+	events []*sentry.Event
+}
+
+func (t *testTransport) Flush(time.Duration) bool              { return true }
+func (t *testTransport) FlushWithContext(context.Context) bool { return true }
+func (t *testTransport) Configure(sentry.ClientOptions)        {}
+func (t *testTransport) Close()                                {}
+
+func (t *testTransport) SendEvent(event *sentry.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, event)
+}
+
+func newTestReporter(t *testing.T, secrets *Secrets, captureErrors bool) (*Reporter, *testTransport) {
+	t.Helper()
+	transport := &testTransport{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn:       "http://public@localhost/1",
+		Transport: transport,
+	})
+	require.NoError(t, err)
+	return NewReporter(sentry.NewHub(client, sentry.NewScope()), "1.2.0", "abc123", secrets, captureErrors), transport
+}
+
+func TestReporter_CaptureException(t *testing.T) {
+	t.Setenv("TEST_SENTRY_TOKEN", "s3cr3t")
+	secrets, err := NewSecrets("token=env:TEST_SENTRY_TOKEN", "")
+	require.NoError(t, err)
+	reporter, transport := newTestReporter(t, secrets, true)
+
+	p := newTestPlugin(t)
+	p.Reporter = reporter
+	_, err = p.VM.RunScript("index.js", `
+		function check(req) {
+			throw new TypeError("invalid token s3cr3t");
+		}
+		function onTrafficFromClient(ctx, req) {
+			return check(req);
+		}
+	`)
+	require.NoError(t, err)
+	p.RegisterFunction("onTrafficFromClient")
+
+	req := newTrafficRequest(t, newQueryMessage("SELECT 1"))
+	_, err = p.RunFunction(context.Background(), "onTrafficFromClient", req)
+	require.Error(t, err)
+
+	require.Len(t, transport.events, 1)
+	event := transport.events[0]
+	assert.Equal(t, sentry.LevelError, event.Level)
+	assert.Equal(t, "onTrafficFromClient", event.Tags["hook"])
+	assert.Equal(t, "1.2.0", event.Tags["script.version"])
+	assert.Equal(t, "abc123", event.Tags["script.hash"])
+
+	require.Len(t, event.Exception, 1)
+	exception := event.Exception[0]
+	assert.Equal(t, "TypeError", exception.Type)
+	assert.Equal(t, "invalid token [REDACTED]", exception.Value)
+	require.NotNil(t, exception.Stacktrace)
+	frames := exception.Stacktrace.Frames
+	require.Len(t, frames, 2)
+	assert.Equal(t, "onTrafficFromClient", frames[0].Function)
+	assert.Equal(t, "check", frames[1].Function)
+	assert.Equal(t, "index.js", frames[1].Filename)
+	assert.Equal(t, 3, frames[1].Lineno)
+
+	request := event.Contexts["request"]
+	assert.Equal(t, "[14 bytes]", request["request"])
+	assert.Empty(t, request["client"], "addresses are not reported")
+}
+
+func TestReporter_CaptureExceptionDisabled(t *testing.T) {
+	reporter, transport := newTestReporter(t, nil, false)
+	reporter.CaptureException("onTrafficFromClient", nil, errors.New("SELECT secret FROM users"))
+	assert.Empty(t, transport.events, "errors of JS functions are opt-in")
+}
+
+func TestReporter_Scrub(t *testing.T) {
+	reporter, _ := newTestReporter(t, nil, true)
+	scrubbed := reporter.scrub(map[string]interface{}{
+		"client":   map[string]interface{}{"remote": "10.0.0.1:5000", "local": "10.0.0.2:5432"},
+		"startup":  map[string]interface{}{"parameters": map[string]interface{}{"user": "alice"}, "user": "alice"},
+		"request":  []byte("SELECT 1"),
+		"password": "hunter2",
+		"error":    "timeout",
+	})
+	assert.Equal(t, map[string]interface{}{
+		"client":   map[string]interface{}{},
+		"startup":  map[string]interface{}{},
+		"request":  "[8 bytes]",
+		"password": Redacted,
+		"error":    "timeout",
+	}, scrubbed)
+}
+
+func TestReporter_Register(t *testing.T) {
+	reporter, transport := newTestReporter(t, nil, false)
+	p := newTestPlugin(t)
+	require.NoError(t, reporter.Register(p.VM))
+
+	value, err := p.VM.RunString(`
+		sentry.captureMessage("cache miss rate is high", { level: "warning", tags: { table: "users" }, extra: { rate: 0.4 } })
+	`)
+	require.NoError(t, err)
+	assert.NotEmpty(t, value.String())
+
+	require.Len(t, transport.events, 1)
+	event := transport.events[0]
+	assert.Equal(t, "cache miss rate is high", event.Message)
+	assert.Equal(t, sentry.LevelWarning, event.Level)
+	assert.Equal(t, "users", event.Tags["table"])
+	assert.InDelta(t, 0.4, event.Extra["rate"], 0)
+
+	_, err = p.VM.RunString(`sentry.captureMessage("oops", { level: "loud" })`)
+	require.Error(t, err)
+
+	// Without Sentry, messages are dropped.
+	var disabled *Reporter
+	p = newTestPlugin(t)
+	require.NoError(t, disabled.Register(p.VM))
+	value, err = p.VM.RunString(`sentry.captureMessage("dropped")`)
+	require.NoError(t, err)
+	assert.Empty(t, value.String())
+}
@@ -0,0 +1,103 @@
+package plugin
+
+import (
+	"github.com/dop251/goja"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+)
+
+const (
+	// RejectCode is the default SQLSTATE of rejected connections, which is
+	// invalid_authorization_specification.
+	RejectCode = "28000"
+	// RejectSeverity is the default severity of rejected connections.
+	RejectSeverity = "FATAL"
+)
+
+// newStartupObject returns the JS object of a message sent before the startup.
+func newStartupObject(runtime *goja.Runtime, startup *StartupMessage) *goja.Object {
+	object := runtime.NewObject()
+	setProperty(object, "type", startup.Type)
+	switch startup.Type {
+	case StartupTypeStartup:
+		setProperty(object, "protocolVersion", startup.ProtocolVersion)
+		setProperty(object, "parameters", startup.Parameters)
+		setProperty(object, "user", startup.Parameters["user"])
+		setProperty(object, "database", startup.Parameters["database"])
+		setProperty(object, "applicationName", startup.Parameters["application_name"])
+		setProperty(object, "options", startup.Parameters["options"])
+	case StartupTypeCancel:
+		setProperty(object, "processId", startup.ProcessID)
+		setProperty(object, "secretKey", newUint8Array(runtime, startup.SecretKey))
+	}
+	return object
+}
+
+// setResponse makes GatewayD answer the client with the response instead of
+// forwarding the request.
+func setResponse(req *v1.Struct, response []byte) {
+	if req.Fields == nil {
+		req.Fields = map[string]*v1.Value{}
+	}
+	req.Fields["response"] = v1.NewBytesValue(response)
+	req.Fields["terminate"] = v1.NewBoolValue(true)
+}
+
+// isTerminated tells whether the request is answered with a response instead
+// of being forwarded.
+func isTerminated(req *v1.Struct) bool {
+	return req.GetFields()["terminate"].GetBoolValue()
+}
+
+// RegisterStartupHelpers exposes the helpers for the messages sent by clients
+// before the startup, which have no type byte, to JS:
+//
+//	parseStartupMessage(bytes) // { type, user, database, applicationName, options, parameters, ... } or null
+//	rejectConnection(req, "user is not allowed", { code: "28000", detail, hint })
+//
+// The type is startup, ssl, gssenc or cancel. rejectConnection answers the
+// client with a FATAL ErrorResponse and returns the request.
+func RegisterStartupHelpers(runtime *goja.Runtime) error {
+	if err := runtime.Set("parseStartupMessage", func(call goja.FunctionCall) goja.Value {
+		startup, ok := parseStartupMessage(mustBytes(runtime, call.Argument(0), "parseStartupMessage"))
+		if !ok {
+			return goja.Null()
+		}
+		return newStartupObject(runtime, startup)
+	}); err != nil {
+		return err
+	}
+
+	return runtime.Set("rejectConnection", func(call goja.FunctionCall) goja.Value {
+		req, ok := exportStruct(call.Argument(0))
+		if !ok {
+			panic(runtime.NewTypeError("rejectConnection: expected the request as the first argument"))
+		}
+
+		code, severity := RejectCode, RejectSeverity
+		fields := []ErrorField{}
+		if options := call.Argument(2); !goja.IsUndefined(options) && !goja.IsNull(options) {
+			object := options.ToObject(runtime)
+			get := func(name string) string {
+				value := object.Get(name)
+				if value == nil || goja.IsUndefined(value) || goja.IsNull(value) {
+					return ""
+				}
+				return value.String()
+			}
+			if value := get("code"); value != "" {
+				code = value
+			}
+			if value := get("severity"); value != "" {
+				severity = value
+			}
+			fields = append(fields, ErrorField{Type: 'D', Value: get("detail")}, ErrorField{Type: 'H', Value: get("hint")})
+		}
+
+		text := "connection rejected"
+		if message := call.Argument(1); !goja.IsUndefined(message) && !goja.IsNull(message) {
+			text = message.String()
+		}
+		setResponse(req, newErrorResponse(severity, code, text, fields...))
+		return call.Argument(0)
+	})
+}
@@ -0,0 +1,91 @@
+package plugin
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/dop251/goja"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequestCode(code uint32, extra ...byte) []byte {
+	msg := binary.BigEndian.AppendUint32(nil, uint32(8+len(extra)))
+	return append(binary.BigEndian.AppendUint32(msg, code), extra...)
+}
+
+func TestParseStartupMessage(t *testing.T) {
+	startup, ok := parseStartupMessage(newStartupMessage("user", "alice", "options", "-c search_path=app"))
+	require.True(t, ok)
+	assert.Equal(t, &StartupMessage{
+		Type:            StartupTypeStartup,
+		ProtocolVersion: "3.0",
+		Parameters:      map[string]string{"user": "alice", "options": "-c search_path=app"},
+	}, startup)
+
+	startup, ok = parseStartupMessage(newRequestCode(sslRequestCode))
+	require.True(t, ok)
+	assert.Equal(t, StartupTypeSSL, startup.Type)
+
+	startup, ok = parseStartupMessage(newRequestCode(gssencRequestCode))
+	require.True(t, ok)
+	assert.Equal(t, StartupTypeGSSENC, startup.Type)
+
+	startup, ok = parseStartupMessage(newRequestCode(cancelRequestCode, 0, 0, 0x30, 0x39, 1, 2, 3, 4))
+	require.True(t, ok)
+	assert.Equal(t, &StartupMessage{Type: StartupTypeCancel, ProcessID: 12345, SecretKey: []byte{1, 2, 3, 4}}, startup)
+
+	for _, msg := range [][]byte{
+		nil,
+		newQueryMessage("SELECT 1"),
+		newRequestCode(1234),
+		newRequestCode(sslRequestCode, 0),
+		newRequestCode(cancelRequestCode, 1),
+	} {
+		_, ok := parseStartupMessage(msg)
+		assert.False(t, ok, "%q", msg)
+	}
+}
+
+func TestNewErrorResponse(t *testing.T) {
+	body := "SFATAL\x00VFATAL\x00C28000\x00Mnot allowed\x00Hask an admin\x00\x00"
+	expected := append(binary.BigEndian.AppendUint32([]byte{'E'}, uint32(4+len(body))), body...)
+	assert.Equal(t, expected, newErrorResponse("FATAL", "28000", "not allowed",
+		ErrorField{Type: 'D'}, ErrorField{Type: 'H', Value: "ask an admin"}))
+}
+
+func TestRegisterStartupHelpers(t *testing.T) {
+	runtime := goja.New()
+	require.NoError(t, RegisterStartupHelpers(runtime))
+	require.NoError(t, RegisterEncodingHelpers(runtime))
+	require.NoError(t, runtime.Set("msg", newStartupMessage("user", "bob", "database", "shop")))
+
+	value, err := runtime.RunString(`
+		const startup = parseStartupMessage(bytes(msg));
+		[startup.type, startup.user, startup.database, startup.protocolVersion, parseStartupMessage(bytes([1, 2]))]
+	`)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"startup", "bob", "shop", "3.0", nil}, value.Export())
+
+	req := newTrafficRequest(t, newStartupMessage("user", "bob"))
+	require.NoError(t, runtime.Set("req", req))
+	value, err = runtime.RunString(`rejectConnection(req, "bob is not allowed", { code: "28P01", hint: "ask an admin" })`)
+	require.NoError(t, err)
+
+	result, ok := value.Export().(*v1.Struct)
+	require.True(t, ok)
+	assert.Equal(t,
+		newErrorResponse("FATAL", "28P01", "bob is not allowed", ErrorField{Type: 'H', Value: "ask an admin"}),
+		result.GetFields()["response"].GetBytesValue())
+	assert.True(t, result.GetFields()["terminate"].GetBoolValue())
+
+	// The message and the options are optional.
+	_, err = runtime.RunString(`rejectConnection(req)`)
+	require.NoError(t, err)
+	assert.Equal(t, newErrorResponse(RejectSeverity, RejectCode, "connection rejected"),
+		req.GetFields()["response"].GetBytesValue())
+
+	_, err = runtime.RunString(`rejectConnection({}, "no")`)
+	assert.Error(t, err)
+}
@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"sync"
+	"time"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/spf13/cast"
+	pgQuery "github.com/wasilibs/go-pgquery"
+)
+
+type SlowQueryConfig struct {
+	// Threshold is the duration above which queries are logged as slow. Slow
+	// queries are not logged if it is zero.
+	Threshold time.Duration
+}
+
+// NewSlowQueryConfig returns a new SlowQueryConfig from the plugin config.
+func NewSlowQueryConfig(config map[string]interface{}) *SlowQueryConfig {
+	return &SlowQueryConfig{Threshold: cast.ToDuration(config["slowQueryThreshold"])}
+}
+
+// OtherFingerprint is the label of the query duration of the queries whose
+// fingerprints are not labels.
+const OtherFingerprint = "other"
+
+// FingerprintLabels bounds the number of query fingerprints used as labels
+// of the query duration histogram, since every label value is a series kept
+// by the plugin and the scrapers. The first fingerprints seen are labels, and
+// the others are recorded as other.
+type FingerprintLabels struct {
+	mu     sync.Mutex
+	max    int
+	labels map[string]bool
+}
+
+// NewFingerprintLabels returns a new FingerprintLabels from the plugin config.
+// Fingerprints are not labels if the maximum is zero.
+func NewFingerprintLabels(config map[string]interface{}) *FingerprintLabels {
+	return &FingerprintLabels{
+		max:    cast.ToInt(config["queryMetricsMaxFingerprints"]),
+		labels: map[string]bool{},
+	}
+}
+
+// Label returns the label of the fingerprint.
+func (l *FingerprintLabels) Label(fingerprint string) string {
+	if l == nil {
+		return OtherFingerprint
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.labels[fingerprint] {
+		return fingerprint
+	}
+	if len(l.labels) >= l.max {
+		return OtherFingerprint
+	}
+	l.labels[fingerprint] = true
+	return fingerprint
+}
+
+// observeQueries records the duration of the queries answered by the server
+// per query fingerprint, for a bounded number of fingerprints, and logs the
+// slow ones. The query text is logged
+// normalized, without its literal values.
+func (p *Plugin) observeQueries(resp *v1.Struct, traffic *ServerTraffic) {
+	if traffic == nil {
+		return
+	}
+	for _, query := range traffic.Queries {
+		fingerprint := getFingerprint(query.Text)
+		if fingerprint == "" {
+			fingerprint = "unknown"
+		}
+		QueryDuration.WithLabelValues(p.QueryLabels.Label(fingerprint)).Observe(query.Duration.Seconds())
+
+		if p.SlowQuery == nil || p.SlowQuery.Threshold <= 0 || query.Duration < p.SlowQuery.Threshold {
+			continue
+		}
+		SlowQueries.Inc()
+		normalized, err := pgQuery.Normalize(query.Text)
+		if err != nil {
+			normalized = ""
+		}
+		parameters := p.Connections.Parameters(resp)
+		p.Logger.Warn("Slow query",
+			"durationMs", float64(query.Duration.Microseconds())/1000,
+			"fingerprint", fingerprint,
+			"query", normalized,
+			"protocol", query.Protocol,
+			"remote", getClientAddress(resp),
+			"user", parameters["user"],
+			"database", parameters["database"])
+	}
+}
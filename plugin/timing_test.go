@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newServerResponse(t *testing.T, response []byte) *v1.Struct {
+	t.Helper()
+	resp, err := v1.NewStruct(map[string]interface{}{
+		"client":   map[string]interface{}{"local": "localhost:15432", "remote": "127.0.0.1:5000"},
+		"response": response,
+	})
+	require.NoError(t, err)
+	return resp
+}
+
+// sendQueries tracks the request and records it as sent to the server.
+func sendQueries(t *testing.T, tracker *ConnectionTracker, request []byte) {
+	t.Helper()
+	req := newTrafficRequest(t, request)
+	tracker.Sent(req, tracker.TrackClient(req))
+}
+
+func TestConnectionTracker_QueryDuration(t *testing.T) {
+	tracker := NewConnectionTracker()
+	ready := newReadyForQuery('I')
+
+	sendQueries(t, tracker, newQueryMessage("SELECT pg_sleep(1)"))
+	time.Sleep(2 * time.Millisecond)
+
+	// Responses without a ReadyForQuery answer no query.
+	traffic := tracker.TrackServer(newServerResponse(t, newCommandComplete("SELECT 1")))
+	require.NotNil(t, traffic)
+	assert.Empty(t, traffic.Queries)
+
+	traffic = tracker.TrackServer(newServerResponse(t, concat(newCommandComplete("SELECT 1"), ready)))
+	require.Len(t, traffic.Queries, 1)
+	assert.Equal(t, "SELECT pg_sleep(1)", traffic.Queries[0].Text)
+	assert.GreaterOrEqual(t, traffic.Queries[0].Duration, 2*time.Millisecond)
+	assert.Equal(t, traffic.Queries, tracker.Completed(newTrafficRequest(t, nil)).Queries)
+
+	// Each Sync is answered by a ReadyForQuery, with or without portals.
+	sendQueries(t, tracker, concat(
+		newParseMessage("", "SELECT $1"),
+		newBindMessage("", "", nil, []byte("1")),
+		newExecuteMessage(""),
+		newExecuteMessage("")))
+	sendQueries(t, tracker, concat(newFrontendMessage('S'), newParseMessage("s1", "SELECT 2"), newFrontendMessage('S')))
+	traffic = tracker.TrackServer(newServerResponse(t, concat(ready, ready)))
+	require.Len(t, traffic.Queries, 2)
+	assert.Equal(t, "SELECT $1", traffic.Queries[1].Text)
+	assert.Positive(t, traffic.Queries[1].Duration)
+
+	// Requests that are not sent are not timed.
+	tracker.TrackClient(newTrafficRequest(t, newQueryMessage("SELECT 1")))
+	assert.Empty(t, tracker.TrackServer(newServerResponse(t, ready)).Queries)
+
+	var nilTracker *ConnectionTracker
+	assert.Nil(t, nilTracker.TrackServer(newServerResponse(t, ready)))
+	assert.Nil(t, nilTracker.Completed(newTrafficRequest(t, nil)))
+	nilTracker.Sent(newTrafficRequest(t, nil), &ClientTraffic{})
+}
+
+func TestPlugin_SlowQuery(t *testing.T) {
+	output := &bytes.Buffer{}
+	p := newTestPlugin(t)
+	p.Logger = hclog.New(&hclog.LoggerOptions{Level: hclog.Warn, Output: output})
+	p.Connections = NewConnectionTracker()
+	p.SlowQuery = NewSlowQueryConfig(map[string]interface{}{"slowQueryThreshold": "1ns"})
+	require.NoError(t, p.VM.Set("Value", p.VM.ToValue(v1.NewValue)))
+	_, err := p.VM.RunString(`
+	function onTrafficFromClient(ctx, req) {
+		req.Fields["duration"] = Value(ctx.query.durationMs === null);
+		return req;
+	}
+	function onTrafficFromServer(ctx, resp) {
+		resp.Fields["duration"] = Value(ctx.query.durationMs > 0);
+		return resp;
+	}
+	function onTrafficToClient(ctx, resp) {
+		resp.Fields["text"] = Value(ctx.query.text);
+		return resp;
+	}`)
+	require.NoError(t, err)
+	p.RegisterFunctions([]string{"onTrafficFromClient", "onTrafficFromServer", "onTrafficToClient"})
+
+	slowQueries := testutil.ToFloat64(SlowQueries)
+	req, err := p.OnTrafficFromClient(context.Background(),
+		newTrafficRequest(t, newQueryMessage("SELECT * FROM users WHERE name = 'alice'")))
+	require.NoError(t, err)
+	assert.Equal(t, true, req.AsMap()["duration"])
+
+	resp, err := p.OnTrafficFromServer(context.Background(), newServerResponse(t, newReadyForQuery('I')))
+	require.NoError(t, err)
+	assert.Equal(t, true, resp.AsMap()["duration"])
+	resp, err = p.OnTrafficToClient(context.Background(), resp)
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT * FROM users WHERE name = 'alice'", resp.AsMap()["text"])
+
+	// The slow query is logged without its literal values.
+	assert.InDelta(t, slowQueries+1, testutil.ToFloat64(SlowQueries), 0)
+	assert.Contains(t, output.String(), "Slow query")
+	assert.Contains(t, output.String(), "query=\"SELECT * FROM users WHERE name = $1\"")
+	assert.NotContains(t, output.String(), "alice")
+}
+
+func TestFingerprintLabels(t *testing.T) {
+	labels := NewFingerprintLabels(map[string]interface{}{"queryMetricsMaxFingerprints": "2"})
+	assert.Equal(t, "a", labels.Label("a"))
+	assert.Equal(t, "b", labels.Label("b"))
+	assert.Equal(t, OtherFingerprint, labels.Label("c"))
+	assert.Equal(t, "a", labels.Label("a"))
+
+	assert.Equal(t, OtherFingerprint, NewFingerprintLabels(map[string]interface{}{}).Label("a"))
+	var nilLabels *FingerprintLabels
+	assert.Equal(t, OtherFingerprint, nilLabels.Label("a"))
+}
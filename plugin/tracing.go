@@ -0,0 +1,336 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/dop251/goja"
+	"github.com/spf13/cast"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc/metadata"
+)
+
+var ErrUnknownTracingExporter = errors.New("unknown tracing exporter")
+
+type TracingConfig struct {
+	// Exporter is none, otlp, stdout or file.
+	Exporter    string
+	Endpoint    string
+	Insecure    bool
+	FilePath    string
+	SampleRatio float64
+}
+
+// NewTracingConfig returns a new TracingConfig from the plugin config.
+func NewTracingConfig(config map[string]interface{}) *TracingConfig {
+	tracingConfig := TracingConfig{
+		Exporter:    strings.ToLower(cast.ToString(config["tracingExporter"])),
+		Endpoint:    cast.ToString(config["tracingEndpoint"]),
+		Insecure:    cast.ToBool(config["tracingInsecure"]),
+		FilePath:    cast.ToString(config["tracingFilePath"]),
+		SampleRatio: cast.ToFloat64(config["tracingSampleRatio"]),
+	}
+	if tracingConfig.Exporter == "" {
+		tracingConfig.Exporter = "none"
+	}
+	return &tracingConfig
+}
+
+// stdoutWriter writes to the current os.Stdout, which is redirected to
+// GatewayD once the plugin is served.
+type stdoutWriter struct{}
+
+func (stdoutWriter) Write(data []byte) (int, error) {
+	return os.Stdout.Write(data)
+}
+
+// Tracing creates the spans of hook calls and the spans created by scripts.
+type Tracing struct {
+	provider      *sdktrace.TracerProvider
+	tracer        trace.Tracer
+	scriptVersion string
+	closer        io.Closer
+}
+
+// NewTracing returns a new Tracing that exports the spans with the configured
+// exporter, or nil if tracing is disabled.
+func NewTracing(config *TracingConfig, scriptVersion string) (*Tracing, error) {
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+	var err error
+
+	switch config.Exporter {
+	case "none":
+		return nil, nil //nolint:nilnil
+	case "otlp":
+		options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(config.Endpoint)}
+		if config.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(context.Background(), options...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(stdoutWriter{}))
+	case "file":
+		var file *os.File
+		file, err = os.OpenFile(config.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		closer = file
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownTracingExporter, config.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(PluginID.GetName()),
+			semconv.ServiceVersion(PluginID.GetVersion()),
+		)),
+	)
+	tracing := newTracing(provider, scriptVersion)
+	tracing.closer = closer
+	return tracing, nil
+}
+
+func newTracing(provider *sdktrace.TracerProvider, scriptVersion string) *Tracing {
+	return &Tracing{
+		provider:      provider,
+		tracer:        provider.Tracer(PluginID.GetRemoteUrl()),
+		scriptVersion: scriptVersion,
+	}
+}
+
+// metadataCarrier reads the trace context from the gRPC metadata sent by GatewayD.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// StartHook starts the span of a hook call. The span is a child of the span
+// propagated by GatewayD in the gRPC metadata, if any. Without tracing, the
+// span does nothing, and the span of the context, if any, is left untouched.
+func (t *Tracing) StartHook(ctx context.Context, hook string) (context.Context, trace.Span) {
+	if t == nil {
+		return ctx, noop.Span{}
+	}
+	if incoming, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = propagation.TraceContext{}.Extract(ctx, metadataCarrier(incoming))
+	}
+
+	attributes := []attribute.KeyValue{attribute.String("gatewayd.hook", hook)}
+	if t.scriptVersion != "" {
+		attributes = append(attributes, attribute.String("gatewayd.js.script_version", t.scriptVersion))
+	}
+	return t.tracer.Start(ctx, hook,
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attributes...))
+}
+
+// Start starts a span of a script as a child of the span in the context.
+func (t *Tracing) Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	if t == nil {
+		return ctx, noop.Span{}
+	}
+	return t.tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// Shutdown exports the remaining spans and closes the exporter.
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	err := t.provider.Shutdown(ctx)
+	if t.closer != nil {
+		err = errors.Join(err, t.closer.Close())
+	}
+	return err
+}
+
+// endSpan records the outcome of the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("gatewayd.js.outcome", "error"))
+	} else {
+		span.SetAttributes(attribute.String("gatewayd.js.outcome", "ok"))
+	}
+	span.End()
+}
+
+// toAttributes converts the properties of a JS object to span attributes.
+func toAttributes(runtime *goja.Runtime, value goja.Value) []attribute.KeyValue {
+	if value == nil || goja.IsUndefined(value) || goja.IsNull(value) {
+		return nil
+	}
+	object := value.ToObject(runtime)
+	attributes := make([]attribute.KeyValue, 0, len(object.Keys()))
+	for _, key := range object.Keys() {
+		switch value := object.Get(key).Export().(type) {
+		case bool:
+			attributes = append(attributes, attribute.Bool(key, value))
+		case int64:
+			attributes = append(attributes, attribute.Int64(key, value))
+		case float64:
+			attributes = append(attributes, attribute.Float64(key, value))
+		case string:
+			attributes = append(attributes, attribute.String(key, value))
+		default:
+			attributes = append(attributes, attribute.String(key, fmt.Sprint(value)))
+		}
+	}
+	return attributes
+}
+
+// newSpanObject wraps the span in a JS object.
+func newSpanObject(runtime *goja.Runtime, span trace.Span) *goja.Object {
+	object := runtime.NewObject()
+	setProperty(object, "traceId", span.SpanContext().TraceID().String())
+	setProperty(object, "spanId", span.SpanContext().SpanID().String())
+	setProperty(object, "setAttribute", func(key string, value goja.Value) {
+		attributes := runtime.NewObject()
+		setProperty(attributes, key, value)
+		span.SetAttributes(toAttributes(runtime, attributes)...)
+	})
+	setProperty(object, "setAttributes", func(attributes goja.Value) {
+		span.SetAttributes(toAttributes(runtime, attributes)...)
+	})
+	setProperty(object, "addEvent", func(name string, attributes goja.Value) {
+		span.AddEvent(name, trace.WithAttributes(toAttributes(runtime, attributes)...))
+	})
+	setProperty(object, "setStatus", func(status, description string) {
+		switch status {
+		case "ok":
+			span.SetStatus(codes.Ok, "")
+		case "error":
+			span.SetStatus(codes.Error, description)
+		default:
+			panic(runtime.NewTypeError("span.setStatus: unknown status %q", status))
+		}
+	})
+	setProperty(object, "recordException", func(value goja.Value) {
+		span.RecordError(errors.New(value.String())) //nolint:err113
+		span.SetStatus(codes.Error, value.String())
+	})
+	setProperty(object, "end", func() {
+		span.End()
+	})
+	return object
+}
+
+// RegisterTracingAPI exposes the tracing object to JS. Spans are children of
+// the span of the running hook:
+//
+//	const span = tracing.startSpan("lookup", { table: "users" })
+//	span.addEvent("cache miss")
+//	span.end()
+//
+//	tracing.withSpan("policy", (span) => { ... })
+//
+// withSpan ends the span when the function returns and records its
+// exception, if any. Spans started within the function are its children.
+func (p *Plugin) RegisterTracingAPI() error {
+	runtime := p.VM
+	tracing := runtime.NewObject()
+
+	parent := func() context.Context {
+		if p.hookCtx != nil {
+			return p.hookCtx
+		}
+		return context.Background()
+	}
+
+	setProperty(tracing, "startSpan", func(call goja.FunctionCall) goja.Value {
+		_, span := p.Tracing.Start(parent(), call.Argument(0).String(),
+			toAttributes(runtime, call.Argument(1))...)
+		return newSpanObject(runtime, span)
+	})
+	setProperty(tracing, "withSpan", func(call goja.FunctionCall) goja.Value {
+		callable, ok := goja.AssertFunction(call.Argument(1))
+		if !ok {
+			panic(runtime.NewTypeError("tracing.withSpan requires a function as the second argument"))
+		}
+
+		previous := p.hookCtx
+		ctx, span := p.Tracing.Start(parent(), call.Argument(0).String(),
+			toAttributes(runtime, call.Argument(2))...)
+		p.hookCtx = ctx
+		defer func() { p.hookCtx = previous }()
+
+		value, err := callable(goja.Undefined(), newSpanObject(runtime, span))
+		if err == nil {
+			// The span of async functions that wait for fetch ends when
+			// their promise settles.
+			if promise, ok := value.Export().(*goja.Promise); ok && promise.State() == goja.PromiseStatePending {
+				return whenSettled(runtime, value, func(err error) { endSpan(span, err) })
+			}
+			_, err = settle(value)
+		}
+		endSpan(span, err)
+		var exception *goja.Exception
+		if errors.As(err, &exception) {
+			panic(exception)
+		} else if err != nil {
+			panic(runtime.NewGoError(err))
+		}
+		return value
+	})
+	setProperty(tracing, "enabled", p.Tracing != nil)
+
+	return runtime.Set("tracing", tracing)
+}
+
+// whenSettled calls done when the promise settles, and returns a promise
+// settled like it.
+func whenSettled(runtime *goja.Runtime, promise goja.Value, done func(error)) goja.Value {
+	then, _ := goja.AssertFunction(promise.ToObject(runtime).Get("then"))
+	result, err := then(promise,
+		runtime.ToValue(func(value goja.Value) goja.Value {
+			done(nil)
+			return value
+		}),
+		runtime.ToValue(func(reason goja.Value) goja.Value {
+			done(fmt.Errorf("%w: %s", ErrPromiseRejected, reason))
+			rejected, _, reject := runtime.NewPromise()
+			_ = reject(reason)
+			return runtime.ToValue(rejected)
+		}))
+	if err != nil {
+		panic(runtime.NewGoError(err))
+	}
+	return result
+}
@@ -0,0 +1,140 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc/metadata"
+)
+
+func newTestTracing(t *testing.T) (*Plugin, *tracetest.InMemoryExporter) {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+
+	p := newTestPlugin(t)
+	p.Tracing = newTracing(provider, "1.2.0")
+	require.NoError(t, p.RegisterTracingAPI())
+	return p, exporter
+}
+
+func spanAttributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+func TestTracing_RunFunction(t *testing.T) {
+	p, exporter := newTestTracing(t)
+	_, err := p.VM.RunString(`
+		function onTrafficFromClient(ctx, req) {
+			const span = tracing.startSpan("lookup", { table: "users", rows: 3 });
+			span.addEvent("cache miss");
+			span.end();
+			return tracing.withSpan("policy", (span) => {
+				span.setAttribute("allowed", true);
+				return req;
+			});
+		}
+	`)
+	require.NoError(t, err)
+	p.RegisterFunction("onTrafficFromClient")
+
+	// The trace context propagated by GatewayD is the parent of the hook span.
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", traceParent))
+	_, err = p.RunFunction(ctx, "onTrafficFromClient", newTestRequest(t))
+	require.NoError(t, err)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	lookup, policy, hook := spans[0], spans[1], spans[2]
+
+	assert.Equal(t, "onTrafficFromClient", hook.Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hook.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", hook.Parent.SpanID().String())
+	attributes := spanAttributes(hook)
+	assert.Equal(t, "onTrafficFromClient", attributes["gatewayd.hook"].AsString())
+	assert.Equal(t, "1.2.0", attributes["gatewayd.js.script_version"].AsString())
+	assert.Equal(t, "ok", attributes["gatewayd.js.outcome"].AsString())
+	assert.Contains(t, attributes, attribute.Key("gatewayd.js.vm_wait_us"))
+
+	assert.Equal(t, "lookup", lookup.Name)
+	assert.Equal(t, hook.SpanContext.SpanID(), lookup.Parent.SpanID())
+	assert.Equal(t, int64(3), spanAttributes(lookup)["rows"].AsInt64())
+	require.Len(t, lookup.Events, 1)
+	assert.Equal(t, "cache miss", lookup.Events[0].Name)
+
+	assert.Equal(t, "policy", policy.Name)
+	assert.Equal(t, hook.SpanContext.SpanID(), policy.Parent.SpanID())
+	assert.True(t, spanAttributes(policy)["allowed"].AsBool())
+}
+
+func TestTracing_Error(t *testing.T) {
+	p, exporter := newTestTracing(t)
+	_, err := p.VM.RunString(`
+		function onOpened(ctx, req) {
+			return tracing.withSpan("check", () => {
+				tracing.startSpan("nested").end();
+				throw new Error("denied");
+			});
+		}
+	`)
+	require.NoError(t, err)
+	p.RegisterFunction("onOpened")
+
+	_, err = p.RunFunction(context.Background(), "onOpened", newTestRequest(t))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "denied")
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	nested, check, hook := spans[0], spans[1], spans[2]
+	assert.Equal(t, check.SpanContext.SpanID(), nested.Parent.SpanID())
+	assert.Equal(t, codes.Error, check.Status.Code)
+	assert.Equal(t, codes.Error, hook.Status.Code)
+	assert.Equal(t, "error", spanAttributes(hook)["gatewayd.js.outcome"].AsString())
+}
+
+func TestTracing_Disabled(t *testing.T) {
+	tracing, err := NewTracing(NewTracingConfig(map[string]interface{}{}), "")
+	require.NoError(t, err)
+	assert.Nil(t, tracing)
+
+	_, err = NewTracing(NewTracingConfig(map[string]interface{}{"tracingExporter": "jaeger"}), "")
+	require.ErrorIs(t, err, ErrUnknownTracingExporter)
+
+	p := newTestPlugin(t)
+	require.NoError(t, p.RegisterTracingAPI())
+	_, err = p.VM.RunString(`
+		function onBooted(ctx, req) {
+			tracing.startSpan("noop").end();
+			return tracing.withSpan("noop", () => req);
+		}
+	`)
+	require.NoError(t, err)
+	p.RegisterFunction("onBooted")
+
+	// The span of the incoming context is not owned by the plugin, so it is
+	// neither ended nor changed by the spans of the script.
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+	ctx, incoming := provider.Tracer("gatewayd").Start(context.Background(), "incoming")
+	_, err = p.RunFunction(ctx, "onBooted", newTestRequest(t))
+	require.NoError(t, err)
+	assert.True(t, incoming.IsRecording())
+	assert.Empty(t, exporter.GetSpans())
+	incoming.End()
+	require.Len(t, exporter.GetSpans(), 1)
+	assert.Empty(t, exporter.GetSpans()[0].Attributes)
+}
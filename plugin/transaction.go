@@ -0,0 +1,159 @@
+package plugin
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/spf13/cast"
+	pgQuery "github.com/wasilibs/go-pgquery"
+)
+
+const (
+	TransactionStatusIdle   = "idle"
+	TransactionStatusActive = "transaction"
+	TransactionStatusFailed = "failed"
+)
+
+// transactionKeywords are the first keywords of the transaction control
+// statements that start or end a transaction. Queries without any of these
+// words are never parsed.
+var transactionKeywords = map[string]bool{
+	"begin": true, "start": true, "commit": true, "end": true,
+	"rollback": true, "abort": true, "prepare": true,
+}
+
+// Transaction is the transaction state of a connection.
+type Transaction struct {
+	// Status is idle, transaction or failed. It is guessed from the
+	// statements of the client, and set by the ReadyForQuery of the server.
+	Status string
+	// StartedAt is the time of the start of the transaction, if any.
+	StartedAt time.Time
+	// Statements is the number of queries run in the transaction.
+	Statements int
+	// LastActivityAt is the time of the last query of the client.
+	LastActivityAt time.Time
+}
+
+// trackStatement updates the transaction state with a query of the client,
+// given the kinds of its transaction statements.
+func (t *Transaction) trackStatement(kinds []string, now time.Time) {
+	t.LastActivityAt = now
+	for _, kind := range kinds {
+		switch kind {
+		case "TRANS_STMT_BEGIN", "TRANS_STMT_START":
+			if t.Status == TransactionStatusIdle {
+				*t = Transaction{Status: TransactionStatusActive, StartedAt: now, LastActivityAt: now}
+			}
+		case "TRANS_STMT_COMMIT", "TRANS_STMT_ROLLBACK", "TRANS_STMT_PREPARE":
+			t.end()
+		default:
+			if t.Status != TransactionStatusIdle {
+				t.Statements++
+			}
+		}
+	}
+}
+
+// readyForQuery updates the transaction state with the status of a
+// ReadyForQuery message, which answered the batch, if known.
+func (t *Transaction) readyForQuery(status byte, batch *queryBatch) {
+	switch status {
+	case 'I':
+		t.end()
+	case 'T', 'E':
+		// The server started a transaction the client statements did not.
+		if t.Status == TransactionStatusIdle {
+			t.StartedAt = time.Now()
+			t.Statements = 0
+			if batch != nil {
+				t.StartedAt = batch.started
+				t.Statements = len(batch.queries)
+			}
+		}
+		t.Status = TransactionStatusActive
+		if status == 'E' {
+			t.Status = TransactionStatusFailed
+		}
+	}
+}
+
+func (t *Transaction) end() {
+	*t = Transaction{Status: TransactionStatusIdle, LastActivityAt: t.LastActivityAt}
+}
+
+// transactionStatements returns the kinds of the statements of the query,
+// e.g. TRANS_STMT_BEGIN, with an empty kind for statements that are not
+// transaction control statements. Only queries with a keyword of these
+// statements are parsed, and the others are a single statement of an empty
+// kind, even if they have several statements.
+func transactionStatements(text string) []string {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	if !hasTransactionKeyword(text) {
+		return []string{""}
+	}
+
+	tree, err := pgQuery.ParseToJSON(text)
+	if err != nil {
+		return []string{""}
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal([]byte(tree), &result); err != nil {
+		return []string{""}
+	}
+	kinds := []string{}
+	for _, stmt := range cast.ToSlice(result["stmts"]) {
+		node := cast.ToStringMap(cast.ToStringMap(stmt)["stmt"])
+		kinds = append(kinds, cast.ToString(cast.ToStringMap(node["TransactionStmt"])["kind"]))
+	}
+	return kinds
+}
+
+// hasTransactionKeyword tells whether a word of the query, in any case, is a
+// keyword of the transaction control statements.
+func hasTransactionKeyword(text string) bool {
+	start := -1
+	for i := 0; i <= len(text); i++ {
+		if i < len(text) && isWordByte(text[i]) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && i-start <= len("rollback") && transactionKeywords[strings.ToLower(text[start:i])] {
+			return true
+		}
+		start = -1
+	}
+	return false
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+// newTransactionObject returns the JS object of a transaction state.
+func newTransactionObject(runtime *goja.Runtime, transaction Transaction) *goja.Object {
+	object := runtime.NewObject()
+	setProperty(object, "status", transaction.Status)
+	setProperty(object, "startedAt", newDate(runtime, transaction.StartedAt))
+	setProperty(object, "statements", transaction.Statements)
+	setProperty(object, "lastActivityAt", newDate(runtime, transaction.LastActivityAt))
+	return object
+}
+
+// newDate returns a JS Date, or null for the zero time.
+func newDate(runtime *goja.Runtime, t time.Time) goja.Value {
+	if t.IsZero() {
+		return goja.Null()
+	}
+	date, err := runtime.New(runtime.Get("Date"), runtime.ToValue(t.UnixMilli()))
+	if err != nil {
+		return goja.Null()
+	}
+	return date
+}
@@ -0,0 +1,136 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionStatements(t *testing.T) {
+	for query, expected := range map[string][]string{
+		"":                                  nil,
+		"SELECT 1":                          {""},
+		"begin":                             {"TRANS_STMT_BEGIN"},
+		"START TRANSACTION READ ONLY":       {"TRANS_STMT_START"},
+		"END":                               {"TRANS_STMT_COMMIT"},
+		"ROLLBACK TO SAVEPOINT a":           {"TRANS_STMT_ROLLBACK_TO"},
+		"PREPARE TRANSACTION 'tx'":          {"TRANS_STMT_PREPARE"},
+		"PREPARE q AS SELECT 1":             {""},
+		"BEGIN; UPDATE t SET a = 1; COMMIT": {"TRANS_STMT_BEGIN", "", "TRANS_STMT_COMMIT"},
+		"begin garbage":                     {""},
+		"SELECT 1;":                         {""},
+		"SELECT 1; SELECT 2;":               {""},
+		"commit;":                           {"TRANS_STMT_COMMIT"},
+		"SELECT 1; BEGIN;":                  {"", "TRANS_STMT_BEGIN"},
+	} {
+		assert.Equal(t, expected, transactionStatements(query), query)
+	}
+}
+
+func TestHasTransactionKeyword(t *testing.T) {
+	assert.False(t, hasTransactionKeyword("SELECT * FROM begins WHERE ended;"))
+	assert.False(t, hasTransactionKeyword("INSERT INTO t VALUES (1);"))
+	assert.True(t, hasTransactionKeyword("Rollback;"))
+	assert.True(t, hasTransactionKeyword("SELECT 1;BEGIN"))
+	assert.True(t, hasTransactionKeyword("SELECT CASE WHEN a THEN 1 END FROM t"))
+}
+
+func TestConnectionTracker_Transaction(t *testing.T) {
+	tracker := NewConnectionTracker()
+	req := newTrafficRequest(t, nil)
+	transaction := func() Transaction {
+		t.Helper()
+		info := tracker.Info(req)
+		require.NotNil(t, info)
+		return info.Transaction
+	}
+	respond := func(status byte) {
+		t.Helper()
+		tracker.TrackServer(newServerResponse(t, newReadyForQuery(status)))
+	}
+
+	sendQueries(t, tracker, newQueryMessage("SELECT 1"))
+	assert.Equal(t, TransactionStatusIdle, transaction().Status)
+	assert.False(t, transaction().LastActivityAt.IsZero())
+	respond('I')
+
+	// The statements of the client start the transaction before the server
+	// answers.
+	sendQueries(t, tracker, newQueryMessage("BEGIN"))
+	assert.Equal(t, TransactionStatusActive, transaction().Status)
+	started := transaction().StartedAt
+	assert.False(t, started.IsZero())
+	respond('T')
+	sendQueries(t, tracker, newQueryMessage("UPDATE t SET a = 1"))
+	respond('T')
+	sendQueries(t, tracker, newQueryMessage("SELECT 1/0"))
+	respond('E')
+	assert.Equal(t, Transaction{
+		Status:         TransactionStatusFailed,
+		StartedAt:      started,
+		Statements:     2,
+		LastActivityAt: transaction().LastActivityAt,
+	}, transaction())
+
+	sendQueries(t, tracker, newQueryMessage("ROLLBACK"))
+	assert.Equal(t, TransactionStatusIdle, transaction().Status)
+	respond('I')
+	assert.True(t, transaction().StartedAt.IsZero())
+	assert.Zero(t, transaction().Statements)
+
+	// Transactions the client statements do not start are set by the server.
+	sendQueries(t, tracker, concat(
+		newParseMessage("", "CALL begin_work()"),
+		newBindMessage("", "", nil),
+		newExecuteMessage(""),
+		newFrontendMessage('S')))
+	assert.Equal(t, TransactionStatusIdle, transaction().Status)
+	respond('T')
+	assert.Equal(t, TransactionStatusActive, transaction().Status)
+	assert.Equal(t, 1, transaction().Statements)
+	assert.False(t, transaction().StartedAt.IsZero())
+
+	var nilTracker *ConnectionTracker
+	assert.Nil(t, nilTracker.Info(req))
+	assert.Nil(t, nilTracker.List())
+}
+
+func TestPlugin_HookContextTransaction(t *testing.T) {
+	p := newTestPlugin(t)
+	p.Connections = NewConnectionTracker()
+	require.NoError(t, p.RegisterConnectionAPI())
+	require.NoError(t, p.VM.Set("Value", p.VM.ToValue(v1.NewValue)))
+	_, err := p.VM.RunString(`
+	function onTrafficFromClient(ctx, req) {
+		const transaction = ctx.connection.transaction;
+		req.Fields["status"] = Value(transaction.status);
+		req.Fields["started"] = Value(transaction.startedAt instanceof Date);
+		req.Fields["statements"] = Value(transaction.statements);
+		return req;
+	}
+	function onTick(ctx, req) {
+		req.Fields["connections"] = Value(listConnections().map(
+			(conn) => conn.remote + " " + conn.user + " " + conn.transaction.status).join(","));
+		return req;
+	}`)
+	require.NoError(t, err)
+	p.RegisterFunctions([]string{"onTrafficFromClient", "onTick"})
+
+	_, err = p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, newStartupMessage("user", "alice")))
+	require.NoError(t, err)
+	result, err := p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, newQueryMessage("BEGIN")))
+	require.NoError(t, err)
+	assert.Equal(t, TransactionStatusActive, result.AsMap()["status"])
+	assert.Equal(t, true, result.AsMap()["started"])
+
+	result, err = p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, newQueryMessage("DELETE FROM t")))
+	require.NoError(t, err)
+	assert.InDelta(t, 1, result.AsMap()["statements"], 0)
+
+	result, err = p.OnTick(context.Background(), &v1.Struct{Fields: map[string]*v1.Value{}})
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:5000 alice transaction", result.AsMap()["connections"])
+}
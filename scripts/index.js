@@ -1,15 +1,27 @@
+// The ctx object describes the current hook call: ctx.hook, ctx.hookName,
+// ctx.id, ctx.plugin, ctx.metadata, ctx.deadline, ctx.remainingMs(),
+// ctx.cancelled() and ctx.err(). In onTrafficFromClient, ctx.query is the
+// query sent by the client with the simple (Q) or the extended
+// (Parse/Bind/Execute) query protocol: ctx.query.text, ctx.query.params,
+// ctx.query.statement, ctx.query.portal and ctx.query.protocol. It is null
+// if the request runs no query, and ctx.queries lists all the queries of
+// pipelined requests. ctx.startup is the StartupMessage, SSLRequest,
+// GSSENCRequest or CancelRequest sent first by the client, and
+// ctx.connection has the user, database and applicationName of the client
+// connection in every hook.
 function onTrafficFromClient(ctx, req) {
-  const msg = req.Fields["request"].GetBytesValue()
-  switch (String.fromCharCode(msg[0])) {
-    case "Q":
-      // The client is asking for a query
-      const query = String.fromCharCode(...msg.slice(5, -1))
-      console.log("query:", query)
-      // Parse the query and log it to the console
-      // The parseSQL function returns a stringified JSON object
-      const parsedQuery = parseSQL(query)
-      console.log("parsed query:", parsedQuery)
-      break
+  // Reject connections with a FATAL ErrorResponse
+  // if (ctx.startup !== null && ctx.startup.user === "guest") {
+  //   return rejectConnection(req, "guest is not allowed", { code: "28000" })
+  // }
+
+  if (ctx.query !== null) {
+    // The client is asking for a query
+    console.log("query:", ctx.query.text, "params:", ctx.query.params)
+    // Parse the query and log it to the console
+    // The parseSQL function returns a stringified JSON object
+    const parsedQuery = parseSQL(ctx.query.text)
+    console.log("parsed query:", parsedQuery)
   }
 
   // Terminate the request immediately by modifying the request object